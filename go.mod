@@ -11,6 +11,7 @@ require (
 	github.com/pion/rtcp v1.2.10
 	github.com/pion/rtp v1.8.1
 	github.com/pion/sctp v1.8.9 // indirect
+	github.com/pion/sdp/v3 v3.0.6
 	github.com/pion/transport/v2 v2.2.4 // indirect
 	github.com/pion/turn/v2 v2.1.4 // indirect
 	github.com/pion/webrtc/v3 v3.2.21
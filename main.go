@@ -1,38 +1,164 @@
 package main
 
 import (
+	"ffmpeg-webrtc/pkg/logger"
 	"ffmpeg-webrtc/pkg/stream"
+	"flag"
+	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime/pprof"
+	"strconv"
+	"strings"
 	"syscall"
 )
 
-func main() {
-	//cpu profiling
-	f, err := os.Create("cpu.prof")
+//options are read from the command line, every option can also be set by the environment variable in envPrefix
+//command line flags take precedence over environment variables
+type options struct {
+	config     string
+	listen     string
+	rtmp       string
+	assets     string
+	logLevel   string
+	cpuProfile string
+}
+
+const envPrefix = "FFMPEG_WEBRTC_"
+
+func parseOptions(args []string) (*options, error) {
+	opts := &options{}
+
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.StringVar(&opts.config, "config", env("CONFIG", "config.json"), "path of the config file, env "+envPrefix+"CONFIG")
+	flags.StringVar(&opts.listen, "listen", env("LISTEN", ":7000"), "address the http server listens on, env "+envPrefix+"LISTEN")
+	flags.StringVar(&opts.rtmp, "rtmp", env("RTMP", ":1935"), "address the rtmp server listens on once a stream has an rtmp source, env "+envPrefix+"RTMP")
+	flags.StringVar(&opts.assets, "assets", env("ASSETS", "src"), "directory holding html/index.html, env "+envPrefix+"ASSETS")
+	flags.StringVar(&opts.logLevel, "log-level", env("LOG_LEVEL", "info"), "log level, one of debug, info or error, env "+envPrefix+"LOG_LEVEL")
+	flags.StringVar(&opts.cpuProfile, "cpuprofile", env("CPUPROFILE", ""), "write a cpu profile to this file, profiling is off when empty, env "+envPrefix+"CPUPROFILE")
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return nil, err
+	}
+
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	return opts, nil
+}
+
+//validate checks every option and names the flag and environment variable of the first invalid one
+func (o *options) validate() error {
+	if _, err := os.Stat(o.config); err != nil {
+		return optionError("config", err)
+	}
+
+	if err := validateAddress(o.listen); err != nil {
+		return optionError("listen", err)
+	}
+
+	if err := validateAddress(o.rtmp); err != nil {
+		return optionError("rtmp", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(o.assets, "html", "index.html")); err != nil {
+		return optionError("assets", err)
+	}
+
+	if err := logger.SetLevel(o.logLevel); err != nil {
+		return optionError("log-level", err)
+	}
+
+	return nil
+}
+
+//validateAddress checks a host:port address to listen on, the host may be empty
+func validateAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("port %q of %q is not a valid port", port, address)
+	}
+
+	if host != "" && net.ParseIP(host) == nil {
+		if _, err := net.LookupHost(host); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func optionError(name string, err error) error {
+	env := envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+	return fmt.Errorf("invalid -%v (%v): %v", name, env, err)
+}
+
+func env(name string, fallback string) string {
+	if value, ok := os.LookupEnv(envPrefix + name); ok {
+		return value
+	}
+
+	return fallback
+}
+
+func main() {
+	opts, err := parseOptions(os.Args)
+	if err == flag.ErrHelp {
+		return
 	}
 
-	if err := pprof.StartCPUProfile(f); err != nil {
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	defer pprof.StopCPUProfile()
+	//cpu profiling
+	if opts.cpuProfile != "" {
+		f, err := os.Create(opts.cpuProfile)
+		if err != nil {
+			log.Fatal(optionError("cpuprofile", err))
+		}
+
+		if err := pprof.StartCPUProfile(f); err != nil {
+			log.Fatal(err)
+		}
+
+		defer pprof.StopCPUProfile()
+	}
 
-	stream, err := stream.NewStream()
+	streams, err := stream.NewManager(opts.config, opts.listen, opts.rtmp, opts.assets)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if err := stream.Start(); err != nil {
+	if err := streams.Start(); err != nil {
 		log.Fatal(err)
 	}
 
+	//SIGHUP reloads the config, the other signals stop the server
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+
 	osSignals := make(chan os.Signal, 1)
 	signal.Notify(osSignals, os.Interrupt, os.Kill, syscall.SIGTERM)
-	<-osSignals
-	stream.Stop()
+
+	for {
+		select {
+		case <-reloadSignals:
+			logger.Infoln("reloading config", opts.config)
+			if err := streams.Reload(); err != nil {
+				logger.Errorf("error reloading config: %v\n", err)
+			}
+		case <-osSignals:
+			streams.Stop()
+			return
+		}
+	}
 }
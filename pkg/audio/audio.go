@@ -0,0 +1,67 @@
+package audio
+
+import "time"
+
+//Codec describes an audio codec as it is negotiated with the viewers
+type Codec struct {
+	Name        string
+	MimeType    string
+	ClockRate   uint32
+	Channels    uint16
+	SDPFmtpLine string
+	PayloadType uint8
+}
+
+//Opus is sent at 48kHz with the two channels webrtc always announces for it
+var Opus = &Codec{
+	Name:        "opus",
+	MimeType:    "audio/opus",
+	ClockRate:   48000,
+	Channels:    2,
+	SDPFmtpLine: "minptime=10;useinbandfec=1",
+	PayloadType: 111,
+}
+
+//PCMU and PCMA are g.711 mu-law and a-law, mono at 8kHz with their static payload types
+var (
+	PCMU = &Codec{
+		Name:        "pcmu",
+		MimeType:    "audio/PCMU",
+		ClockRate:   8000,
+		PayloadType: 0,
+	}
+	PCMA = &Codec{
+		Name:        "pcma",
+		MimeType:    "audio/PCMA",
+		ClockRate:   8000,
+		PayloadType: 8,
+	}
+)
+
+//G711FrameSize is the number of bytes of g.711 sent in one packet, one byte per sample makes it 20ms
+const G711FrameSize = 160
+
+//CodecByName returns the codec with the name used in the config, nil if it is unknown
+func CodecByName(name string) *Codec {
+	for _, codec := range []*Codec{Opus, PCMU, PCMA} {
+		if codec.Name == name {
+			return codec
+		}
+	}
+
+	return nil
+}
+
+//Frame is a single encoded audio packet
+//Timestamp is its capture time, PTS is set by the stream on the same timeline as the video
+type Frame struct {
+	Data      []byte
+	Duration  time.Duration
+	Timestamp time.Time
+	PTS       time.Duration
+}
+
+//RTPTimestamp converts the presentation timestamp to the clock of the codec
+func (f *Frame) RTPTimestamp(clockRate uint32) uint32 {
+	return uint32(uint64(f.PTS/time.Microsecond) * uint64(clockRate) / 1000000)
+}
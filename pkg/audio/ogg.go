@@ -0,0 +1,168 @@
+package audio
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	oggPageHeaderSize = 27
+	oggBeginOfStream  = 0x02
+)
+
+//OggOpusReader reads the opus packets of an ogg stream as written by ffmpeg -c:a libopus -f ogg
+//pages may hold any number of packets and packets may span pages, so the packets are split by their lacing values
+//a new logical stream, for example after a restart of the encoder, starts again with its header packets
+type OggOpusReader struct {
+	reader  *bufio.Reader
+	header  [oggPageHeaderSize]byte
+	packets [][]byte
+	//packet is the part of a packet that continues on the next page
+	packet []byte
+	//headers counts the header packets still to be skipped, start is set for the first audio packet of a stream
+	headers int
+	start   bool
+}
+
+func NewOggOpusReader(r io.Reader) *OggOpusReader {
+	return &OggOpusReader{reader: bufio.NewReader(r)}
+}
+
+//ReadPacket returns the next opus packet and its duration
+//start is true for the first packet of a logical stream, its time does not follow the previous packet
+func (o *OggOpusReader) ReadPacket() ([]byte, time.Duration, bool, error) {
+	for {
+		for len(o.packets) > 0 {
+			packet := o.packets[0]
+			o.packets = o.packets[1:]
+
+			if o.headers > 0 {
+				o.headers--
+				continue
+			}
+
+			duration, err := PacketDuration(packet)
+			if err != nil {
+				continue
+			}
+
+			start := o.start
+			o.start = false
+
+			return packet, duration, start, nil
+		}
+
+		if err := o.readPage(); err != nil {
+			return nil, 0, false, err
+		}
+	}
+}
+
+//Buffered returns the duration of the packets of the current page that have not been read yet
+//a page is written once it is complete, so the last packet read was captured Buffered before the page arrived
+func (o *OggOpusReader) Buffered() time.Duration {
+	var buffered time.Duration
+
+	for i, packet := range o.packets {
+		if i < o.headers {
+			continue
+		}
+
+		if duration, err := PacketDuration(packet); err == nil {
+			buffered += duration
+		}
+	}
+
+	return buffered
+}
+
+func (o *OggOpusReader) readPage() error {
+	//pages start with the capture pattern, anything else is skipped up to the next page
+	if _, err := io.ReadFull(o.reader, o.header[:4]); err != nil {
+		return err
+	}
+
+	for string(o.header[:4]) != "OggS" {
+		copy(o.header[:3], o.header[1:4])
+		if _, err := io.ReadFull(o.reader, o.header[3:4]); err != nil {
+			return err
+		}
+	}
+
+	if _, err := io.ReadFull(o.reader, o.header[4:]); err != nil {
+		return err
+	}
+
+	segments := make([]byte, o.header[26])
+	if _, err := io.ReadFull(o.reader, segments); err != nil {
+		return err
+	}
+
+	//OpusHead and OpusTags open every logical stream
+	if o.header[5]&oggBeginOfStream != 0 {
+		o.headers = 2
+		o.start = true
+		o.packet = nil
+	}
+
+	for _, size := range segments {
+		segment := make([]byte, size)
+		if _, err := io.ReadFull(o.reader, segment); err != nil {
+			return err
+		}
+
+		o.packet = append(o.packet, segment...)
+
+		//a segment shorter than 255 bytes ends the packet
+		if size < 255 {
+			o.packets = append(o.packets, o.packet)
+			o.packet = nil
+		}
+	}
+
+	//a stream without the beginning of stream page, for example a pipe opened while the encoder runs, is found by its header
+	if o.headers == 0 && len(o.packets) > 0 && bytes.HasPrefix(o.packets[0], []byte("OpusHead")) {
+		o.headers = 2
+		o.start = true
+	}
+
+	return nil
+}
+
+//PacketDuration returns the duration of an opus packet from its toc byte as described in rfc 6716
+func PacketDuration(packet []byte) (time.Duration, error) {
+	if len(packet) < 1 {
+		return 0, fmt.Errorf("opus packet is empty")
+	}
+
+	config := packet[0] >> 3
+
+	var frameDuration time.Duration
+	switch {
+	case config < 12:
+		//silk
+		frameDuration = []time.Duration{10, 20, 40, 60}[config%4] * time.Millisecond
+	case config < 16:
+		//hybrid
+		frameDuration = []time.Duration{10, 20}[config%2] * time.Millisecond
+	default:
+		//celt
+		frameDuration = []time.Duration{2500, 5000, 10000, 20000}[config%4] * time.Microsecond
+	}
+
+	frames := 1
+	switch packet[0] & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0, fmt.Errorf("opus packet is too short")
+		}
+		frames = int(packet[1] & 0x3F)
+	}
+
+	return time.Duration(frames) * frameDuration, nil
+}
@@ -0,0 +1,98 @@
+package audio
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+//oggPage writes a page with the given segments, the crc and granule position are not checked by the reader
+func oggPage(flags byte, segments []byte, data []byte) []byte {
+	page := []byte("OggS")
+	page = append(page, 0, flags)
+	page = append(page, make([]byte, 20)...)
+	page = append(page, byte(len(segments)))
+	page = append(page, segments...)
+	return append(page, data...)
+}
+
+//lacing returns the segment sizes of a packet that ends on its page
+func lacing(packet []byte) []byte {
+	var segments []byte
+	for size := len(packet); ; size -= 255 {
+		if size < 255 {
+			return append(segments, byte(size))
+		}
+		segments = append(segments, 255)
+	}
+}
+
+func TestOggPacketAcrossPages(t *testing.T) {
+	head := append([]byte("OpusHead"), 1, 2, 0x38, 1, 0x80, 0xBB, 0, 0, 0, 0, 0)
+	tags := append([]byte("OpusTags"), 0, 0, 0, 0, 0, 0, 0, 0)
+
+	//a 20ms celt packet of 600 bytes, its first 510 bytes are on the first page and end without a short segment
+	long := append([]byte{0xF8}, bytes.Repeat([]byte{0xab}, 599)...)
+	short := []byte{0xF8, 1, 2}
+	//two 10ms frames in one packet
+	double := []byte{0xF1, 3, 4}
+
+	var stream []byte
+	stream = append(stream, oggPage(oggBeginOfStream, lacing(head), head)...)
+	stream = append(stream, oggPage(0, lacing(tags), tags)...)
+	stream = append(stream, oggPage(0, append(lacing(short), 255, 255), append(append([]byte(nil), short...), long[:510]...))...)
+	stream = append(stream, oggPage(0x01, append([]byte{90}, lacing(double)...), append(append([]byte(nil), long[510:]...), double...))...)
+
+	reader := NewOggOpusReader(bytes.NewReader(stream))
+
+	want := []struct {
+		packet   []byte
+		duration time.Duration
+		start    bool
+		buffered time.Duration
+	}{
+		{short, 20 * time.Millisecond, true, 0},
+		{long, 20 * time.Millisecond, false, 20 * time.Millisecond},
+		{double, 20 * time.Millisecond, false, 0},
+	}
+
+	for i, w := range want {
+		packet, duration, start, err := reader.ReadPacket()
+		if err != nil {
+			t.Fatalf("error reading packet %d: %v", i, err)
+		}
+
+		if !bytes.Equal(packet, w.packet) || duration != w.duration || start != w.start {
+			t.Errorf("packet %d has %d bytes of %v start %v, want %d bytes of %v start %v", i, len(packet), duration, start, len(w.packet), w.duration, w.start)
+		}
+
+		if buffered := reader.Buffered(); buffered != w.buffered {
+			t.Errorf("%v is buffered after packet %d, want %v", buffered, i, w.buffered)
+		}
+	}
+
+	if _, _, _, err := reader.ReadPacket(); err != io.EOF {
+		t.Errorf("got %v at the end of the stream, want eof", err)
+	}
+}
+
+func TestOggStreamWithoutBeginning(t *testing.T) {
+	head := append([]byte("OpusHead"), 1, 2, 0x38, 1, 0x80, 0xBB, 0, 0, 0, 0, 0)
+	tags := append([]byte("OpusTags"), 0, 0, 0, 0, 0, 0, 0, 0)
+	packet := []byte{0xF8, 1}
+
+	//bytes in front of the first page, then a page with the header packets but no beginning of stream flag
+	stream := []byte{0x4F, 0x67, 1}
+	stream = append(stream, oggPage(0, append(lacing(head), lacing(tags)...), append(append([]byte(nil), head...), tags...))...)
+	stream = append(stream, oggPage(0, lacing(packet), packet)...)
+
+	got, _, start, err := NewOggOpusReader(bytes.NewReader(stream)).ReadPacket()
+	if err != nil {
+		t.Fatalf("error reading packet: %v", err)
+	}
+
+	if !bytes.Equal(got, packet) || !start {
+		t.Errorf("got %x start %v, want %x start true", got, start, packet)
+	}
+}
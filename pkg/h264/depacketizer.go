@@ -0,0 +1,121 @@
+package h264
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+//Depacketizer rebuilds access units from h264 rtp packets as described in rfc 6184
+//single nal unit packets, stap-a and fu-a are supported, an access unit ends with the marker bit or a new timestamp
+//an access unit that lost a packet is dropped, the decoder recovers with the next keyframe
+type Depacketizer struct {
+	nals      [][]byte
+	fragment  []byte
+	timestamp uint32
+	sequence  uint16
+	started   bool
+	broken    bool
+	//ended is set when the last packet had the marker bit, packets lost after it only held whole access units
+	ended bool
+}
+
+func NewDepacketizer() *Depacketizer {
+	return &Depacketizer{}
+}
+
+//Write adds a packet, packets have to be written in sequence number order
+//emit is called for every complete access unit together with its rtp timestamp
+func (d *Depacketizer) Write(packet *rtp.Packet, emit func(frame *Frame, timestamp uint32)) {
+	//a gap after the marker bit lost whole access units, the next one is complete as long as its packets arrive
+	//otherwise the access unit being assembled lost a part of it
+	lost := d.started && packet.SequenceNumber != d.sequence+1 && !d.ended
+	d.started = true
+	d.sequence = packet.SequenceNumber
+	d.ended = packet.Marker
+
+	if lost {
+		d.nals = nil
+		d.fragment = nil
+	}
+
+	if packet.Timestamp != d.timestamp {
+		d.flush(emit)
+		d.timestamp = packet.Timestamp
+	}
+
+	//the lost packet may have been the start of this access unit
+	if lost {
+		d.broken = true
+	}
+
+	if !d.broken {
+		d.add(packet.Payload)
+	}
+
+	if packet.Marker {
+		d.flush(emit)
+	}
+}
+
+//flush emits the current access unit unless it is broken
+func (d *Depacketizer) flush(emit func(frame *Frame, timestamp uint32)) {
+	if !d.broken && len(d.nals) > 0 {
+		emit(NewFrame(d.nals, time.Now()), d.timestamp)
+	}
+
+	d.nals = nil
+	d.fragment = nil
+	d.broken = false
+}
+
+//add splits a payload into nal units, the payload buffer may be reused by the caller so the nal units are copied
+func (d *Depacketizer) add(payload []byte) {
+	if len(payload) < 1 {
+		return
+	}
+
+	switch naltype := NalType(payload); {
+	case naltype >= NALU_TYPE_P && naltype <= 23:
+		d.nals = append(d.nals, append([]byte(nil), payload...))
+
+	case naltype == NALU_TYPE_STAPA:
+		for data := payload[1:]; len(data) > 2; {
+			size := int(binary.BigEndian.Uint16(data))
+			data = data[2:]
+
+			if size == 0 || size > len(data) {
+				d.broken = true
+				return
+			}
+
+			d.nals = append(d.nals, append([]byte(nil), data[:size]...))
+			data = data[size:]
+		}
+
+	case naltype == NALU_TYPE_FUA:
+		if len(payload) < 2 {
+			d.broken = true
+			return
+		}
+
+		indicator, header := payload[0], payload[1]
+
+		//the start bit begins a new nal unit, its header is rebuilt from the fu indicator and fu header
+		if header&0x80 != 0 {
+			d.fragment = append([]byte{indicator&0xE0 | header&0x1F}, payload[2:]...)
+		} else if d.fragment != nil {
+			d.fragment = append(d.fragment, payload[2:]...)
+		} else {
+			d.broken = true
+			return
+		}
+
+		//the end bit completes the nal unit
+		if header&0x40 != 0 && d.fragment != nil {
+			d.nals = append(d.nals, d.fragment)
+			d.fragment = nil
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package h264
+
+import (
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+//testAccessUnit returns the packets of an access unit with a p slice sent as three fu-a fragments
+func testAccessUnit(sequence uint16, timestamp uint32) []*rtp.Packet {
+	var packets []*rtp.Packet
+
+	for i, header := range []byte{0x81, 0x01, 0x41} {
+		packets = append(packets, &rtp.Packet{
+			Header:  rtp.Header{SequenceNumber: sequence + uint16(i), Timestamp: timestamp, Marker: i == 2},
+			Payload: []byte{0x40 | NALU_TYPE_FUA, header, byte(i)},
+		})
+	}
+
+	return packets
+}
+
+func TestDepacketizerLoss(t *testing.T) {
+	tests := []struct {
+		name string
+		//lost are the indexes of the packets that do not arrive
+		lost []int
+		want []uint32
+	}{
+		{"no loss", nil, []uint32{3000, 6000, 9000}},
+		{"loss of a whole access unit", []int{3, 4, 5}, []uint32{3000, 9000}},
+		{"loss inside an access unit", []int{4}, []uint32{3000, 9000}},
+		{"loss of the start of an access unit", []int{3}, []uint32{3000, 9000}},
+		//without the marker bit the gap may also hold the start of the next access unit
+		{"loss of the end of an access unit", []int{5}, []uint32{3000}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var packets []*rtp.Packet
+			for i, timestamp := range []uint32{3000, 6000, 9000} {
+				packets = append(packets, testAccessUnit(uint16(100+3*i), timestamp)...)
+			}
+
+			lost := make(map[int]bool)
+			for _, i := range test.lost {
+				lost[i] = true
+			}
+
+			var got []uint32
+			depacketizer := NewDepacketizer()
+
+			for i, packet := range packets {
+				if lost[i] {
+					continue
+				}
+
+				depacketizer.Write(packet, func(frame *Frame, timestamp uint32) {
+					if len(frame.NALs) != 1 || len(frame.NALs[0]) != 1+3 {
+						t.Errorf("access unit at %d is not the nal unit of the 3 fragments", timestamp)
+					}
+					got = append(got, timestamp)
+				})
+			}
+
+			if len(got) != len(test.want) {
+				t.Fatalf("got access units at %v, want %v", got, test.want)
+			}
+
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("got access units at %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
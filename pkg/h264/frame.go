@@ -0,0 +1,102 @@
+package h264
+
+import "time"
+
+//Frame is a complete access unit, all nal units that make up one picture
+//Data owns its bytes and holds the nal units in annex b format with 4 byte start codes
+//NALs holds the nal units without start codes and points into Data
+//Timestamp is the capture time, PTS is the presentation time relative to the start of the stream
+//Offset is the position of the access unit in the data written to the parser that emitted it
+type Frame struct {
+	Data      []byte
+	NALs      [][]byte
+	Keyframe  bool
+	Timestamp time.Time
+	PTS       time.Duration
+	Offset    int64
+}
+
+//ClockRate is the rtp clock rate of h264
+const ClockRate = 90000
+
+var startCode = []byte{0, 0, 0, 1}
+
+//NewFrame builds a frame from a list of nal units, the nal units are copied
+func NewFrame(nals [][]byte, timestamp time.Time) *Frame {
+	size := 0
+	for _, nal := range nals {
+		size += len(startCode) + len(nal)
+	}
+
+	frame := &Frame{
+		Data:      make([]byte, 0, size),
+		NALs:      make([][]byte, 0, len(nals)),
+		Timestamp: timestamp,
+	}
+
+	for _, nal := range nals {
+		if len(nal) == 0 {
+			continue
+		}
+
+		frame.Data = append(frame.Data, startCode...)
+		start := len(frame.Data)
+		frame.Data = append(frame.Data, nal...)
+		frame.NALs = append(frame.NALs, frame.Data[start:])
+
+		if NalType(nal) == NALU_TYPE_IDR {
+			frame.Keyframe = true
+		}
+	}
+
+	return frame
+}
+
+//NalType returns the type of a nal unit without start code
+func NalType(nal []byte) byte {
+	if len(nal) == 0 {
+		return 0
+	}
+
+	return nal[0] & 0x1F
+}
+
+//RTPTimestamp converts the presentation time to the 90kHz rtp clock, the value wraps around like rtp timestamps do
+func (f *Frame) RTPTimestamp() uint32 {
+	return uint32(uint64(f.PTS/time.Microsecond) * ClockRate / 1000000)
+}
+
+//SPS returns the sps of the frame if it carries one
+func (f *Frame) SPS() []byte {
+	return f.nal(NALU_TYPE_SPS)
+}
+
+//PPS returns the pps of the frame if it carries one
+func (f *Frame) PPS() []byte {
+	return f.nal(NALU_TYPE_PPS)
+}
+
+func (f *Frame) nal(naltype byte) []byte {
+	for _, nal := range f.NALs {
+		if NalType(nal) == naltype {
+			return nal
+		}
+	}
+
+	return nil
+}
+
+//WithParameterSets returns the frame with sps and pps prepended if it is a keyframe that does not carry them
+//the frame itself is returned when it needs no parameter sets or sps or pps is missing
+func (f *Frame) WithParameterSets(sps []byte, pps []byte) *Frame {
+	if !f.Keyframe || (f.SPS() != nil && f.PPS() != nil) || sps == nil || pps == nil {
+		return f
+	}
+
+	nals := append([][]byte{sps, pps}, f.NALs...)
+	withParameterSets := NewFrame(nals, f.Timestamp)
+	withParameterSets.PTS = f.PTS
+	withParameterSets.Offset = f.Offset
+
+	return withParameterSets
+}
@@ -0,0 +1,139 @@
+package h264
+
+import "time"
+
+//Parser is an incremental annex b parser, data can be written in chunks of any size
+//and complete access units are emitted once the start of the next access unit is seen
+type Parser struct {
+	buf     []byte
+	scanned int
+	//consumed counts the bytes dropped from the front of buf, offset is the position of the current access unit
+	consumed  int64
+	offset    int64
+	nals      [][]byte
+	hasVCL    bool
+	timestamp time.Time
+}
+
+func NewParser() *Parser {
+	return &Parser{}
+}
+
+//Write appends data to the parser and calls emit for every access unit completed by it
+func (p *Parser) Write(data []byte, emit func(*Frame)) {
+	now := time.Now()
+	p.buf = append(p.buf, data...)
+
+	//find the first start code, anything in front of it is garbage
+	nalStart, prefixLength := findNal(p.buf, 0)
+	if nalStart == -1 {
+		p.scanned = 0
+		if len(p.buf) > 3 {
+			//keep the trailing bytes, they may be the beginning of a start code
+			p.consumed += int64(len(p.buf) - 3)
+			p.buf = append(p.buf[:0], p.buf[len(p.buf)-3:]...)
+		}
+		return
+	}
+
+	for {
+		prefixStart := nalStart
+		prevNalStart := nalStart + prefixLength
+
+		//continue scanning where the previous write stopped, the last bytes may be part of a start code
+		scanFrom := prevNalStart
+		if p.scanned-len(startCode) > scanFrom {
+			scanFrom = p.scanned - len(startCode)
+		}
+
+		nalStart, prefixLength = findNal(p.buf, scanFrom)
+		if nalStart == -1 {
+			//the nal unit is not complete yet, keep it including its start code as it was written
+			//so the offset of its access unit still points at the first byte of the start code
+			if prefixStart > 0 {
+				p.consumed += int64(prefixStart)
+				p.buf = append(p.buf[:0], p.buf[prefixStart:]...)
+			}
+			p.scanned = len(p.buf)
+			return
+		}
+
+		p.scanned = 0
+		p.addNal(p.buf[prevNalStart:nalStart], p.consumed+int64(prefixStart), now, emit)
+	}
+}
+
+//Flush emits the access unit that is still buffered, it is used when the input has ended
+func (p *Parser) Flush(emit func(*Frame)) {
+	nalStart, prefixLength := findNal(p.buf, 0)
+	if nalStart != -1 {
+		p.addNal(p.buf[nalStart+prefixLength:], p.consumed+int64(nalStart), time.Now(), emit)
+	}
+
+	p.consumed += int64(len(p.buf))
+	p.buf = p.buf[:0]
+	p.scanned = 0
+
+	if len(p.nals) > 0 {
+		emit(p.frame())
+	}
+}
+
+//addNal adds a nal unit to the current access unit, starting a new one when the nal unit begins the next picture
+func (p *Parser) addNal(nal []byte, offset int64, now time.Time, emit func(*Frame)) {
+	if len(nal) == 0 {
+		return
+	}
+
+	if p.hasVCL && startsAccessUnit(nal) {
+		emit(p.frame())
+	}
+
+	if len(p.nals) == 0 {
+		p.timestamp = now
+		p.offset = offset
+	}
+
+	//the buffer is reused, the nal unit has to be copied
+	nalCopy := make([]byte, len(nal))
+	copy(nalCopy, nal)
+	p.nals = append(p.nals, nalCopy)
+
+	if isVCL(nal) {
+		p.hasVCL = true
+	}
+}
+
+func (p *Parser) frame() *Frame {
+	frame := NewFrame(p.nals, p.timestamp)
+	frame.Offset = p.offset
+
+	p.nals = nil
+	p.hasVCL = false
+
+	return frame
+}
+
+//isVCL reports whether the nal unit contains slice data
+func isVCL(nal []byte) bool {
+	naltype := NalType(nal)
+	return naltype >= NALU_TYPE_P && naltype <= NALU_TYPE_IDR
+}
+
+//startsAccessUnit reports whether the nal unit begins a new access unit once the current one has slice data
+//aud, sps, pps, sei and the reserved types 14 to 18 always start a new one, slices start one when first_mb_in_slice is 0
+func startsAccessUnit(nal []byte) bool {
+	naltype := NalType(nal)
+
+	switch {
+	case naltype == NALU_TYPE_AUD, naltype == NALU_TYPE_SPS, naltype == NALU_TYPE_PPS, naltype == NALU_TYPE_SEI:
+		return true
+	case naltype >= 14 && naltype <= 18:
+		return true
+	case naltype == NALU_TYPE_P || naltype == NALU_TYPE_IDR:
+		//first_mb_in_slice is exp-golomb coded, a value of 0 is a single 1 bit
+		return len(nal) > 1 && nal[1]&0x80 != 0
+	}
+
+	return false
+}
@@ -0,0 +1,106 @@
+package h264
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+type testUnit struct {
+	nals     [][]byte
+	keyframe bool
+}
+
+//testStream returns an annex b stream that mixes 3 and 4 byte start codes, starting with bytes that are no nal unit
+//together with its access units and their offsets
+func testStream() ([]byte, []testUnit, []int64) {
+	units := []testUnit{
+		{[][]byte{{0x09, 0xf0}, {0x67, 0x42, 0x00, 0x1f, 0xe9}, {0x68, 0xce, 0x3c, 0x80}, {0x65, 0x88, 0x84, 0x00, 0x33, 0xff}}, true},
+		//a picture of two slices, the second one does not start at macroblock 0
+		{[][]byte{{0x41, 0x9a, 0x01, 0x02}, {0x41, 0x40, 0x03, 0x04, 0x05}}, false},
+		{[][]byte{{0x06, 0x05, 0x01, 0x80}, {0x41, 0x9a, 0x06}}, false},
+		{[][]byte{{0x65, 0xb8, 0x00, 0x01, 0x07, 0x08, 0x09}}, true},
+		{[][]byte{{0x41, 0x9a, 0x0a, 0x0b}}, false},
+	}
+
+	stream := []byte{0xde, 0xad, 0x01}
+	var offsets []int64
+
+	for i, unit := range units {
+		offsets = append(offsets, int64(len(stream)))
+
+		for j, nal := range unit.nals {
+			if (i+j)%2 == 0 {
+				stream = append(stream, 0, 0, 0, 1)
+			} else {
+				stream = append(stream, 0, 0, 1)
+			}
+			stream = append(stream, nal...)
+		}
+	}
+
+	return stream, units, offsets
+}
+
+func TestParserChunks(t *testing.T) {
+	stream, units, offsets := testStream()
+	random := rand.New(rand.NewSource(1))
+
+	tests := []struct {
+		name string
+		size func() int
+	}{
+		{"whole", func() int { return len(stream) }},
+		{"1 byte", func() int { return 1 }},
+		{"3 bytes", func() int { return 3 }},
+		{"random", func() int { return 1 + random.Intn(12) }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parser := NewParser()
+
+			var frames []*Frame
+			emit := func(frame *Frame) {
+				frames = append(frames, frame)
+			}
+
+			for data := stream; len(data) > 0; {
+				size := test.size()
+				if size > len(data) {
+					size = len(data)
+				}
+
+				parser.Write(data[:size], emit)
+				data = data[size:]
+			}
+
+			//the last nal unit only ends with the input, so the access unit before it is not known to be complete either
+			if len(frames) != len(units)-2 {
+				t.Fatalf("got %d access units before the flush, want %d", len(frames), len(units)-2)
+			}
+			parser.Flush(emit)
+
+			if len(frames) != len(units) {
+				t.Fatalf("got %d access units, want %d", len(frames), len(units))
+			}
+
+			for i, frame := range frames {
+				if frame.Offset != offsets[i] || frame.Keyframe != units[i].keyframe {
+					t.Errorf("access unit %d is at %d keyframe %v, want %d keyframe %v", i, frame.Offset, frame.Keyframe, offsets[i], units[i].keyframe)
+				}
+
+				if len(frame.NALs) != len(units[i].nals) {
+					t.Errorf("access unit %d has %d nal units, want %d", i, len(frame.NALs), len(units[i].nals))
+					continue
+				}
+
+				for j, nal := range frame.NALs {
+					if !bytes.Equal(nal, units[i].nals[j]) {
+						t.Errorf("nal unit %d of access unit %d is %x, want %x", j, i, nal, units[i].nals[j])
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package h264
+
+import (
+	"errors"
+	"fmt"
+)
+
+//SPS holds the fields of a sequence parameter set that are needed for timing and metadata
+//FrameRate is 0 when the sps carries no vui timing info
+type SPS struct {
+	ProfileIDC     uint8
+	LevelIDC       uint8
+	Width          int
+	Height         int
+	FrameRate      float64
+	FixedFrameRate bool
+}
+
+var errShortSPS = errors.New("sps is too short")
+
+//ParseSPS parses a sps nal unit without start code
+func ParseSPS(nal []byte) (*SPS, error) {
+	if NalType(nal) != NALU_TYPE_SPS {
+		return nil, fmt.Errorf("nal unit type %d is not a sps", NalType(nal))
+	}
+
+	r := &bitReader{data: removeEmulationPrevention(nal[1:])}
+	sps := &SPS{}
+
+	sps.ProfileIDC = uint8(r.bits(8))
+	r.bits(8) //constraint flags
+	sps.LevelIDC = uint8(r.bits(8))
+	r.ue() //seq_parameter_set_id
+
+	chromaFormatIDC := uint64(1)
+
+	switch sps.ProfileIDC {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormatIDC = r.ue()
+		if chromaFormatIDC == 3 {
+			r.bits(1) //separate_colour_plane_flag
+		}
+		r.ue()    //bit_depth_luma_minus8
+		r.ue()    //bit_depth_chroma_minus8
+		r.bits(1) //qpprime_y_zero_transform_bypass_flag
+
+		if r.bits(1) == 1 { //seq_scaling_matrix_present_flag
+			count := 8
+			if chromaFormatIDC == 3 {
+				count = 12
+			}
+
+			for i := 0; i < count; i++ {
+				if r.bits(1) == 0 {
+					continue
+				}
+
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				r.skipScalingList(size)
+			}
+		}
+	}
+
+	r.ue() //log2_max_frame_num_minus4
+
+	pocType := r.ue()
+	if pocType == 0 {
+		r.ue() //log2_max_pic_order_cnt_lsb_minus4
+	} else if pocType == 1 {
+		r.bits(1) //delta_pic_order_always_zero_flag
+		r.se()    //offset_for_non_ref_pic
+		r.se()    //offset_for_top_to_bottom_field
+		cycle := r.ue()
+		for i := uint64(0); i < cycle && r.err == nil; i++ {
+			r.se() //offset_for_ref_frame
+		}
+	}
+
+	r.ue()    //max_num_ref_frames
+	r.bits(1) //gaps_in_frame_num_value_allowed_flag
+
+	widthInMbs := int(r.ue()) + 1
+	heightInMapUnits := int(r.ue()) + 1
+
+	frameMbsOnly := int(r.bits(1))
+	if frameMbsOnly == 0 {
+		r.bits(1) //mb_adaptive_frame_field_flag
+	}
+	r.bits(1) //direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom int
+	if r.bits(1) == 1 {
+		cropLeft = int(r.ue())
+		cropRight = int(r.ue())
+		cropTop = int(r.ue())
+		cropBottom = int(r.ue())
+	}
+
+	cropUnitX, cropUnitY := 1, 2-frameMbsOnly
+	if chromaFormatIDC == 1 {
+		cropUnitX, cropUnitY = 2, 2*(2-frameMbsOnly)
+	} else if chromaFormatIDC == 2 {
+		cropUnitX = 2
+	}
+
+	sps.Width = widthInMbs*16 - cropUnitX*(cropLeft+cropRight)
+	sps.Height = (2-frameMbsOnly)*heightInMapUnits*16 - cropUnitY*(cropTop+cropBottom)
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if r.bits(1) == 1 { //vui_parameters_present_flag
+		r.parseVUITiming(sps)
+	}
+
+	//the vui is optional, a sps that ends early still has valid dimensions
+	if r.err != nil {
+		sps.FrameRate = 0
+		sps.FixedFrameRate = false
+	}
+
+	return sps, nil
+}
+
+//parseVUITiming reads the vui up to and including the timing info
+func (r *bitReader) parseVUITiming(sps *SPS) {
+	if r.bits(1) == 1 { //aspect_ratio_info_present_flag
+		if r.bits(8) == 255 { //extended_sar
+			r.bits(16) //sar_width
+			r.bits(16) //sar_height
+		}
+	}
+
+	if r.bits(1) == 1 { //overscan_info_present_flag
+		r.bits(1) //overscan_appropriate_flag
+	}
+
+	if r.bits(1) == 1 { //video_signal_type_present_flag
+		r.bits(3)           //video_format
+		r.bits(1)           //video_full_range_flag
+		if r.bits(1) == 1 { //colour_description_present_flag
+			r.bits(24) //colour_primaries, transfer_characteristics, matrix_coefficients
+		}
+	}
+
+	if r.bits(1) == 1 { //chroma_loc_info_present_flag
+		r.ue() //chroma_sample_loc_type_top_field
+		r.ue() //chroma_sample_loc_type_bottom_field
+	}
+
+	if r.bits(1) == 1 { //timing_info_present_flag
+		numUnitsInTick := r.bits(32)
+		timeScale := r.bits(32)
+		sps.FixedFrameRate = r.bits(1) == 1
+
+		//a frame consists of two fields, hence the division by two
+		if numUnitsInTick > 0 {
+			sps.FrameRate = float64(timeScale) / float64(2*numUnitsInTick)
+		}
+	}
+}
+
+//removeEmulationPrevention removes the 0x03 bytes inserted after two zeros to prevent start code emulation
+func removeEmulationPrevention(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	zeros := 0
+
+	for _, b := range data {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+
+		out = append(out, b)
+	}
+
+	return out
+}
+
+//bitReader reads bits and exp-golomb codes, the first error is kept and all further reads return 0
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *bitReader) bits(n int) uint64 {
+	var v uint64
+
+	for i := 0; i < n; i++ {
+		if r.err != nil {
+			return 0
+		}
+
+		if r.pos/8 >= len(r.data) {
+			r.err = errShortSPS
+			return 0
+		}
+
+		bit := (r.data[r.pos/8] >> (7 - uint(r.pos%8))) & 1
+		v = v<<1 | uint64(bit)
+		r.pos++
+	}
+
+	return v
+}
+
+//ue reads an unsigned exp-golomb code
+func (r *bitReader) ue() uint64 {
+	zeros := 0
+	for r.bits(1) == 0 {
+		if r.err != nil || zeros > 31 {
+			r.err = errShortSPS
+			return 0
+		}
+		zeros++
+	}
+
+	return (1<<uint(zeros) - 1) + r.bits(zeros)
+}
+
+//se reads a signed exp-golomb code
+func (r *bitReader) se() int64 {
+	v := r.ue()
+	if v%2 == 0 {
+		return -int64(v / 2)
+	}
+
+	return int64(v+1) / 2
+}
+
+func (r *bitReader) skipScalingList(size int) {
+	lastScale, nextScale := int64(8), int64(8)
+
+	for i := 0; i < size && r.err == nil; i++ {
+		if nextScale != 0 {
+			nextScale = (lastScale + r.se() + 256) % 256
+		}
+
+		if nextScale != 0 {
+			lastScale = nextScale
+		}
+	}
+}
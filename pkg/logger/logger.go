@@ -0,0 +1,79 @@
+package logger
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+//the log levels, messages below the configured level are dropped
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelError
+)
+
+var levelNames = map[string]int32{
+	"debug": LevelDebug,
+	"info":  LevelInfo,
+	"error": LevelError,
+}
+
+var (
+	level  = int32(LevelInfo)
+	output = log.New(os.Stdout, "", log.LstdFlags)
+)
+
+//SetLevel sets the level by name, one of debug, info or error
+func SetLevel(name string) error {
+	l, ok := levelNames[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown log level %q, must be one of debug, info or error", name)
+	}
+
+	atomic.StoreInt32(&level, l)
+
+	return nil
+}
+
+func Debugf(format string, args ...interface{}) {
+	logf(LevelDebug, "DEBUG ", format, args...)
+}
+
+func Debugln(args ...interface{}) {
+	logln(LevelDebug, "DEBUG ", args...)
+}
+
+func Infof(format string, args ...interface{}) {
+	logf(LevelInfo, "INFO ", format, args...)
+}
+
+func Infoln(args ...interface{}) {
+	logln(LevelInfo, "INFO ", args...)
+}
+
+func Errorf(format string, args ...interface{}) {
+	logf(LevelError, "ERROR ", format, args...)
+}
+
+func Errorln(args ...interface{}) {
+	logln(LevelError, "ERROR ", args...)
+}
+
+func logf(l int32, prefix string, format string, args ...interface{}) {
+	if l < atomic.LoadInt32(&level) {
+		return
+	}
+
+	output.Output(3, prefix+strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+}
+
+func logln(l int32, prefix string, args ...interface{}) {
+	if l < atomic.LoadInt32(&level) {
+		return
+	}
+
+	output.Output(3, prefix+strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
+}
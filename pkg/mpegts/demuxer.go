@@ -0,0 +1,285 @@
+package mpegts
+
+import "encoding/binary"
+
+const (
+	//PacketSize is the size of a transport stream packet
+	PacketSize = 188
+	//ClockRate is the clock rate of pts and dts
+	ClockRate = 90000
+	//StreamTypeH264 is the stream type of h264 video in the pmt
+	StreamTypeH264 = 0x1B
+)
+
+const (
+	syncByte = 0x47
+	pidPAT   = 0x0000
+	pidNull  = 0x1FFF
+	tablePAT = 0x00
+	tablePMT = 0x02
+)
+
+//Demuxer extracts the h264 elementary stream of the first program of a transport stream
+//the pmt is found through the pat, psi sections have to fit into a single packet which is the case for all common muxers
+//a pes that lost a packet is dropped, the lost packets are counted by ContinuityErrors
+type Demuxer struct {
+	buf        []byte
+	pmtPID     uint16
+	videoPID   uint16
+	continuity map[uint16]byte
+	pes        []byte
+	broken     bool
+	pts        uint64
+	dts        uint64
+	//synced is set once a packet was found followed by the sync byte of the next one
+	synced bool
+	//continuityErrors counts the packets with an unexpected continuity counter
+	continuityErrors int64
+}
+
+func NewDemuxer() *Demuxer {
+	return &Demuxer{continuity: make(map[uint16]byte)}
+}
+
+//ContinuityErrors returns the number of continuity counter errors seen so far
+func (d *Demuxer) ContinuityErrors() int64 {
+	return d.continuityErrors
+}
+
+//Write adds data of any size, a stream that is not aligned to packets is resynchronized on the sync byte
+//emit is called with the payload of every complete h264 pes, its 33 bit pts and its dts, which is the pts when the pes has no dts
+//pes arrive in decode order, so with b-frames only the dts grows steadily while the pts gives the time of the picture
+//a pes without timestamps gets the ones of the previous pes, the data is only valid during the call
+func (d *Demuxer) Write(data []byte, emit func(data []byte, pts uint64, dts uint64)) {
+	d.buf = append(d.buf, data...)
+
+	start := 0
+	for len(d.buf)-start >= PacketSize {
+		if d.buf[start] != syncByte {
+			start++
+			d.synced = false
+			continue
+		}
+
+		//a sync byte inside the payload is not a packet start if the next packet does not start with one
+		//a packet whose successor has not arrived yet is only taken while the stream is in sync
+		if len(d.buf)-start > PacketSize {
+			if d.buf[start+PacketSize] != syncByte {
+				start++
+				d.synced = false
+				continue
+			}
+			d.synced = true
+		} else if !d.synced {
+			break
+		}
+
+		d.packet(d.buf[start:start+PacketSize], emit)
+		start += PacketSize
+	}
+
+	d.buf = append(d.buf[:0], d.buf[start:]...)
+}
+
+func (d *Demuxer) packet(packet []byte, emit func(data []byte, pts uint64, dts uint64)) {
+	//transport_error_indicator
+	if packet[1]&0x80 != 0 {
+		return
+	}
+
+	unitStart := packet[1]&0x40 != 0
+	pid := binary.BigEndian.Uint16(packet[1:3]) & 0x1FFF
+	adaptation := packet[3] >> 4 & 0x03
+	counter := packet[3] & 0x0F
+
+	if pid == pidNull {
+		return
+	}
+
+	payload := packet[4:]
+	discontinuity := false
+
+	if adaptation&0x02 != 0 {
+		length := int(payload[0])
+		if length+1 > len(payload) {
+			return
+		}
+		discontinuity = length > 0 && payload[1]&0x80 != 0
+		payload = payload[1+length:]
+	}
+
+	//the counter only advances with packets that carry a payload
+	if adaptation&0x01 == 0 {
+		return
+	}
+
+	previous, seen := d.continuity[pid]
+	d.continuity[pid] = counter
+
+	if seen && !discontinuity {
+		//a packet may be sent twice in a row
+		if counter == previous {
+			return
+		}
+
+		if counter != (previous+1)&0x0F {
+			d.continuityErrors++
+			if pid == d.videoPID {
+				d.broken = true
+			}
+		}
+	}
+
+	switch {
+	case pid == pidPAT:
+		d.parsePAT(section(payload, unitStart))
+	case pid == d.pmtPID && d.pmtPID != 0:
+		d.parsePMT(section(payload, unitStart))
+	case pid == d.videoPID && d.videoPID != 0:
+		d.addPES(payload, unitStart, emit)
+	}
+}
+
+//section returns the psi section that starts in the payload after the pointer field
+func section(payload []byte, unitStart bool) []byte {
+	if !unitStart || len(payload) < 1 {
+		return nil
+	}
+
+	pointer := int(payload[0])
+	if 1+pointer >= len(payload) {
+		return nil
+	}
+
+	payload = payload[1+pointer:]
+	if len(payload) < 3 {
+		return nil
+	}
+
+	//section_length counts the bytes after it including the crc
+	length := int(binary.BigEndian.Uint16(payload[1:3]) & 0x0FFF)
+	if 3+length > len(payload) || length < 4 {
+		return nil
+	}
+
+	return payload[:3+length-4]
+}
+
+//parsePAT selects the pmt of the first program, program 0 points to the network information table
+func (d *Demuxer) parsePAT(section []byte) {
+	if len(section) < 8 || section[0] != tablePAT {
+		return
+	}
+
+	for entries := section[8:]; len(entries) >= 4; entries = entries[4:] {
+		program := binary.BigEndian.Uint16(entries[0:2])
+		pid := binary.BigEndian.Uint16(entries[2:4]) & 0x1FFF
+
+		if program == 0 {
+			continue
+		}
+
+		if pid != d.pmtPID {
+			d.pmtPID = pid
+			d.videoPID = 0
+			d.pes = d.pes[:0]
+		}
+
+		return
+	}
+}
+
+//parsePMT selects the first h264 stream of the program
+func (d *Demuxer) parsePMT(section []byte) {
+	if len(section) < 12 || section[0] != tablePMT {
+		return
+	}
+
+	infoLength := int(binary.BigEndian.Uint16(section[10:12]) & 0x0FFF)
+	if 12+infoLength > len(section) {
+		return
+	}
+
+	for streams := section[12+infoLength:]; len(streams) >= 5; {
+		streamType := streams[0]
+		pid := binary.BigEndian.Uint16(streams[1:3]) & 0x1FFF
+		esInfoLength := int(binary.BigEndian.Uint16(streams[3:5]) & 0x0FFF)
+
+		if streamType == StreamTypeH264 {
+			if pid != d.videoPID {
+				d.videoPID = pid
+				d.pes = d.pes[:0]
+				d.broken = true
+			}
+			return
+		}
+
+		if 5+esInfoLength > len(streams) {
+			return
+		}
+		streams = streams[5+esInfoLength:]
+	}
+}
+
+//addPES collects the packets of a pes, a pes ends with the start of the next one or when its length is reached
+func (d *Demuxer) addPES(payload []byte, unitStart bool, emit func(data []byte, pts uint64, dts uint64)) {
+	if unitStart {
+		d.flush(emit)
+		d.broken = false
+	} else if len(d.pes) == 0 {
+		//the start of the pes was lost
+		return
+	}
+
+	d.pes = append(d.pes, payload...)
+
+	//video pes usually have no length and end with the next pes
+	if len(d.pes) >= 6 {
+		length := int(binary.BigEndian.Uint16(d.pes[4:6]))
+		if length > 0 && len(d.pes) >= 6+length {
+			d.pes = d.pes[:6+length]
+			d.flush(emit)
+		}
+	}
+}
+
+//flush parses the header of the collected pes and emits its payload
+func (d *Demuxer) flush(emit func(data []byte, pts uint64, dts uint64)) {
+	pes := d.pes
+	d.pes = d.pes[:0]
+
+	if d.broken || len(pes) < 9 {
+		return
+	}
+
+	//packet_start_code_prefix 00 00 01
+	if pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return
+	}
+
+	headerLength := int(pes[8])
+	if 9+headerLength > len(pes) {
+		return
+	}
+
+	//PTS_DTS_flags, 10 is a pts only, 11 a pts followed by a dts
+	switch {
+	case pes[7]&0xC0 == 0xC0 && headerLength >= 10:
+		d.pts = parseTimestamp(pes[9:14])
+		d.dts = parseTimestamp(pes[14:19])
+	case pes[7]&0x80 != 0 && headerLength >= 5:
+		d.pts = parseTimestamp(pes[9:14])
+		d.dts = d.pts
+	}
+
+	emit(pes[9+headerLength:], d.pts, d.dts)
+}
+
+//parseTimestamp reads a 33 bit pts or dts spread over 5 bytes with marker bits
+func parseTimestamp(b []byte) uint64 {
+	return uint64(b[0]>>1&0x07)<<30 |
+		uint64(b[1])<<22 |
+		uint64(b[2]>>1)<<15 |
+		uint64(b[3])<<7 |
+		uint64(b[4]>>1)
+}
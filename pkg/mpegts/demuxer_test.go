@@ -0,0 +1,211 @@
+package mpegts
+
+import (
+	"bytes"
+	"testing"
+)
+
+const (
+	testPMTPID   = 0x1000
+	testVideoPID = 0x0100
+)
+
+//muxer writes a transport stream of a single program with h264 video, the continuity counters are kept per pid
+type muxer struct {
+	counters map[uint16]byte
+	packets  [][]byte
+}
+
+func newMuxer() *muxer {
+	m := &muxer{counters: make(map[uint16]byte)}
+
+	//the crc is not checked by the demuxer
+	m.packet(pidPAT, true, []byte{0, tablePAT, 0xB0, 13, 0, 1, 0xC1, 0, 0,
+		0, 1, 0xE0 | testPMTPID>>8, testPMTPID & 0xFF,
+		0, 0, 0, 0})
+	m.packet(testPMTPID, true, []byte{0, tablePMT, 0xB0, 18, 0, 1, 0xC1, 0, 0, 0xE0 | testVideoPID>>8, testVideoPID & 0xFF, 0xF0, 0,
+		StreamTypeH264, 0xE0 | testVideoPID>>8, testVideoPID & 0xFF, 0xF0, 0,
+		0, 0, 0, 0})
+
+	return m
+}
+
+//packet adds a packet, a short payload is padded with the stuffing of an adaptation field
+func (m *muxer) packet(pid uint16, unitStart bool, payload []byte) {
+	counter := m.counters[pid]
+	m.counters[pid] = (counter + 1) & 0x0F
+
+	packet := []byte{syncByte, byte(pid>>8) & 0x1F, byte(pid), 0x10 | counter}
+	if unitStart {
+		packet[1] |= 0x40
+	}
+
+	if stuffing := PacketSize - 4 - len(payload); stuffing > 0 {
+		packet[3] |= 0x20
+		packet = append(packet, byte(stuffing-1))
+		if stuffing > 1 {
+			packet = append(packet, 0)
+			packet = append(packet, bytes.Repeat([]byte{0xFF}, stuffing-2)...)
+		}
+	}
+
+	m.packets = append(m.packets, append(packet, payload...))
+}
+
+//pes adds a video pes without a length, it is cut into as many packets as it needs
+//dts is only written when it differs from pts
+func (m *muxer) pes(pts uint64, dts uint64, data []byte) {
+	pes := []byte{0, 0, 1, 0xE0, 0, 0, 0x80, 0x80, 5}
+	pes = append(pes, timestamp(0x02, pts)...)
+	if dts != pts {
+		pes[7], pes[8] = 0xC0, 10
+		pes[9] |= 0x10
+		pes = append(pes, timestamp(0x01, dts)...)
+	}
+	pes = append(pes, data...)
+
+	for first := true; len(pes) > 0; first = false {
+		size := PacketSize - 4
+		if size > len(pes) {
+			size = len(pes)
+		}
+
+		m.packet(testVideoPID, first, pes[:size])
+		pes = pes[size:]
+	}
+}
+
+func (m *muxer) bytes() []byte {
+	return bytes.Join(m.packets, nil)
+}
+
+//timestamp writes a 33 bit pts or dts with its 4 bit prefix and the marker bits
+func timestamp(prefix byte, ts uint64) []byte {
+	return []byte{
+		prefix<<4 | byte(ts>>29)&0x0E | 1,
+		byte(ts >> 22),
+		byte(ts>>14)&0xFE | 1,
+		byte(ts >> 7),
+		byte(ts<<1) | 1,
+	}
+}
+
+type emitted struct {
+	data []byte
+	pts  uint64
+	dts  uint64
+}
+
+func demux(d *Demuxer, data []byte, chunk int) []emitted {
+	var pes []emitted
+
+	emit := func(data []byte, pts uint64, dts uint64) {
+		pes = append(pes, emitted{append([]byte(nil), data...), pts, dts})
+	}
+
+	for len(data) > 0 {
+		size := chunk
+		if size > len(data) {
+			size = len(data)
+		}
+
+		d.Write(data[:size], emit)
+		data = data[size:]
+	}
+
+	return pes
+}
+
+func TestTimestamps(t *testing.T) {
+	m := newMuxer()
+	//an i frame shown after the two b frames that follow it, then a p frame without a dts
+	m.pes(9000, 3000, []byte{0, 0, 0, 1, 0x65, 1})
+	m.pes(3000, 6000, []byte{0, 0, 0, 1, 0x01, 2})
+	m.pes(6000, 9000, []byte{0, 0, 0, 1, 0x01, 3})
+	m.pes(12000, 12000, []byte{0, 0, 0, 1, 0x41, 4})
+	//the last pes is only complete once the next one starts
+	m.pes(15000, 15000, nil)
+
+	pes := demux(NewDemuxer(), m.bytes(), len(m.bytes()))
+
+	want := []emitted{
+		{[]byte{0, 0, 0, 1, 0x65, 1}, 9000, 3000},
+		{[]byte{0, 0, 0, 1, 0x01, 2}, 3000, 6000},
+		{[]byte{0, 0, 0, 1, 0x01, 3}, 6000, 9000},
+		{[]byte{0, 0, 0, 1, 0x41, 4}, 12000, 12000},
+	}
+
+	if len(pes) != len(want) {
+		t.Fatalf("got %d pes, want %d", len(pes), len(want))
+	}
+
+	for i, w := range want {
+		if !bytes.Equal(pes[i].data, w.data) || pes[i].pts != w.pts || pes[i].dts != w.dts {
+			t.Errorf("pes %d is %x at pts %d dts %d, want %x at pts %d dts %d", i, pes[i].data, pes[i].pts, pes[i].dts, w.data, w.pts, w.dts)
+		}
+	}
+}
+
+func TestPESAcrossPackets(t *testing.T) {
+	//a pes of several packets, the muxer writes it without a length so it ends with the next pes
+	data := append([]byte{0, 0, 0, 1, 0x65}, bytes.Repeat([]byte{0xab, 0xcd}, 500)...)
+
+	m := newMuxer()
+	m.pes(3000, 3000, data)
+	m.pes(6000, 6000, []byte{0, 0, 0, 1, 0x41, 1})
+	m.pes(9000, 9000, nil)
+
+	if len(m.packets) < 2+6 {
+		t.Fatalf("the first pes takes %d packets, want it to span several", len(m.packets)-2)
+	}
+
+	//a stream read in pieces that do not line up with the packets, with bytes in front of the first packet
+	stream := append([]byte{0x12, 0x47, 0x00}, m.bytes()...)
+
+	for _, chunk := range []int{1, 100, PacketSize + 1, len(stream)} {
+		pes := demux(NewDemuxer(), stream, chunk)
+
+		if len(pes) != 2 {
+			t.Fatalf("got %d pes in chunks of %d, want 2", len(pes), chunk)
+		}
+
+		if !bytes.Equal(pes[0].data, data) || pes[0].pts != 3000 {
+			t.Errorf("first pes in chunks of %d has %d bytes at %d, want %d bytes at 3000", chunk, len(pes[0].data), pes[0].pts, len(data))
+		}
+	}
+}
+
+func TestContinuityGap(t *testing.T) {
+	m := newMuxer()
+	m.pes(3000, 3000, append([]byte{0, 0, 0, 1, 0x65}, bytes.Repeat([]byte{0xab}, 500)...))
+	m.pes(6000, 6000, []byte{0, 0, 0, 1, 0x41, 1})
+	m.pes(9000, 9000, []byte{0, 0, 0, 1, 0x41, 2})
+	m.pes(12000, 12000, nil)
+
+	//the second packet of the first pes is lost
+	m.packets = append(m.packets[:3], m.packets[4:]...)
+
+	d := NewDemuxer()
+	pes := demux(d, m.bytes(), len(m.bytes()))
+
+	if len(pes) != 2 || pes[0].pts != 6000 || pes[1].pts != 9000 {
+		t.Fatalf("got %d pes, want the two after the one that lost a packet", len(pes))
+	}
+
+	if errors := d.ContinuityErrors(); errors != 1 {
+		t.Errorf("counted %d continuity errors, want 1", errors)
+	}
+
+	//a packet sent twice is not an error and its copy is ignored
+	m = newMuxer()
+	m.pes(3000, 3000, []byte{0, 0, 0, 1, 0x65, 1})
+	m.pes(6000, 6000, nil)
+	m.packets = append(m.packets[:3], m.packets[2:]...)
+
+	d = NewDemuxer()
+	pes = demux(d, m.bytes(), len(m.bytes()))
+
+	if len(pes) != 1 || !bytes.Equal(pes[0].data, []byte{0, 0, 0, 1, 0x65, 1}) || d.ContinuityErrors() != 0 {
+		t.Errorf("got %d pes and %d continuity errors for a duplicated packet, want the pes once and no error", len(pes), d.ContinuityErrors())
+	}
+}
@@ -0,0 +1,197 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+//amf0 markers, values are decoded to float64, bool, string, map[string]interface{}, []interface{} and nil
+const (
+	amfNumber      = 0x00
+	amfBoolean     = 0x01
+	amfString      = 0x02
+	amfObject      = 0x03
+	amfNull        = 0x05
+	amfUndefined   = 0x06
+	amfECMAArray   = 0x08
+	amfObjectEnd   = 0x09
+	amfStrictArray = 0x0A
+	amfDate        = 0x0B
+	amfLongString  = 0x0C
+)
+
+//decodeAMF decodes all values of a command or data message
+func decodeAMF(data []byte) ([]interface{}, error) {
+	var values []interface{}
+
+	for len(data) > 0 {
+		value, rest, err := decodeValue(data)
+		if err != nil {
+			return values, err
+		}
+
+		values = append(values, value)
+		data = rest
+	}
+
+	return values, nil
+}
+
+func decodeValue(data []byte) (interface{}, []byte, error) {
+	if len(data) < 1 {
+		return nil, nil, fmt.Errorf("amf value is empty")
+	}
+
+	marker, data := data[0], data[1:]
+
+	switch marker {
+	case amfNumber:
+		if len(data) < 8 {
+			return nil, nil, fmt.Errorf("amf number is too short")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), data[8:], nil
+
+	case amfBoolean:
+		if len(data) < 1 {
+			return nil, nil, fmt.Errorf("amf boolean is too short")
+		}
+		return data[0] != 0, data[1:], nil
+
+	case amfString:
+		return decodeString(data)
+
+	case amfLongString:
+		if len(data) < 4 {
+			return nil, nil, fmt.Errorf("amf long string is too short")
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		if size > len(data)-4 {
+			return nil, nil, fmt.Errorf("amf long string is too short")
+		}
+		return string(data[4 : 4+size]), data[4+size:], nil
+
+	case amfObject:
+		return decodeObject(data)
+
+	case amfECMAArray:
+		if len(data) < 4 {
+			return nil, nil, fmt.Errorf("amf array is too short")
+		}
+		//the count is only a hint, the array ends like an object
+		return decodeObject(data[4:])
+
+	case amfStrictArray:
+		if len(data) < 4 {
+			return nil, nil, fmt.Errorf("amf array is too short")
+		}
+		count := int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+
+		var values []interface{}
+		for i := 0; i < count; i++ {
+			value, rest, err := decodeValue(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			values = append(values, value)
+			data = rest
+		}
+		return values, data, nil
+
+	case amfDate:
+		if len(data) < 10 {
+			return nil, nil, fmt.Errorf("amf date is too short")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), data[10:], nil
+
+	case amfNull, amfUndefined:
+		return nil, data, nil
+	}
+
+	return nil, nil, fmt.Errorf("unsupported amf marker %#x", marker)
+}
+
+func decodeString(data []byte) (string, []byte, error) {
+	if len(data) < 2 {
+		return "", nil, fmt.Errorf("amf string is too short")
+	}
+
+	size := int(binary.BigEndian.Uint16(data))
+	if 2+size > len(data) {
+		return "", nil, fmt.Errorf("amf string is too short")
+	}
+
+	return string(data[2 : 2+size]), data[2+size:], nil
+}
+
+//decodeObject decodes the properties of an object up to the empty key followed by the end marker
+func decodeObject(data []byte) (interface{}, []byte, error) {
+	object := make(map[string]interface{})
+
+	for {
+		key, rest, err := decodeString(data)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if key == "" && len(rest) > 0 && rest[0] == amfObjectEnd {
+			return object, rest[1:], nil
+		}
+
+		value, rest, err := decodeValue(rest)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		object[key] = value
+		data = rest
+	}
+}
+
+//encodeAMF encodes values of the types decodeAMF returns, maps are encoded as objects and ints as numbers
+func encodeAMF(values ...interface{}) []byte {
+	var buf bytes.Buffer
+
+	for _, value := range values {
+		encodeValue(&buf, value)
+	}
+
+	return buf.Bytes()
+}
+
+func encodeValue(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case float64:
+		buf.WriteByte(amfNumber)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case int:
+		encodeValue(buf, float64(v))
+	case bool:
+		buf.WriteByte(amfBoolean)
+		if v {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case string:
+		buf.WriteByte(amfString)
+		encodeString(buf, v)
+	case map[string]interface{}:
+		buf.WriteByte(amfObject)
+		for key, property := range v {
+			encodeString(buf, key)
+			encodeValue(buf, property)
+		}
+		encodeString(buf, "")
+		buf.WriteByte(amfObjectEnd)
+	default:
+		buf.WriteByte(amfNull)
+	}
+}
+
+func encodeString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
@@ -0,0 +1,236 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+//message types
+const (
+	typeSetChunkSize     = 1
+	typeAbort            = 2
+	typeAcknowledgement  = 3
+	typeUserControl      = 4
+	typeWindowAckSize    = 5
+	typeSetPeerBandwidth = 6
+	typeAudio            = 8
+	typeVideo            = 9
+	typeDataAMF3         = 15
+	typeCommandAMF3      = 17
+	typeDataAMF0         = 18
+	typeCommandAMF0      = 20
+)
+
+const (
+	defaultChunkSize = 128
+	//maxMessageSize protects against a broken or hostile publisher announcing huge messages
+	maxMessageSize = 16 * 1024 * 1024
+	//extendedTimestamp in the timestamp field means the timestamp follows the message header in 4 bytes
+	extendedTimestamp = 0xFFFFFF
+)
+
+//message is a complete rtmp message, timestamp is in milliseconds
+type message struct {
+	typeID    byte
+	streamID  uint32
+	timestamp uint32
+	payload   []byte
+}
+
+//chunkStream is the state of one chunk stream id, headers of later chunks only carry what changed
+type chunkStream struct {
+	timestamp uint32
+	delta     uint32
+	length    uint32
+	typeID    byte
+	streamID  uint32
+	extended  bool
+	payload   []byte
+}
+
+//chunkReader reassembles messages from the chunks of all chunk streams
+type chunkReader struct {
+	reader    io.Reader
+	chunkSize uint32
+	streams   map[uint32]*chunkStream
+	header    [11]byte
+}
+
+func newChunkReader(reader io.Reader) *chunkReader {
+	return &chunkReader{
+		reader:    reader,
+		chunkSize: defaultChunkSize,
+		streams:   make(map[uint32]*chunkStream),
+	}
+}
+
+//readMessage reads chunks until a message is complete
+func (r *chunkReader) readMessage() (*message, error) {
+	for {
+		msg, err := r.readChunk()
+		if err != nil || msg != nil {
+			return msg, err
+		}
+	}
+}
+
+func (r *chunkReader) readChunk() (*message, error) {
+	b := r.header[:1]
+	if _, err := io.ReadFull(r.reader, b); err != nil {
+		return nil, err
+	}
+
+	format := b[0] >> 6
+	id := uint32(b[0] & 0x3F)
+
+	//chunk stream ids 64 and above use one or two more bytes
+	switch id {
+	case 0:
+		if _, err := io.ReadFull(r.reader, b); err != nil {
+			return nil, err
+		}
+		id = 64 + uint32(b[0])
+	case 1:
+		b = r.header[:2]
+		if _, err := io.ReadFull(r.reader, b); err != nil {
+			return nil, err
+		}
+		id = 64 + uint32(b[0]) + uint32(b[1])*256
+	}
+
+	cs, ok := r.streams[id]
+	if !ok {
+		if format != 0 {
+			return nil, fmt.Errorf("chunk stream %d starts without a full header", id)
+		}
+		cs = &chunkStream{}
+		r.streams[id] = cs
+	}
+
+	header := r.header[:[]int{11, 7, 3, 0}[format]]
+	if _, err := io.ReadFull(r.reader, header); err != nil {
+		return nil, err
+	}
+
+	var timestamp uint32
+	if format < 3 {
+		timestamp = uint24(header[0:3])
+		cs.extended = timestamp == extendedTimestamp
+	}
+
+	if format < 2 {
+		cs.length = uint24(header[3:6])
+		cs.typeID = header[6]
+	}
+
+	if format == 0 {
+		cs.streamID = binary.LittleEndian.Uint32(header[7:11])
+	}
+
+	//the extended timestamp is repeated in every chunk of a message that needs it
+	if cs.extended {
+		b = r.header[:4]
+		if _, err := io.ReadFull(r.reader, b); err != nil {
+			return nil, err
+		}
+		if format < 3 {
+			timestamp = binary.BigEndian.Uint32(b)
+		}
+	}
+
+	//a message starts with this chunk, its timestamp is absolute or a delta to the previous message
+	if len(cs.payload) == 0 {
+		switch format {
+		case 0:
+			cs.timestamp = timestamp
+			cs.delta = 0
+		case 1, 2:
+			cs.delta = timestamp
+			cs.timestamp += timestamp
+		case 3:
+			cs.timestamp += cs.delta
+		}
+	}
+
+	if cs.length > maxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes is too large", cs.length)
+	}
+
+	size := cs.length - uint32(len(cs.payload))
+	if size > r.chunkSize {
+		size = r.chunkSize
+	}
+
+	start := len(cs.payload)
+	cs.payload = append(cs.payload, make([]byte, size)...)
+	if _, err := io.ReadFull(r.reader, cs.payload[start:]); err != nil {
+		return nil, err
+	}
+
+	if uint32(len(cs.payload)) < cs.length {
+		return nil, nil
+	}
+
+	msg := &message{
+		typeID:    cs.typeID,
+		streamID:  cs.streamID,
+		timestamp: cs.timestamp,
+		payload:   cs.payload,
+	}
+	cs.payload = nil
+
+	return msg, nil
+}
+
+//abort drops the partial message of a chunk stream
+func (r *chunkReader) abort(id uint32) {
+	if cs, ok := r.streams[id]; ok {
+		cs.payload = nil
+	}
+}
+
+//writeMessage writes a message in chunks of chunkSize, the first chunk has a full header and the others none
+func writeMessage(w io.Writer, chunkSize int, chunkStreamID byte, msg *message) error {
+	header := make([]byte, 12, 16)
+	header[0] = chunkStreamID
+	putUint24(header[1:4], msg.timestamp)
+	putUint24(header[4:7], uint32(len(msg.payload)))
+	header[7] = msg.typeID
+	binary.LittleEndian.PutUint32(header[8:12], msg.streamID)
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	for payload := msg.payload; ; {
+		size := len(payload)
+		if size > chunkSize {
+			size = chunkSize
+		}
+
+		if _, err := w.Write(payload[:size]); err != nil {
+			return err
+		}
+
+		payload = payload[size:]
+		if len(payload) == 0 {
+			return nil
+		}
+
+		//format 3 continues the message
+		if _, err := w.Write([]byte{0xC0 | chunkStreamID}); err != nil {
+			return err
+		}
+	}
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
+}
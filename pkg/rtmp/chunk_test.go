@@ -0,0 +1,183 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExtendedTimestamp(t *testing.T) {
+	var stream bytes.Buffer
+	payload := bytes.Repeat([]byte{0xab}, 300)
+	timestamp := uint32(0x01000005)
+
+	//a message of three chunks with an extended timestamp, which every chunk of the message repeats
+	stream.Write([]byte{0x04, 0xFF, 0xFF, 0xFF, 0x00, 0x01, 0x2C, typeVideo, 1, 0, 0, 0})
+	binary.Write(&stream, binary.BigEndian, timestamp)
+	stream.Write(payload[:128])
+	for _, chunk := range [][]byte{payload[128:256], payload[256:]} {
+		stream.WriteByte(0xC4)
+		binary.Write(&stream, binary.BigEndian, timestamp)
+		stream.Write(chunk)
+	}
+
+	//a message with a delta of 40ms and one that repeats the delta without a header
+	stream.Write([]byte{0x44, 0x00, 0x00, 0x28, 0x00, 0x00, 0x02, typeVideo, 1, 2})
+	stream.Write([]byte{0xC4, 3, 4})
+
+	reader := newChunkReader(&stream)
+
+	want := []struct {
+		timestamp uint32
+		payload   []byte
+	}{
+		{timestamp, payload},
+		{timestamp + 40, []byte{1, 2}},
+		{timestamp + 80, []byte{3, 4}},
+	}
+
+	for i, w := range want {
+		msg, err := reader.readMessage()
+		if err != nil {
+			t.Fatalf("error reading message %d: %v", i, err)
+		}
+
+		if msg.timestamp != w.timestamp || !bytes.Equal(msg.payload, w.payload) || msg.typeID != typeVideo || msg.streamID != 1 {
+			t.Errorf("message %d is type %d on stream %d at %d with %d bytes, want video on stream 1 at %d with %d bytes",
+				i, msg.typeID, msg.streamID, msg.timestamp, len(msg.payload), w.timestamp, len(w.payload))
+		}
+	}
+}
+
+//publish writes messages as a publisher would, every message starts with a full header
+func publish(t *testing.T, conn net.Conn, chunkSize int, messages ...*message) {
+	for _, msg := range messages {
+		if err := writeMessage(conn, chunkSize, 4, msg); err != nil {
+			t.Errorf("error writing message: %v", err)
+			return
+		}
+
+		if msg.typeID == typeSetChunkSize {
+			chunkSize = int(binary.BigEndian.Uint32(msg.payload))
+		}
+	}
+}
+
+func TestChunkSizeChange(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	conn := newConn(server, time.Second)
+	defer conn.Close()
+
+	first := bytes.Repeat([]byte{1}, 500)
+	second := bytes.Repeat([]byte{2}, 5000)
+
+	go publish(t, client, defaultChunkSize,
+		&message{typeID: typeVideo, streamID: 1, timestamp: 0, payload: first},
+		&message{typeID: typeSetChunkSize, payload: uint32Payload(4096)},
+		&message{typeID: typeVideo, streamID: 1, timestamp: 40, payload: second},
+	)
+
+	for i, payload := range [][]byte{first, second} {
+		msg, err := conn.readMessage()
+		if err != nil {
+			t.Fatalf("error reading message %d: %v", i, err)
+		}
+
+		if !bytes.Equal(msg.payload, payload) {
+			t.Errorf("message %d has %d bytes, want %d", i, len(msg.payload), len(payload))
+		}
+	}
+
+	if conn.reader.chunkSize != 4096 {
+		t.Errorf("chunk size is %d, want 4096", conn.reader.chunkSize)
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	conn := newConn(server, time.Second)
+	defer conn.Close()
+
+	sps := []byte{0x67, 0x42, 0x00, 0x1f, 0xe9}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	idr := []byte{0x65, 0x88, 0x84, 0x00}
+	p := []byte{0x41, 0x9a, 0x01}
+
+	//the avc decoder configuration record with 4 byte nal unit lengths
+	record := []byte{0x10 | codecAVC, avcSequenceHeader, 0, 0, 0, 1, 0x42, 0x00, 0x1f, 0xFF, 0xE1, 0, byte(len(sps))}
+	record = append(append(record, sps...), 1, 0, byte(len(pps)))
+	record = append(record, pps...)
+
+	//a keyframe with a composition time of 80ms, an sei and a p frame in one tag
+	keyframe := append([]byte{0x10 | codecAVC, avcNALU, 0, 0, 80, 0, 0, 0, byte(len(idr))}, idr...)
+	frame := []byte{0x20 | codecAVC, avcNALU, 0, 0, 0, 0, 0, 0, 2, 0x06, 0x05, 0, 0, 0, byte(len(p))}
+	frame = append(frame, p...)
+
+	go publish(t, client, defaultChunkSize,
+		&message{typeID: typeVideo, streamID: 1, timestamp: 0, payload: record},
+		&message{typeID: typeVideo, streamID: 1, timestamp: 1000, payload: keyframe},
+		&message{typeID: typeVideo, streamID: 1, timestamp: 1040, payload: frame},
+	)
+
+	want := []struct {
+		nals      [][]byte
+		keyframe  bool
+		timestamp uint32
+	}{
+		{[][]byte{sps, pps, idr}, true, 1080},
+		{[][]byte{{0x06, 0x05}, p}, false, 1040},
+	}
+
+	for i, w := range want {
+		frame, timestamp, err := conn.ReadFrame()
+		if err != nil {
+			t.Fatalf("error reading frame %d: %v", i, err)
+		}
+
+		if frame.Keyframe != w.keyframe || timestamp != w.timestamp || !reflect.DeepEqual(frame.NALs, w.nals) {
+			t.Errorf("frame %d is keyframe %v at %d with %x, want keyframe %v at %d with %x", i, frame.Keyframe, timestamp, frame.NALs, w.keyframe, w.timestamp, w.nals)
+		}
+
+		if !bytes.HasPrefix(frame.Data, []byte{0, 0, 0, 1}) {
+			t.Errorf("frame %d is not in annex b format", i)
+		}
+	}
+}
+
+func TestAMF(t *testing.T) {
+	values := []interface{}{"connect", float64(1), map[string]interface{}{"app": "live", "fpad": false}, nil}
+
+	decoded, err := decodeAMF(encodeAMF(values...))
+	if err != nil {
+		t.Fatalf("error decoding amf: %v", err)
+	}
+
+	if !reflect.DeepEqual(decoded, values) {
+		t.Errorf("decoded %v, want %v", decoded, values)
+	}
+
+	//an ecma array as sent in @setDataFrame and a strict array
+	data := []byte{amfECMAArray, 0, 0, 0, 1, 0, 5, 'w', 'i', 'd', 't', 'h', amfNumber, 0x40, 0x94, 0, 0, 0, 0, 0, 0, 0, 0, amfObjectEnd,
+		amfStrictArray, 0, 0, 0, 2, amfBoolean, 1, amfString, 0, 1, 'a'}
+
+	decoded, err = decodeAMF(data)
+	if err != nil {
+		t.Fatalf("error decoding amf: %v", err)
+	}
+
+	want := []interface{}{map[string]interface{}{"width": float64(1280)}, []interface{}{true, "a"}}
+	if !reflect.DeepEqual(decoded, want) {
+		t.Errorf("decoded %v, want %v", decoded, want)
+	}
+
+	if _, err := decodeAMF([]byte{amfString, 0, 10, 'a'}); err == nil {
+		t.Errorf("decoded a truncated string")
+	}
+}
@@ -0,0 +1,480 @@
+package rtmp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"ffmpeg-webrtc/pkg/h264"
+)
+
+const (
+	handshakeSize = 1536
+	//windowAckSize is the acknowledgement window and bandwidth announced to the publisher
+	windowAckSize = 2500000
+	//outChunkSize is the chunk size of our messages after connect
+	outChunkSize = 4096
+	//publishStreamID is the message stream id handed out by createStream
+	publishStreamID = 1
+)
+
+//chunk stream ids used for our messages
+const (
+	chunkStreamControl = 2
+	chunkStreamCommand = 3
+)
+
+//flv video
+const (
+	codecAVC          = 7
+	avcSequenceHeader = 0
+	avcNALU           = 1
+	avcEndOfSequence  = 2
+)
+
+//Conn is a connection of an rtmp publisher, it is created by the Server once the publisher asks to publish
+type Conn struct {
+	conn    net.Conn
+	reader  *chunkReader
+	writer  *bufio.Writer
+	timeout time.Duration
+	//chunkSize is the chunk size of our messages
+	chunkSize int
+	app       string
+	key       string
+	//received counts the bytes read, an acknowledgement is sent when the window of the publisher is full
+	received  uint32
+	acked     uint32
+	ackWindow uint32
+	//lengthSize is the size of the nal unit lengths from the avc decoder configuration record
+	lengthSize int
+	sps        []byte
+	pps        []byte
+	closeOnce  sync.Once
+}
+
+func newConn(conn net.Conn, timeout time.Duration) *Conn {
+	c := &Conn{
+		conn:      conn,
+		writer:    bufio.NewWriter(conn),
+		timeout:   timeout,
+		chunkSize: defaultChunkSize,
+	}
+	c.reader = newChunkReader(bufio.NewReaderSize(countingReader{c}, 64*1024))
+
+	return c
+}
+
+//countingReader counts the bytes the publisher sent for the acknowledgements
+type countingReader struct {
+	c *Conn
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	r.c.conn.SetReadDeadline(time.Now().Add(r.c.timeout))
+
+	n, err := r.c.conn.Read(p)
+	r.c.received += uint32(n)
+
+	return n, err
+}
+
+//App returns the application name of the connect command, the path of the rtmp url
+func (c *Conn) App() string {
+	return c.app
+}
+
+//Key returns the stream key the publisher publishes to
+func (c *Conn) Key() string {
+	return c.key
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) Close() error {
+	var err error
+
+	c.closeOnce.Do(func() {
+		err = c.conn.Close()
+	})
+
+	return err
+}
+
+//handshake performs the simple handshake, the server echoes the random bytes of the client
+func (c *Conn) handshake() error {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	c0c1 := make([]byte, 1+handshakeSize)
+	if _, err := io.ReadFull(c.conn, c0c1); err != nil {
+		return err
+	}
+
+	if c0c1[0] != 3 {
+		return fmt.Errorf("unsupported rtmp version %d", c0c1[0])
+	}
+
+	s0s1s2 := make([]byte, 1+2*handshakeSize)
+	s0s1s2[0] = 3
+	binary.BigEndian.PutUint32(s0s1s2[1:5], uint32(time.Now().Unix()))
+	rand.Read(s0s1s2[9 : 1+handshakeSize])
+	copy(s0s1s2[1+handshakeSize:], c0c1[1:])
+
+	if _, err := c.conn.Write(s0s1s2); err != nil {
+		return err
+	}
+
+	c2 := make([]byte, handshakeSize)
+	_, err := io.ReadFull(c.conn, c2)
+
+	return err
+}
+
+//waitPublish answers the commands of the publisher until it asks to publish a stream
+func (c *Conn) waitPublish() error {
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+
+		name, values, ok := command(msg)
+		if !ok {
+			continue
+		}
+
+		if len(values) < 2 {
+			return fmt.Errorf("invalid %v command", name)
+		}
+
+		transaction, _ := values[1].(float64)
+
+		switch name {
+		case "connect":
+			if err := c.onConnect(transaction, values); err != nil {
+				return err
+			}
+		case "releaseStream", "FCPublish":
+			if err := c.writeCommand(0, "_result", transaction, nil); err != nil {
+				return err
+			}
+		case "createStream":
+			if err := c.writeCommand(0, "_result", transaction, nil, publishStreamID); err != nil {
+				return err
+			}
+		case "publish":
+			//publish(transaction, null, key, type), obs may add a query to the key
+			if len(values) < 4 {
+				return fmt.Errorf("publish without stream key")
+			}
+			key, _ := values[3].(string)
+			if i := strings.Index(key, "?"); i >= 0 {
+				key = key[:i]
+			}
+			c.key = key
+			return nil
+		case "play":
+			return fmt.Errorf("playing is not supported, only publishing")
+		}
+	}
+}
+
+func (c *Conn) onConnect(transaction float64, values []interface{}) error {
+	if len(values) > 2 {
+		if object, ok := values[2].(map[string]interface{}); ok {
+			c.app, _ = object["app"].(string)
+		}
+	}
+
+	if err := c.writeControl(typeWindowAckSize, uint32Payload(windowAckSize)); err != nil {
+		return err
+	}
+
+	//the limit type 2 is dynamic
+	if err := c.writeControl(typeSetPeerBandwidth, append(uint32Payload(windowAckSize), 2)); err != nil {
+		return err
+	}
+
+	if err := c.writeControl(typeSetChunkSize, uint32Payload(outChunkSize)); err != nil {
+		return err
+	}
+
+	properties := map[string]interface{}{
+		"fmsVer":       "FMS/3,0,1,123",
+		"capabilities": 31,
+	}
+
+	information := map[string]interface{}{
+		"level":          "status",
+		"code":           "NetConnection.Connect.Success",
+		"description":    "Connection succeeded.",
+		"objectEncoding": 0,
+	}
+
+	return c.writeCommand(0, "_result", transaction, properties, information)
+}
+
+//accept tells the publisher that it can start sending
+func (c *Conn) accept() error {
+	//user control event 0 is stream begin
+	if err := c.writeControl(typeUserControl, append([]byte{0, 0}, uint32Payload(publishStreamID)...)); err != nil {
+		return err
+	}
+
+	return c.writeStatus("status", "NetStream.Publish.Start", c.key+" is now published")
+}
+
+//reject tells the publisher that the stream key is not known
+func (c *Conn) reject() error {
+	return c.writeStatus("error", "NetStream.Publish.BadName", "unknown stream key")
+}
+
+func (c *Conn) writeStatus(level string, code string, description string) error {
+	information := map[string]interface{}{
+		"level":       level,
+		"code":        code,
+		"description": description,
+	}
+
+	return c.writeCommand(publishStreamID, "onStatus", 0, nil, information)
+}
+
+func (c *Conn) writeCommand(streamID uint32, name string, transaction float64, values ...interface{}) error {
+	payload := encodeAMF(append([]interface{}{name, transaction}, values...)...)
+
+	return c.write(chunkStreamCommand, &message{typeID: typeCommandAMF0, streamID: streamID, payload: payload})
+}
+
+func (c *Conn) writeControl(typeID byte, payload []byte) error {
+	return c.write(chunkStreamControl, &message{typeID: typeID, payload: payload})
+}
+
+func (c *Conn) write(chunkStreamID byte, msg *message) error {
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+
+	if err := writeMessage(c.writer, c.chunkSize, chunkStreamID, msg); err != nil {
+		return err
+	}
+
+	//the set chunk size message itself is sent with the previous chunk size
+	if msg.typeID == typeSetChunkSize {
+		c.chunkSize = int(binary.BigEndian.Uint32(msg.payload))
+	}
+
+	return c.writer.Flush()
+}
+
+//readMessage reads the next message and handles the protocol control messages
+func (c *Conn) readMessage() (*message, error) {
+	for {
+		msg, err := c.reader.readMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		if c.ackWindow > 0 && c.received-c.acked >= c.ackWindow {
+			c.acked = c.received
+			if err := c.writeControl(typeAcknowledgement, uint32Payload(c.received)); err != nil {
+				return nil, err
+			}
+		}
+
+		switch msg.typeID {
+		case typeSetChunkSize:
+			if len(msg.payload) < 4 {
+				return nil, fmt.Errorf("invalid set chunk size message")
+			}
+			size := binary.BigEndian.Uint32(msg.payload) & 0x7FFFFFFF
+			if size < 1 || size > maxMessageSize {
+				return nil, fmt.Errorf("invalid chunk size %d", size)
+			}
+			c.reader.chunkSize = size
+		case typeAbort:
+			if len(msg.payload) >= 4 {
+				c.reader.abort(binary.BigEndian.Uint32(msg.payload))
+			}
+		case typeWindowAckSize:
+			if len(msg.payload) >= 4 {
+				c.ackWindow = binary.BigEndian.Uint32(msg.payload)
+			}
+		case typeAcknowledgement, typeUserControl, typeSetPeerBandwidth:
+		default:
+			return msg, nil
+		}
+	}
+}
+
+//ReadFrame returns the next h264 access unit and its presentation timestamp in milliseconds
+//the parameter sets of the avc decoder configuration record are added to keyframes that lack them
+//io.EOF is returned when the publisher stops publishing
+func (c *Conn) ReadFrame() (*h264.Frame, uint32, error) {
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		switch msg.typeID {
+		case typeVideo:
+			frame, err := c.video(msg.payload)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			if frame == nil {
+				continue
+			}
+
+			//the composition time offset turns the decoding timestamp into the presentation timestamp
+			composition := int32(uint24(msg.payload[2:5])<<8) >> 8
+
+			return frame, msg.timestamp + uint32(composition), nil
+
+		case typeCommandAMF0, typeCommandAMF3:
+			switch name, _, _ := command(msg); name {
+			case "FCUnpublish", "deleteStream", "closeStream":
+				return nil, 0, io.EOF
+			}
+		}
+	}
+}
+
+//command decodes a command message, the values start with the name and the transaction id
+func command(msg *message) (string, []interface{}, bool) {
+	if msg.typeID != typeCommandAMF0 && msg.typeID != typeCommandAMF3 {
+		return "", nil, false
+	}
+
+	payload := msg.payload
+	//an amf3 command starts with a format byte and is encoded in amf0 otherwise
+	if msg.typeID == typeCommandAMF3 && len(payload) > 0 {
+		payload = payload[1:]
+	}
+
+	values, err := decodeAMF(payload)
+	if err != nil || len(values) == 0 {
+		return "", nil, false
+	}
+
+	name, ok := values[0].(string)
+
+	return name, values, ok
+}
+
+//video parses an flv video tag, it returns nil for tags without a picture
+func (c *Conn) video(payload []byte) (*h264.Frame, error) {
+	if len(payload) < 5 {
+		return nil, nil
+	}
+
+	if codec := payload[0] & 0x0F; codec != codecAVC || payload[0]&0x80 != 0 {
+		return nil, fmt.Errorf("video codec %d is not supported, only h264", codec)
+	}
+
+	data := payload[5:]
+
+	switch payload[1] {
+	case avcSequenceHeader:
+		return nil, c.decoderConfiguration(data)
+
+	case avcNALU:
+		if c.lengthSize == 0 {
+			return nil, nil
+		}
+
+		var nals [][]byte
+		for len(data) >= c.lengthSize {
+			size := 0
+			for _, b := range data[:c.lengthSize] {
+				size = size<<8 | int(b)
+			}
+			data = data[c.lengthSize:]
+
+			if size > len(data) {
+				return nil, fmt.Errorf("nal unit of %d bytes exceeds the video tag", size)
+			}
+
+			if size > 0 {
+				nals = append(nals, data[:size])
+			}
+			data = data[size:]
+		}
+
+		if len(nals) == 0 {
+			return nil, nil
+		}
+
+		return h264.NewFrame(nals, time.Now()).WithParameterSets(c.sps, c.pps), nil
+	}
+
+	return nil, nil
+}
+
+//decoderConfiguration reads the nal unit length size and the first sps and pps of an avc decoder configuration record
+func (c *Conn) decoderConfiguration(data []byte) error {
+	if len(data) < 6 {
+		return fmt.Errorf("avc decoder configuration record is too short")
+	}
+
+	c.lengthSize = int(data[4]&0x03) + 1
+
+	sps, data, err := parameterSets(data[6:], int(data[5]&0x1F))
+	if err != nil {
+		return err
+	}
+
+	if len(data) < 1 {
+		return fmt.Errorf("avc decoder configuration record has no pps")
+	}
+
+	pps, _, err := parameterSets(data[1:], int(data[0]))
+	if err != nil {
+		return err
+	}
+
+	if len(sps) == 0 || len(pps) == 0 {
+		return fmt.Errorf("avc decoder configuration record has no sps or pps")
+	}
+
+	c.sps = sps[0]
+	c.pps = pps[0]
+
+	return nil
+}
+
+//parameterSets reads count parameter sets that are each prefixed with a 2 byte length
+func parameterSets(data []byte, count int) ([][]byte, []byte, error) {
+	var sets [][]byte
+
+	for i := 0; i < count; i++ {
+		if len(data) < 2 {
+			return nil, nil, fmt.Errorf("avc decoder configuration record is too short")
+		}
+
+		size := int(binary.BigEndian.Uint16(data))
+		if 2+size > len(data) {
+			return nil, nil, fmt.Errorf("avc decoder configuration record is too short")
+		}
+
+		sets = append(sets, append([]byte(nil), data[2:2+size]...))
+		data = data[2+size:]
+	}
+
+	return sets, data, nil
+}
+
+func uint32Payload(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+
+	return b
+}
@@ -0,0 +1,123 @@
+package rtmp
+
+import (
+	"ffmpeg-webrtc/pkg/logger"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+//timeout limits the handshake, every command and the time without data from a publisher
+const timeout = 10 * time.Second
+
+//Handler receives the video of a publisher
+type Handler interface {
+	//Publish reads frames from the connection until it fails or ends, the connection is closed afterwards
+	Publish(conn *Conn)
+}
+
+//Server accepts rtmp publishers, lookup returns the handler for a stream key or nil for an unknown key
+type Server struct {
+	lookup   func(key string) Handler
+	listener net.Listener
+	conns    map[*Conn]bool
+	mu       sync.Mutex
+}
+
+func NewServer(lookup func(key string) Handler) *Server {
+	return &Server{
+		lookup: lookup,
+		conns:  make(map[*Conn]bool),
+	}
+}
+
+//Listen starts accepting publishers on address, for example :1935
+func (s *Server) Listen(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("error listening for rtmp on %v: %v", address, err)
+	}
+
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+
+	logger.Infof("listening for rtmp publishers on %v\n", listener.Addr())
+
+	go s.accept(listener)
+
+	return nil
+}
+
+//Close stops accepting publishers and disconnects the connected ones
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+
+	err := s.listener.Close()
+	s.listener = nil
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+
+	return err
+}
+
+func (s *Server) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.serve(newConn(conn, timeout))
+	}
+}
+
+func (s *Server) serve(conn *Conn) {
+	s.mu.Lock()
+	s.conns[conn] = true
+	s.mu.Unlock()
+
+	defer func() {
+		conn.Close()
+
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	if err := conn.handshake(); err != nil {
+		logger.Errorf("error in rtmp handshake with %v: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+
+	if err := conn.waitPublish(); err != nil {
+		logger.Errorf("error in rtmp session with %v: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+
+	handler := s.lookup(conn.Key())
+	if handler == nil {
+		logger.Errorf("rtmp publisher %v used an unknown stream key\n", conn.RemoteAddr())
+		conn.reject()
+		return
+	}
+
+	if err := conn.accept(); err != nil {
+		logger.Errorf("error accepting rtmp publisher %v: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+
+	logger.Infof("rtmp publisher %v connected to /%v\n", conn.RemoteAddr(), conn.App())
+
+	handler.Publish(conn)
+
+	logger.Infof("rtmp publisher %v disconnected\n", conn.RemoteAddr())
+}
@@ -0,0 +1,142 @@
+package rtsp
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+//authenticator answers basic and digest challenges with the credentials of the url
+type authenticator struct {
+	username string
+	password string
+	//scheme is empty until the server sent a challenge
+	scheme string
+	realm  string
+	nonce  string
+	opaque string
+	qop    string
+	nc     int
+}
+
+func (a *authenticator) ready() bool {
+	return a.scheme != ""
+}
+
+//challenge picks digest over basic from the WWW-Authenticate headers of a 401
+func (a *authenticator) challenge(headers []string) error {
+	for _, header := range headers {
+		if strings.HasPrefix(header, "Digest ") {
+			params := parseAuthParams(strings.TrimPrefix(header, "Digest "))
+
+			if algorithm := params["algorithm"]; algorithm != "" && !strings.EqualFold(algorithm, "MD5") {
+				continue
+			}
+
+			a.scheme = "Digest"
+			a.realm = params["realm"]
+			a.nonce = params["nonce"]
+			a.opaque = params["opaque"]
+
+			for _, qop := range strings.Split(params["qop"], ",") {
+				if strings.TrimSpace(qop) == "auth" {
+					a.qop = "auth"
+				}
+			}
+
+			return nil
+		}
+	}
+
+	for _, header := range headers {
+		if strings.HasPrefix(header, "Basic ") {
+			a.scheme = "Basic"
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unsupported authentication %q", strings.Join(headers, ", "))
+}
+
+func (a *authenticator) authorization(method string, uri string) string {
+	if a.scheme == "Basic" {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(a.username+":"+a.password))
+	}
+
+	ha1 := md5Hex(a.username + ":" + a.realm + ":" + a.password)
+	ha2 := md5Hex(method + ":" + uri)
+
+	header := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, a.username, a.realm, a.nonce, uri)
+
+	if a.qop == "" {
+		header += fmt.Sprintf(`, response="%s"`, md5Hex(ha1+":"+a.nonce+":"+ha2))
+	} else {
+		a.nc++
+		nc := fmt.Sprintf("%08x", a.nc)
+		cnonce := newCnonce()
+		response := md5Hex(ha1 + ":" + a.nonce + ":" + nc + ":" + cnonce + ":" + a.qop + ":" + ha2)
+		header += fmt.Sprintf(`, response="%s", qop=%s, nc=%s, cnonce="%s"`, response, a.qop, nc, cnonce)
+	}
+
+	if a.opaque != "" {
+		header += fmt.Sprintf(`, opaque="%s"`, a.opaque)
+	}
+
+	return header
+}
+
+//parseAuthParams splits realm="cam", nonce="abc", qop="auth" into its values
+func parseAuthParams(value string) map[string]string {
+	params := make(map[string]string)
+
+	for value != "" {
+		value = strings.TrimLeft(value, " ,")
+
+		eq := strings.Index(value, "=")
+		if eq == -1 {
+			break
+		}
+
+		key := strings.ToLower(strings.TrimSpace(value[:eq]))
+		value = value[eq+1:]
+
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end == -1 {
+				params[key] = value[1:]
+				break
+			}
+
+			params[key] = value[1 : end+1]
+			value = value[end+2:]
+			continue
+		}
+
+		end := strings.Index(value, ",")
+		if end == -1 {
+			params[key] = strings.TrimSpace(value)
+			break
+		}
+
+		params[key] = strings.TrimSpace(value[:end])
+		value = value[end+1:]
+	}
+
+	return params
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func newCnonce() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,550 @@
+package rtsp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	TransportTCP = "tcp"
+	TransportUDP = "udp"
+)
+
+const (
+	defaultPort = "554"
+	//defaultSessionTimeout is used when the server does not announce the timeout of the session
+	defaultSessionTimeout = 60 * time.Second
+	userAgent             = "ffmpeg-webrtc"
+)
+
+//Client is a minimal rtsp client that plays the h264 video and the g.711 audio of a single url
+//the rtp packets are received interleaved on the rtsp connection or on a pair of udp ports per media
+type Client struct {
+	url     *url.URL
+	base    string
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	cseq    int
+	session string
+	//sessionTimeout is the timeout announced by the server, keep alives are sent at half of it
+	sessionTimeout time.Duration
+	auth           *authenticator
+	media          *Media
+	interleaved    bool
+	rtpConn        *net.UDPConn
+	rtcpConn       *net.UDPConn
+	buf            []byte
+	//audio is the g.711 audio of the session if it has one, onAudio gets its packets once it is set up
+	audio         *Media
+	onAudio       func(packet *rtp.Packet)
+	audioConn     *net.UDPConn
+	audioRTCPConn *net.UDPConn
+	mu            sync.Mutex
+}
+
+//Dial connects to the server of an rtsp url, timeout limits every request and every read
+func Dial(rawURL string, timeout time.Duration) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing url: %v", err)
+	}
+
+	if u.Scheme != "rtsp" {
+		return nil, fmt.Errorf("url %v is not an rtsp url", Redact(rawURL))
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+
+	conn, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &Client{
+		url:            u,
+		conn:           conn,
+		reader:         bufio.NewReader(conn),
+		timeout:        timeout,
+		sessionTimeout: defaultSessionTimeout,
+		buf:            make([]byte, 64*1024),
+	}
+
+	if u.User != nil {
+		password, _ := u.User.Password()
+		client.auth = &authenticator{username: u.User.Username(), password: password}
+	}
+
+	return client, nil
+}
+
+//Redact removes the credentials from an url so it can be logged
+func Redact(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+
+	u.User = nil
+
+	return u.String()
+}
+
+//requestURL returns the url without credentials, the credentials are sent in the authorization header
+func (c *Client) requestURL() string {
+	u := *c.url
+	u.User = nil
+
+	return u.String()
+}
+
+//response is an rtsp response, the header keys are canonical mime header keys
+type response struct {
+	status int
+	reason string
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+//request sends a request and reads its response, a 401 is answered once with the credentials of the url
+func (c *Client) request(method string, target string, header map[string]string) (*response, error) {
+	res, err := c.roundTrip(method, target, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.status == 401 && c.auth != nil && !c.auth.ready() {
+		if err := c.auth.challenge(res.header["Www-Authenticate"]); err != nil {
+			return nil, err
+		}
+
+		res, err = c.roundTrip(method, target, header)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if res.status != 200 {
+		return nil, fmt.Errorf("%v failed: %v %v", method, res.status, res.reason)
+	}
+
+	return res, nil
+}
+
+func (c *Client) roundTrip(method string, target string, header map[string]string) (*response, error) {
+	if err := c.write(method, target, header); err != nil {
+		return nil, err
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+
+	for {
+		//interleaved packets can arrive before the response to a request sent while playing
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+
+		if b[0] == '$' {
+			if _, _, err := c.readInterleaved(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		return c.readResponse()
+	}
+}
+
+func (c *Client) write(method string, target string, header map[string]string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cseq++
+
+	var request strings.Builder
+	fmt.Fprintf(&request, "%s %s RTSP/1.0\r\n", method, target)
+	fmt.Fprintf(&request, "CSeq: %d\r\n", c.cseq)
+	fmt.Fprintf(&request, "User-Agent: %s\r\n", userAgent)
+
+	if c.session != "" {
+		fmt.Fprintf(&request, "Session: %s\r\n", c.session)
+	}
+
+	if c.auth != nil && c.auth.ready() {
+		fmt.Fprintf(&request, "Authorization: %s\r\n", c.auth.authorization(method, target))
+	}
+
+	for key, value := range header {
+		fmt.Fprintf(&request, "%s: %s\r\n", key, value)
+	}
+	request.WriteString("\r\n")
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := io.WriteString(c.conn, request.String())
+
+	return err
+}
+
+func (c *Client) readResponse() (*response, error) {
+	reader := textproto.NewReader(c.reader)
+
+	line, err := reader.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+
+	//RTSP/1.0 200 OK
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "RTSP/") {
+		return nil, fmt.Errorf("invalid response %q", line)
+	}
+
+	status, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid response %q", line)
+	}
+
+	res := &response{status: status}
+	if len(parts) == 3 {
+		res.reason = parts[2]
+	}
+
+	res.header, err = reader.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if length := res.header.Get("Content-Length"); length != "" {
+		size, err := strconv.Atoi(length)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid content length %q", length)
+		}
+
+		res.body = make([]byte, size)
+		if _, err := io.ReadFull(c.reader, res.body); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+//readInterleaved reads a packet sent on the rtsp connection, $ followed by the channel and the length
+func (c *Client) readInterleaved() (byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	size := int(binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(c.reader, c.buf[:size]); err != nil {
+		return 0, nil, err
+	}
+
+	return header[1], c.buf[:size], nil
+}
+
+//Describe asks for the session description and returns the h264 video of it
+func (c *Client) Describe() (*Media, error) {
+	res, err := c.request("DESCRIBE", c.requestURL(), map[string]string{"Accept": "application/sdp"})
+	if err != nil {
+		return nil, err
+	}
+
+	//control urls are relative to the content base
+	c.base = c.requestURL()
+	if base := res.header.Get("Content-Base"); base != "" {
+		c.base = base
+	} else if location := res.header.Get("Content-Location"); location != "" {
+		c.base = location
+	}
+
+	media, err := ParseMedia(res.body)
+	if err != nil {
+		return nil, err
+	}
+	c.media = media
+
+	//the audio is optional
+	if audio, err := ParseAudio(res.body); err == nil {
+		c.audio = audio
+	}
+
+	return media, nil
+}
+
+//Audio returns the g.711 audio found by Describe, nil if the session has none
+func (c *Client) Audio() *Media {
+	return c.audio
+}
+
+//Setup sets up the video described by Describe for the given transport, TransportTCP or TransportUDP
+func (c *Client) Setup(transport string) error {
+	if c.media == nil {
+		return fmt.Errorf("SETUP before DESCRIBE")
+	}
+
+	var header string
+
+	switch transport {
+	case "", TransportTCP:
+		c.interleaved = true
+		header = "RTP/AVP/TCP;unicast;interleaved=0-1"
+	case TransportUDP:
+		rtpConn, rtcpConn, err := listenUDP()
+		if err != nil {
+			return err
+		}
+		c.rtpConn, c.rtcpConn = rtpConn, rtcpConn
+		port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+		header = fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d", port, port+1)
+	default:
+		return fmt.Errorf("unknown rtsp transport %s", transport)
+	}
+
+	return c.setup(c.media.Control, header)
+}
+
+//SetupAudio sets up the audio described by Describe with the transport of the video, Setup has to be called first
+//onPacket is called with every rtp packet of the audio, the payload points into a buffer that is reused after it returns
+func (c *Client) SetupAudio(onPacket func(packet *rtp.Packet)) error {
+	if c.audio == nil {
+		return fmt.Errorf("session has no audio")
+	}
+
+	if c.session == "" {
+		return fmt.Errorf("SETUP of the audio before the video")
+	}
+
+	header := "RTP/AVP/TCP;unicast;interleaved=2-3"
+
+	if !c.interleaved {
+		rtpConn, rtcpConn, err := listenUDP()
+		if err != nil {
+			return err
+		}
+		c.audioConn, c.audioRTCPConn = rtpConn, rtcpConn
+		port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+		header = fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d", port, port+1)
+	}
+
+	if err := c.setup(c.audio.Control, header); err != nil {
+		return err
+	}
+	c.onAudio = onPacket
+
+	return nil
+}
+
+//setup sends a SETUP for the control url of a media and keeps the session it returns
+func (c *Client) setup(control string, header string) error {
+	res, err := c.request("SETUP", c.control(control), map[string]string{"Transport": header})
+	if err != nil {
+		return err
+	}
+
+	//Session: 12345678;timeout=60
+	session := strings.Split(res.header.Get("Session"), ";")
+	c.session = strings.TrimSpace(session[0])
+
+	for _, param := range session[1:] {
+		param = strings.TrimSpace(param)
+		if strings.HasPrefix(param, "timeout=") {
+			if seconds, err := strconv.Atoi(strings.TrimPrefix(param, "timeout=")); err == nil && seconds > 0 {
+				c.sessionTimeout = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+
+	if c.session == "" {
+		return fmt.Errorf("SETUP response has no session")
+	}
+
+	return nil
+}
+
+//listenUDP opens the rtp port and the rtcp port above it, rtp has to be on an even port
+func listenUDP() (*net.UDPConn, *net.UDPConn, error) {
+	for attempt := 0; attempt < 10; attempt++ {
+		rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+		if port%2 != 0 {
+			rtpConn.Close()
+			continue
+		}
+
+		rtcpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port + 1})
+		if err != nil {
+			rtpConn.Close()
+			continue
+		}
+
+		return rtpConn, rtcpConn, nil
+	}
+
+	return nil, nil, fmt.Errorf("no free pair of udp ports")
+}
+
+//control resolves the control attribute of the media against the content base
+func (c *Client) control(control string) string {
+	switch {
+	case control == "" || control == "*":
+		return c.base
+	case strings.HasPrefix(control, "rtsp://"):
+		return control
+	case strings.HasSuffix(c.base, "/"):
+		return c.base + control
+	default:
+		return c.base + "/" + control
+	}
+}
+
+//Play starts the stream, the packets are read with ReadPacket
+//audio received on its own udp port is read in the background until the client is closed
+func (c *Client) Play() error {
+	if _, err := c.request("PLAY", c.base, map[string]string{"Range": "npt=0.000-"}); err != nil {
+		return err
+	}
+
+	if c.audioConn != nil {
+		go c.readAudio()
+	}
+
+	return nil
+}
+
+func (c *Client) readAudio() {
+	buf := make([]byte, 64*1024)
+
+	for {
+		n, _, err := c.audioConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(buf[:n]); err != nil {
+			continue
+		}
+
+		c.onAudio(packet)
+	}
+}
+
+//KeepAliveInterval is how often KeepAlive has to be called to keep the session from timing out
+func (c *Client) KeepAliveInterval() time.Duration {
+	return c.sessionTimeout / 2
+}
+
+//KeepAlive refreshes the session
+//with interleaved transport the response is skipped by ReadPacket, so it may be called while ReadPacket is running
+func (c *Client) KeepAlive() error {
+	if c.interleaved {
+		return c.write("GET_PARAMETER", c.base, nil)
+	}
+
+	_, err := c.request("GET_PARAMETER", c.base, nil)
+
+	return err
+}
+
+//ReadPacket returns the next rtp packet of the video
+//the packet payload points into a buffer that is reused by the next call
+//with interleaved transport the audio is read here as well and handed to the callback of SetupAudio
+func (c *Client) ReadPacket() (*rtp.Packet, error) {
+	for {
+		if !c.interleaved {
+			c.rtpConn.SetReadDeadline(time.Now().Add(c.timeout))
+
+			n, _, err := c.rtpConn.ReadFromUDP(c.buf)
+			if err != nil {
+				return nil, err
+			}
+
+			packet := &rtp.Packet{}
+			if err := packet.Unmarshal(c.buf[:n]); err != nil {
+				continue
+			}
+
+			return packet, nil
+		}
+
+		c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+
+		b, err := c.reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+
+		//responses to keep alives are skipped
+		if b[0] != '$' {
+			if _, err := c.readResponse(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		channel, data, err := c.readInterleaved()
+		if err != nil {
+			return nil, err
+		}
+
+		//channel 2 carries the audio, 1 and 3 carry rtcp
+		if channel == 2 && c.onAudio != nil {
+			packet := &rtp.Packet{}
+			if err := packet.Unmarshal(data); err == nil {
+				c.onAudio(packet)
+			}
+			continue
+		}
+
+		if channel != 0 {
+			continue
+		}
+
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(data); err != nil {
+			continue
+		}
+
+		return packet, nil
+	}
+}
+
+//Close tears the session down and closes the connections
+func (c *Client) Close() error {
+	if c.session != "" {
+		c.write("TEARDOWN", c.base, nil)
+	}
+
+	if c.rtpConn != nil {
+		c.rtpConn.Close()
+		c.rtcpConn.Close()
+	}
+
+	if c.audioConn != nil {
+		c.audioConn.Close()
+		c.audioRTCPConn.Close()
+	}
+
+	return c.conn.Close()
+}
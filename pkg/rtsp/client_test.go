@@ -0,0 +1,484 @@
+package rtsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ffmpeg-webrtc/pkg/h264"
+
+	"github.com/pion/rtp"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0x00, 0x1f, 0xe9, 0x02, 0x80}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+	testIDR = append([]byte{0x65}, bytes.Repeat([]byte{0xab, 0xcd, 0xef}, 1000)...)
+	testP   = []byte{0x41, 0x9a, 0x01, 0x02, 0x03}
+	testPCM = bytes.Repeat([]byte{0xff}, 160)
+)
+
+const (
+	testRealm = "stand-in"
+	testNonce = "0a4f113b"
+)
+
+//standIn is an rtsp server that plays a fixed h264 video and pcmu audio
+//it demands digest authentication when username is set and closes the connection after the packets when drop is set
+type standIn struct {
+	t        *testing.T
+	listener net.Listener
+	username string
+	password string
+	drop     bool
+	mu       sync.Mutex
+	//unauthorized counts the 401 responses, plays the sessions that were played, setups the urls of the setups
+	unauthorized int
+	plays        int
+	setups       []string
+}
+
+func newStandIn(t *testing.T) *standIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+
+	s := &standIn{t: t, listener: listener}
+	go s.accept()
+
+	return s
+}
+
+func (s *standIn) url(credentials string) string {
+	return fmt.Sprintf("rtsp://%s%s/cam", credentials, s.listener.Addr())
+}
+
+func (s *standIn) close() {
+	s.listener.Close()
+}
+
+func (s *standIn) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.serve(conn)
+	}
+}
+
+//serve answers the requests of a connection, the udp client ports are taken from the transport of the setups
+func (s *standIn) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	var ports []int
+	interleaved := false
+
+	for {
+		line, err := reader.ReadLine()
+		if err != nil {
+			return
+		}
+
+		header, err := reader.ReadMIMEHeader()
+		if err != nil && err != io.EOF {
+			return
+		}
+
+		parts := strings.Fields(line)
+		if len(parts) != 3 {
+			s.t.Errorf("invalid request %q", line)
+			return
+		}
+		method, target := parts[0], parts[1]
+		cseq := header.Get("Cseq")
+
+		if !s.authorized(method, target, header.Get("Authorization")) {
+			s.mu.Lock()
+			s.unauthorized++
+			s.mu.Unlock()
+
+			fmt.Fprintf(conn, "RTSP/1.0 401 Unauthorized\r\nCSeq: %s\r\nWWW-Authenticate: Basic realm=\"%s\"\r\nWWW-Authenticate: Digest realm=\"%s\", nonce=\"%s\", qop=\"auth\"\r\n\r\n", cseq, testRealm, testRealm, testNonce)
+			continue
+		}
+
+		switch method {
+		case "DESCRIBE":
+			sdp := testSDP()
+			fmt.Fprintf(conn, "RTSP/1.0 200 OK\r\nCSeq: %s\r\nContent-Base: %s/\r\nContent-Type: application/sdp\r\nContent-Length: %d\r\n\r\n%s", cseq, s.url(""), len(sdp), sdp)
+		case "SETUP":
+			transport := header.Get("Transport")
+			if strings.Contains(transport, "interleaved=") {
+				interleaved = true
+			}
+
+			var port int
+			if i := strings.Index(transport, "client_port="); i != -1 {
+				fmt.Sscanf(transport[i:], "client_port=%d", &port)
+				ports = append(ports, port)
+			}
+
+			s.mu.Lock()
+			s.setups = append(s.setups, target)
+			s.mu.Unlock()
+
+			fmt.Fprintf(conn, "RTSP/1.0 200 OK\r\nCSeq: %s\r\nSession: 12345678;timeout=20\r\nTransport: %s\r\n\r\n", cseq, transport)
+		case "PLAY":
+			fmt.Fprintf(conn, "RTSP/1.0 200 OK\r\nCSeq: %s\r\nSession: 12345678\r\n\r\n", cseq)
+
+			s.mu.Lock()
+			s.plays++
+			s.mu.Unlock()
+
+			if interleaved {
+				s.sendInterleaved(conn)
+			} else {
+				s.sendUDP(ports)
+			}
+
+			if s.drop {
+				return
+			}
+		default:
+			fmt.Fprintf(conn, "RTSP/1.0 200 OK\r\nCSeq: %s\r\n\r\n", cseq)
+		}
+	}
+}
+
+//authorized checks the digest response of a request
+func (s *standIn) authorized(method string, target string, authorization string) bool {
+	if s.username == "" {
+		return true
+	}
+
+	if !strings.HasPrefix(authorization, "Digest ") {
+		return false
+	}
+
+	params := parseAuthParams(strings.TrimPrefix(authorization, "Digest "))
+	if params["username"] != s.username || params["realm"] != testRealm || params["nonce"] != testNonce || params["uri"] != target || params["qop"] != "auth" {
+		return false
+	}
+
+	ha1 := md5Hex(s.username + ":" + testRealm + ":" + s.password)
+	ha2 := md5Hex(method + ":" + target)
+
+	return params["response"] == md5Hex(ha1+":"+testNonce+":"+params["nc"]+":"+params["cnonce"]+":auth:"+ha2)
+}
+
+func (s *standIn) sendInterleaved(conn net.Conn) {
+	video, audio := testPackets()
+
+	write := func(channel byte, packet []byte) {
+		header := []byte{'$', channel, 0, 0}
+		binary.BigEndian.PutUint16(header[2:], uint16(len(packet)))
+		conn.Write(append(header, packet...))
+	}
+
+	for i, packet := range video {
+		write(0, packet)
+
+		if i < len(audio) {
+			write(2, audio[i])
+		}
+	}
+}
+
+func (s *standIn) sendUDP(ports []int) {
+	video, audio := testPackets()
+
+	send := func(port int, packets [][]byte) {
+		conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+		if err != nil {
+			s.t.Errorf("error dialing udp: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		for _, packet := range packets {
+			conn.Write(packet)
+		}
+	}
+
+	send(ports[0], video)
+	if len(ports) > 1 {
+		send(ports[1], audio)
+	}
+}
+
+func testSDP() string {
+	sps := base64.StdEncoding.EncodeToString(testSPS)
+	pps := base64.StdEncoding.EncodeToString(testPPS)
+
+	return "v=0\r\n" +
+		"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+		"s=stand-in\r\n" +
+		"c=IN IP4 0.0.0.0\r\n" +
+		"t=0 0\r\n" +
+		"m=video 0 RTP/AVP 96\r\n" +
+		"a=rtpmap:96 H264/90000\r\n" +
+		"a=fmtp:96 packetization-mode=1;sprop-parameter-sets=" + sps + "," + pps + "\r\n" +
+		"a=control:trackID=0\r\n" +
+		"m=audio 0 RTP/AVP 0\r\n" +
+		"a=control:trackID=1\r\n"
+}
+
+//testPackets returns a keyframe with the parameter sets in a stap-a and the idr in fu-a fragments followed by a p frame
+//and two packets of pcmu audio
+func testPackets() ([][]byte, [][]byte) {
+	var payloads [][]byte
+	var timestamps []uint32
+
+	stapA := []byte{0x18}
+	for _, nal := range [][]byte{testSPS, testPPS} {
+		stapA = append(stapA, byte(len(nal)>>8), byte(len(nal)))
+		stapA = append(stapA, nal...)
+	}
+	payloads = append(payloads, stapA)
+	timestamps = append(timestamps, 3000)
+
+	indicator := testIDR[0]&0xE0 | h264.NALU_TYPE_FUA
+	for data, first := testIDR[1:], true; len(data) > 0; first = false {
+		size := 1200
+		if size > len(data) {
+			size = len(data)
+		}
+
+		header := h264.NalType(testIDR)
+		if first {
+			header |= 0x80
+		}
+		if size == len(data) {
+			header |= 0x40
+		}
+
+		payloads = append(payloads, append([]byte{indicator, header}, data[:size]...))
+		timestamps = append(timestamps, 3000)
+		data = data[size:]
+	}
+
+	payloads = append(payloads, testP)
+	timestamps = append(timestamps, 6000)
+
+	var video [][]byte
+	for i, payload := range payloads {
+		marker := i == len(payloads)-1 || timestamps[i+1] != timestamps[i]
+		video = append(video, marshal(96, uint16(1000+i), timestamps[i], marker, payload))
+	}
+
+	audio := [][]byte{
+		marshal(0, 1, 160, false, testPCM),
+		marshal(0, 2, 320, false, testPCM),
+	}
+
+	return video, audio
+}
+
+func marshal(payloadType uint8, sequence uint16, timestamp uint32, marker bool, payload []byte) []byte {
+	packet := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    payloadType,
+			SequenceNumber: sequence,
+			Timestamp:      timestamp,
+			Marker:         marker,
+			SSRC:           1,
+		},
+		Payload: payload,
+	}
+
+	data, err := packet.Marshal()
+	if err != nil {
+		panic(err)
+	}
+
+	return data
+}
+
+//play runs a session and returns the access units and the audio payloads it received
+func play(t *testing.T, url string, transport string) (*Client, []*h264.Frame, chan []byte) {
+	client, err := Dial(url, 2*time.Second)
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+
+	media, err := client.Describe()
+	if err != nil {
+		t.Fatalf("error describing: %v", err)
+	}
+
+	if media.PayloadType != 96 || media.ClockRate != h264.ClockRate || !bytes.Equal(media.SPS, testSPS) || !bytes.Equal(media.PPS, testPPS) {
+		t.Fatalf("unexpected media %+v", media)
+	}
+
+	if audio := client.Audio(); audio == nil || audio.Encoding != "PCMU" {
+		t.Fatalf("unexpected audio %+v", audio)
+	}
+
+	if err := client.Setup(transport); err != nil {
+		t.Fatalf("error setting up the video: %v", err)
+	}
+
+	audio := make(chan []byte, 10)
+	err = client.SetupAudio(func(packet *rtp.Packet) {
+		audio <- append([]byte(nil), packet.Payload...)
+	})
+	if err != nil {
+		t.Fatalf("error setting up the audio: %v", err)
+	}
+
+	if err := client.Play(); err != nil {
+		t.Fatalf("error playing: %v", err)
+	}
+
+	if client.KeepAliveInterval() != 10*time.Second {
+		t.Errorf("keep alive interval is %v, the session timeout is 20s", client.KeepAliveInterval())
+	}
+
+	depacketizer := h264.NewDepacketizer()
+	var frames []*h264.Frame
+
+	for len(frames) < 2 {
+		packet, err := client.ReadPacket()
+		if err != nil {
+			t.Fatalf("error reading packet after %d frames: %v", len(frames), err)
+		}
+
+		depacketizer.Write(packet, func(frame *h264.Frame, timestamp uint32) {
+			frames = append(frames, frame)
+		})
+	}
+
+	return client, frames, audio
+}
+
+func checkFrames(t *testing.T, frames []*h264.Frame) {
+	keyframe, p := frames[0], frames[1]
+
+	if !keyframe.Keyframe || len(keyframe.NALs) != 3 {
+		t.Fatalf("first access unit is not the keyframe with sps, pps and idr: %d nal units", len(keyframe.NALs))
+	}
+
+	for i, nal := range [][]byte{testSPS, testPPS, testIDR} {
+		if !bytes.Equal(keyframe.NALs[i], nal) {
+			t.Errorf("nal unit %d of the keyframe differs", i)
+		}
+	}
+
+	if p.Keyframe || len(p.NALs) != 1 || !bytes.Equal(p.NALs[0], testP) {
+		t.Errorf("second access unit is not the p frame")
+	}
+}
+
+func checkAudio(t *testing.T, audio chan []byte) {
+	for i := 0; i < 2; i++ {
+		select {
+		case payload := <-audio:
+			if !bytes.Equal(payload, testPCM) {
+				t.Errorf("audio packet %d differs", i)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("got %d of 2 audio packets", i)
+		}
+	}
+}
+
+func TestPlayInterleaved(t *testing.T) {
+	server := newStandIn(t)
+	defer server.close()
+
+	client, frames, audio := play(t, server.url(""), TransportTCP)
+	defer client.Close()
+
+	checkFrames(t, frames)
+	checkAudio(t, audio)
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	want := []string{server.url("") + "/trackID=0", server.url("") + "/trackID=1"}
+	if strings.Join(server.setups, " ") != strings.Join(want, " ") {
+		t.Errorf("setups are %v, want %v", server.setups, want)
+	}
+}
+
+func TestPlayUDP(t *testing.T) {
+	server := newStandIn(t)
+	defer server.close()
+
+	client, frames, audio := play(t, server.url(""), TransportUDP)
+	defer client.Close()
+
+	checkFrames(t, frames)
+	checkAudio(t, audio)
+}
+
+func TestDigestAuth(t *testing.T) {
+	server := newStandIn(t)
+	server.username = "admin"
+	server.password = "secret"
+	defer server.close()
+
+	client, err := Dial(server.url("admin:wrong@"), time.Second)
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	if _, err := client.Describe(); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("describe with a wrong password returned %v", err)
+	}
+	client.Close()
+
+	client, frames, _ := play(t, server.url("admin:secret@"), TransportTCP)
+	defer client.Close()
+
+	checkFrames(t, frames)
+
+	//the wrong password gets the challenge and the rejected answer, the right one only the challenge
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if server.unauthorized != 3 {
+		t.Errorf("server sent %d 401s, want 3", server.unauthorized)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	server := newStandIn(t)
+	server.drop = true
+	defer server.close()
+
+	client, frames, _ := play(t, server.url(""), TransportTCP)
+	checkFrames(t, frames)
+
+	//the dropped session ends the reads, a new session plays again
+	for {
+		if _, err := client.ReadPacket(); err != nil {
+			break
+		}
+	}
+	client.Close()
+
+	client, frames, _ = play(t, server.url(""), TransportTCP)
+	defer client.Close()
+
+	checkFrames(t, frames)
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if server.plays != 2 {
+		t.Errorf("server played %d sessions, want 2", server.plays)
+	}
+}
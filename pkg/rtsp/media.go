@@ -0,0 +1,202 @@
+package rtsp
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"ffmpeg-webrtc/pkg/h264"
+
+	"github.com/pion/sdp/v3"
+)
+
+//Media is the h264 video or the g.711 audio of a session description
+//SPS and PPS are taken from sprop-parameter-sets, Port and Address from the media and connection lines
+//Encoding is H264, PCMU or PCMA
+type Media struct {
+	Encoding    string
+	PayloadType uint8
+	ClockRate   uint32
+	Control     string
+	SPS         []byte
+	PPS         []byte
+	Port        int
+	Address     string
+}
+
+//ParseMedia returns the first h264 video of a session description
+func ParseMedia(data []byte) (*Media, error) {
+	var description sdp.SessionDescription
+	if err := description.Unmarshal(data); err != nil {
+		return nil, fmt.Errorf("error parsing sdp: %v", err)
+	}
+
+	for _, md := range description.MediaDescriptions {
+		if md.MediaName.Media != "video" {
+			continue
+		}
+
+		for _, format := range md.MediaName.Formats {
+			media, ok := parseFormat(md, format)
+			if !ok {
+				continue
+			}
+
+			media.destination(&description, md)
+
+			return media, nil
+		}
+	}
+
+	return nil, fmt.Errorf("sdp has no h264 video")
+}
+
+//ParseAudio returns the first g.711 audio of a session description, cameras usually send it next to their video
+func ParseAudio(data []byte) (*Media, error) {
+	var description sdp.SessionDescription
+	if err := description.Unmarshal(data); err != nil {
+		return nil, fmt.Errorf("error parsing sdp: %v", err)
+	}
+
+	for _, md := range description.MediaDescriptions {
+		if md.MediaName.Media != "audio" {
+			continue
+		}
+
+		for _, format := range md.MediaName.Formats {
+			media, ok := parseG711(md, format)
+			if !ok {
+				continue
+			}
+
+			media.destination(&description, md)
+
+			return media, nil
+		}
+	}
+
+	return nil, fmt.Errorf("sdp has no g.711 audio")
+}
+
+//parseG711 returns the media of a payload type if it is pcmu or pcma, the static payload types need no rtpmap
+func parseG711(md *sdp.MediaDescription, format string) (*Media, bool) {
+	payloadType, err := strconv.ParseUint(format, 10, 8)
+	if err != nil {
+		return nil, false
+	}
+
+	media := &Media{PayloadType: uint8(payloadType), ClockRate: 8000}
+
+	switch payloadType {
+	case 0:
+		media.Encoding = "PCMU"
+	case 8:
+		media.Encoding = "PCMA"
+	}
+
+	for _, attribute := range md.Attributes {
+		switch attribute.Key {
+		case "control":
+			media.Control = attribute.Value
+		case "rtpmap":
+			//0 PCMU/8000
+			fields := strings.Fields(attribute.Value)
+			if len(fields) != 2 || fields[0] != format {
+				continue
+			}
+
+			encoding := strings.Split(fields[1], "/")
+			media.Encoding = strings.ToUpper(encoding[0])
+
+			//browsers only play g.711 at 8kHz
+			if len(encoding) > 1 && encoding[1] != "8000" {
+				return nil, false
+			}
+		}
+	}
+
+	return media, media.Encoding == "PCMU" || media.Encoding == "PCMA"
+}
+
+//destination sets the port and address the media is sent to
+func (m *Media) destination(description *sdp.SessionDescription, md *sdp.MediaDescription) {
+	m.Port = md.MediaName.Port.Value
+
+	if md.ConnectionInformation != nil && md.ConnectionInformation.Address != nil {
+		m.Address = md.ConnectionInformation.Address.Address
+	} else if description.ConnectionInformation != nil && description.ConnectionInformation.Address != nil {
+		m.Address = description.ConnectionInformation.Address.Address
+	}
+
+	//the address may carry a ttl, 239.0.0.1/127
+	m.Address = strings.Split(m.Address, "/")[0]
+}
+
+//parseFormat returns the media of a payload type if it is h264
+func parseFormat(md *sdp.MediaDescription, format string) (*Media, bool) {
+	payloadType, err := strconv.ParseUint(format, 10, 8)
+	if err != nil {
+		return nil, false
+	}
+
+	media := &Media{Encoding: "H264", PayloadType: uint8(payloadType)}
+	isH264 := false
+
+	for _, attribute := range md.Attributes {
+		switch attribute.Key {
+		case "control":
+			media.Control = attribute.Value
+		case "rtpmap":
+			//96 H264/90000
+			fields := strings.Fields(attribute.Value)
+			if len(fields) != 2 || fields[0] != format {
+				continue
+			}
+
+			encoding := strings.Split(fields[1], "/")
+			if !strings.EqualFold(encoding[0], "H264") {
+				return nil, false
+			}
+			isH264 = true
+
+			media.ClockRate = h264.ClockRate
+			if len(encoding) > 1 {
+				if rate, err := strconv.ParseUint(encoding[1], 10, 32); err == nil {
+					media.ClockRate = uint32(rate)
+				}
+			}
+		case "fmtp":
+			//96 packetization-mode=1;sprop-parameter-sets=Z0IAH+KQCgC3YC3AQEBpB4kRUA==,aM48gA==
+			fields := strings.SplitN(attribute.Value, " ", 2)
+			if len(fields) != 2 || fields[0] != format {
+				continue
+			}
+
+			for _, param := range strings.Split(fields[1], ";") {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "sprop-parameter-sets=") {
+					media.parameterSets(strings.TrimPrefix(param, "sprop-parameter-sets="))
+				}
+			}
+		}
+	}
+
+	return media, isH264
+}
+
+func (m *Media) parameterSets(value string) {
+	for _, encoded := range strings.Split(value, ",") {
+		nal, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(nal) == 0 {
+			continue
+		}
+
+		switch h264.NalType(nal) {
+		case h264.NALU_TYPE_SPS:
+			m.SPS = nal
+		case h264.NALU_TYPE_PPS:
+			m.PPS = nal
+		}
+	}
+}
@@ -1,16 +1,25 @@
 package server
 
 import (
+	"encoding/json"
+	"ffmpeg-webrtc/pkg/logger"
 	"ffmpeg-webrtc/pkg/webrtc"
-	"log"
+	"net"
 	"net/http"
+	"path/filepath"
 	"text/template"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 )
 
-func indexHandler(t *template.Template) http.HandlerFunc {
+//page is passed to the index template, Stream is the name of the stream the player connects to
+type page struct {
+	Host   string
+	Stream string
+}
+
+func (s *Server) indexHandler(t *template.Template) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		templ := t.Lookup("index.html")
 
@@ -19,27 +28,37 @@ func indexHandler(t *template.Template) http.HandlerFunc {
 			return
 		}
 
-		host := r.Host
+		name := mux.Vars(r)["name"]
+		if _, ok := s.Room(name); !ok {
+			http.Error(w, "Stream not found", http.StatusNotFound)
+			return
+		}
 
-		if err := templ.Execute(w, host); err != nil {
+		if err := templ.Execute(w, page{Host: r.Host, Stream: name}); err != nil {
 			http.Error(w, "Could not execute template", http.StatusInternalServerError)
 		}
 	}
 }
 
-func wsHandler(room *webrtc.Room) http.HandlerFunc {
+func (s *Server) wsHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		room, ok := s.Room(r.URL.Query().Get("stream"))
+		if !ok {
+			http.Error(w, "Stream not found", http.StatusNotFound)
+			return
+		}
+
 		upgrader := websocket.Upgrader{}
 
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			log.Println("could not upgrade connection to websocket.", err)
+			logger.Errorln("could not upgrade connection to websocket.", err)
 			return
 		}
 
 		clientID := r.URL.Query().Get("clientID")
 		if clientID == "" {
-			log.Println("clientID is required")
+			logger.Errorln("clientID is required")
 			return
 		}
 
@@ -51,8 +70,51 @@ func wsHandler(room *webrtc.Room) http.HandlerFunc {
 	}
 }
 
-func registerHandlers(mux *mux.Router, room *webrtc.Room) {
-	indexTemplate := template.Must(template.ParseFiles("src/html/index.html"))
-	mux.HandleFunc("/", indexHandler(indexTemplate))
-	mux.HandleFunc("/ws", wsHandler(room))
+func (s *Server) statsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(s.stats()); err != nil {
+			http.Error(w, "Could not encode stats", http.StatusInternalServerError)
+		}
+	}
+}
+
+//reloadHandler reloads the configuration, it only accepts requests from the local machine
+func (s *Server) reloadHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		s.mu.RLock()
+		reload := s.reload
+		s.mu.RUnlock()
+
+		if reload == nil {
+			http.Error(w, "Reload is not supported", http.StatusNotImplemented)
+			return
+		}
+
+		if err := reload(); err != nil {
+			logger.Errorf("error reloading config: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) registerHandlers(mux *mux.Router) {
+	indexTemplate := template.Must(template.ParseFiles(filepath.Join(s.assetDir, "html", "index.html")))
+	mux.HandleFunc("/", s.indexHandler(indexTemplate))
+	mux.HandleFunc("/streams/{name}", s.indexHandler(indexTemplate))
+	mux.HandleFunc("/ws", s.wsHandler())
+	mux.HandleFunc("/stats", s.statsHandler())
+	mux.HandleFunc("/admin/reload", s.reloadHandler()).Methods(http.MethodPost)
+	mux.HandleFunc("/whip/{name}", withCORS(s.whipHandler())).Methods(http.MethodPost, http.MethodOptions)
+	mux.HandleFunc("/whip/{name}/{id}", withCORS(s.whipResourceHandler()))
 }
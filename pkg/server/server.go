@@ -2,30 +2,105 @@ package server
 
 import (
 	"context"
+	"ffmpeg-webrtc/pkg/logger"
 	"ffmpeg-webrtc/pkg/webrtc"
-	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
+//StatsFunc returns the statistics served as json on /stats
+type StatsFunc func() interface{}
+
+//ReloadFunc reloads the configuration, it is called by POST /admin/reload
+type ReloadFunc func() error
+
+//Server serves the player and the signalling of all rooms, rooms are looked up by stream name
+//the player is loaded from html/index.html in the asset directory
 type Server struct {
-	room *webrtc.Room
-	done chan bool
+	addr        string
+	assetDir    string
+	rooms       map[string]*webrtc.Room
+	defaultRoom string
+	stats       StatsFunc
+	reload      ReloadFunc
+	//whipTargets are the streams that accept whip publishers, whipSessions the connected publishers by id
+	whipTargets  map[string]WHIPTarget
+	whipSessions map[string]*whipSession
+	done         chan bool
+	mu           sync.RWMutex
 }
 
-func NewServer(room *webrtc.Room, done chan bool) *Server {
+func NewServer(addr string, assetDir string, stats StatsFunc, done chan bool) *Server {
 	return &Server{
-		room: room,
-		done: done,
+		addr:         addr,
+		assetDir:     assetDir,
+		rooms:        make(map[string]*webrtc.Room),
+		whipTargets:  make(map[string]WHIPTarget),
+		whipSessions: make(map[string]*whipSession),
+		stats:        stats,
+		done:         done,
+	}
+}
+
+//AddRoom makes a room available under a stream name, the first room added is served when no name is given
+func (s *Server) AddRoom(name string, room *webrtc.Room) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.rooms) == 0 {
+		s.defaultRoom = name
+	}
+
+	s.rooms[name] = room
+}
+
+//RemoveRoom stops serving a room, the first remaining room becomes the default if the default room is removed
+func (s *Server) RemoveRoom(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.rooms, name)
+
+	if s.defaultRoom != name {
+		return
+	}
+
+	s.defaultRoom = ""
+	for other := range s.rooms {
+		if s.defaultRoom == "" || other < s.defaultRoom {
+			s.defaultRoom = other
+		}
 	}
 }
 
+//OnReload sets the function called by the admin reload endpoint
+func (s *Server) OnReload(f ReloadFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reload = f
+}
+
+//Room returns the room of a stream, an empty name returns the default room
+func (s *Server) Room(name string) (*webrtc.Room, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if name == "" {
+		name = s.defaultRoom
+	}
+
+	room, ok := s.rooms[name]
+	return room, ok
+}
+
 func (s *Server) Start() {
 	//create a server instance
 	server := &http.Server{
-		Addr:         ":7000",
+		Addr:         s.addr,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 5 * time.Second,
 		Handler:      nil,
@@ -34,7 +109,7 @@ func (s *Server) Start() {
 	router := mux.NewRouter()
 	server.Handler = router
 
-	registerHandlers(router, s.room)
+	s.registerHandlers(router)
 
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -46,15 +121,15 @@ func (s *Server) Start() {
 	}()
 
 	go func() {
-		fmt.Println("server is ready to handle requests at", server.Addr)
+		logger.Infoln("server is ready to handle requests at", server.Addr)
 		serverErrors <- server.ListenAndServe()
 	}()
 
 	select {
 	case err := <-serverErrors:
-		fmt.Println(err)
+		logger.Errorln(err)
 	case <-ctx.Done():
-		fmt.Println("shutting down the server")
+		logger.Infoln("shutting down the server")
 		server.Shutdown(ctx)
 	}
 }
@@ -0,0 +1,282 @@
+package server
+
+import (
+	"crypto/subtle"
+	"ffmpeg-webrtc/pkg/logger"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	pion "github.com/pion/webrtc/v3"
+)
+
+//whipGatherTimeout limits how long the answer waits for the ice candidates, the answer carries all of them
+const whipGatherTimeout = 5 * time.Second
+
+//WHIPTarget accepts the video published to a stream over whip
+type WHIPTarget interface {
+	//StreamKey returns the bearer token a publisher has to send
+	StreamKey() string
+	//Publish reads the h264 track of a publisher until it ends, requestKeyframe sends a pli to the publisher
+	Publish(track *pion.TrackRemote, requestKeyframe func())
+}
+
+//whipSession is a connected publisher, a stream has at most one
+type whipSession struct {
+	id     string
+	stream string
+	pc     *pion.PeerConnection
+}
+
+//AddWHIPTarget accepts whip publishers for a stream
+func (s *Server) AddWHIPTarget(name string, target WHIPTarget) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.whipTargets[name] = target
+}
+
+//RemoveWHIPTarget stops accepting whip publishers for a stream and disconnects its publisher
+func (s *Server) RemoveWHIPTarget(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.whipTargets, name)
+
+	for id, session := range s.whipSessions {
+		if session.stream == name {
+			delete(s.whipSessions, id)
+			go session.pc.Close()
+		}
+	}
+}
+
+//whipHandler answers the sdp offer of a publisher, the stream key is sent as bearer token
+func (s *Server) whipHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+
+		s.mu.RLock()
+		target, ok := s.whipTargets[name]
+		s.mu.RUnlock()
+
+		if !ok {
+			http.Error(w, "Stream not found", http.StatusNotFound)
+			return
+		}
+
+		key := target.StreamKey()
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if key == "" || subtle.ConstantTimeCompare([]byte(token), []byte(key)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/sdp") {
+			http.Error(w, "Content-Type must be application/sdp", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		offer, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+		if err != nil {
+			http.Error(w, "Could not read offer", http.StatusBadRequest)
+			return
+		}
+
+		session, answer, err := s.newWHIPSession(name, target, string(offer))
+		if err != nil {
+			logger.Errorf("error accepting whip publisher for %v: %v\n", name, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		logger.Infof("whip publisher %v connecting to %v\n", session.id, name)
+
+		w.Header().Set("Content-Type", "application/sdp")
+		w.Header().Set("Location", "/whip/"+name+"/"+session.id)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(answer))
+	}
+}
+
+//whipResourceHandler ends a publisher session, trickle ice with PATCH is not supported
+func (s *Server) whipResourceHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", "DELETE")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id := mux.Vars(r)["id"]
+
+		s.mu.Lock()
+		session, ok := s.whipSessions[id]
+		if ok && session.stream == mux.Vars(r)["name"] {
+			delete(s.whipSessions, id)
+		}
+		s.mu.Unlock()
+
+		if !ok || session.stream != mux.Vars(r)["name"] {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+
+		logger.Infof("whip publisher %v left %v\n", id, session.stream)
+		session.pc.Close()
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+//withCORS allows browsers on other origins to publish and answers their preflight requests
+func withCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.Header().Set("Access-Control-Expose-Headers", "Location")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+//newWHIPSession creates a recvonly peer connection for an offer and returns the answer with all ice candidates
+//a new publisher replaces the one that is publishing to the stream
+func (s *Server) newWHIPSession(name string, target WHIPTarget, offer string) (*whipSession, string, error) {
+	mediaEngine := &pion.MediaEngine{}
+
+	for _, codec := range whipCodecs() {
+		if err := mediaEngine.RegisterCodec(codec, pion.RTPCodecTypeVideo); err != nil {
+			return nil, "", fmt.Errorf("error registering codec: %v", err)
+		}
+	}
+
+	interceptorRegistry := &interceptor.Registry{}
+	if err := pion.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
+		return nil, "", fmt.Errorf("error registering default interceptors: %v", err)
+	}
+
+	api := pion.NewAPI(pion.WithMediaEngine(mediaEngine), pion.WithInterceptorRegistry(interceptorRegistry))
+
+	pc, err := api.NewPeerConnection(pion.Configuration{ICEServers: []pion.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}}})
+	if err != nil {
+		return nil, "", fmt.Errorf("error creating peer connection: %v", err)
+	}
+
+	session := &whipSession{
+		id:     uuid.New().String(),
+		stream: name,
+		pc:     pc,
+	}
+
+	pc.OnTrack(func(track *pion.TrackRemote, receiver *pion.RTPReceiver) {
+		if !strings.EqualFold(track.Codec().MimeType, pion.MimeTypeH264) {
+			return
+		}
+
+		requestKeyframe := func() {
+			if err := pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}}); err != nil {
+				logger.Debugf("error sending pli to whip publisher: %v\n", err)
+			}
+		}
+
+		logger.Infof("whip publisher %v is publishing %v to %v\n", session.id, track.Codec().MimeType, name)
+		target.Publish(track, requestKeyframe)
+	})
+
+	pc.OnConnectionStateChange(func(state pion.PeerConnectionState) {
+		if state != pion.PeerConnectionStateFailed && state != pion.PeerConnectionStateClosed {
+			return
+		}
+
+		s.mu.Lock()
+		if s.whipSessions[session.id] == session {
+			delete(s.whipSessions, session.id)
+		}
+		s.mu.Unlock()
+
+		if state == pion.PeerConnectionStateFailed {
+			logger.Errorf("whip publisher %v of %v failed\n", session.id, name)
+			pc.Close()
+		}
+	})
+
+	if _, err := pc.AddTransceiverFromKind(pion.RTPCodecTypeVideo, pion.RTPTransceiverInit{Direction: pion.RTPTransceiverDirectionRecvonly}); err != nil {
+		pc.Close()
+		return nil, "", fmt.Errorf("error adding transceiver: %v", err)
+	}
+
+	if err := pc.SetRemoteDescription(pion.SessionDescription{Type: pion.SDPTypeOffer, SDP: offer}); err != nil {
+		pc.Close()
+		return nil, "", fmt.Errorf("error setting remote description: %v", err)
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		pc.Close()
+		return nil, "", fmt.Errorf("error creating answer: %v", err)
+	}
+
+	gatherComplete := pion.GatheringCompletePromise(pc)
+
+	if err := pc.SetLocalDescription(answer); err != nil {
+		pc.Close()
+		return nil, "", fmt.Errorf("error setting local description: %v", err)
+	}
+
+	select {
+	case <-gatherComplete:
+	case <-time.After(whipGatherTimeout):
+		logger.Errorf("ice gathering for whip publisher %v timed out\n", session.id)
+	}
+
+	s.mu.Lock()
+	for id, other := range s.whipSessions {
+		if other.stream == name {
+			logger.Infof("whip publisher %v replaces %v on %v\n", session.id, id, name)
+			delete(s.whipSessions, id)
+			go other.pc.Close()
+		}
+	}
+	s.whipSessions[session.id] = session
+	s.mu.Unlock()
+
+	return session, pc.LocalDescription().SDP, nil
+}
+
+//whipCodecs are the h264 profiles accepted from publishers, other video codecs are rejected
+func whipCodecs() []pion.RTPCodecParameters {
+	feedback := []pion.RTCPFeedback{
+		{Type: "nack"},
+		{Type: "nack", Parameter: "pli"},
+		{Type: "ccm", Parameter: "fir"},
+	}
+
+	var codecs []pion.RTPCodecParameters
+	for i, profile := range []string{"42001f", "42e01f", "4d001f", "64001f"} {
+		codecs = append(codecs, pion.RTPCodecParameters{
+			RTPCodecCapability: pion.RTPCodecCapability{
+				MimeType:     pion.MimeTypeH264,
+				ClockRate:    90000,
+				SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + profile,
+				RTCPFeedback: feedback,
+			},
+			PayloadType: pion.PayloadType(102 + 2*i),
+		})
+	}
+
+	return codecs
+}
@@ -0,0 +1,178 @@
+package stream
+
+import (
+	"ffmpeg-webrtc/pkg/logger"
+	wbrtc "ffmpeg-webrtc/pkg/webrtc"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//bitrateControlInterval is how often the estimates of the viewers are looked at
+	bitrateControlInterval = time.Second
+	//bitrateUpgradeDelay and bitrateDowngradeDelay are how long a tier has to be wanted before the encoder is changed to it
+	//every change restarts the encoder, lowering the bitrate sooner than raising it lets the viewers recover from congestion
+	bitrateUpgradeDelay   = 10 * time.Second
+	bitrateDowngradeDelay = 3 * time.Second
+	//bitrateHeadroom is how many percent the estimates have to exceed a higher tier before it is wanted
+	bitrateHeadroom = 20
+	//bitratePercentile is the percentage of viewers whose estimate may be below the bitrate
+	//so a single viewer on a bad link does not pull the quality down for everybody once there are many
+	bitratePercentile = 20
+)
+
+//bitrateController changes the bitrate of the encoder of a source to the tier the bandwidth estimates of the viewers allow
+//the tiers are the bitrate constants of the room up to the bitrate the source was configured with
+type bitrateController struct {
+	name    string
+	source  bitrateSource
+	room    *wbrtc.Room
+	tiers   []int
+	current int
+	//pending is the tier wanted since since, 0 when the current one is wanted
+	pending int
+	since   time.Time
+}
+
+func newBitrateController(name string, source bitrateSource, room *wbrtc.Room) *bitrateController {
+	current := source.Bitrate()
+
+	var tiers []int
+	for _, tier := range []int{wbrtc.LowBitrate, wbrtc.MidBitrate, wbrtc.HighBitrate, wbrtc.VeryHighBitrate} {
+		if tier < current {
+			tiers = append(tiers, tier)
+		}
+	}
+
+	return &bitrateController{
+		name:    name,
+		source:  source,
+		room:    room,
+		tiers:   append(tiers, current),
+		current: current,
+	}
+}
+
+//run adjusts the bitrate until stop is closed
+func (c *bitrateController) run(stop chan bool) {
+	ticker := time.NewTicker(bitrateControlInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			c.update(now, c.room.BandwidthEstimates())
+		}
+	}
+}
+
+func (c *bitrateController) update(now time.Time, estimates []int) {
+	if len(estimates) == 0 {
+		c.pending = 0
+		return
+	}
+
+	estimate := percentile(estimates, bitratePercentile)
+	tier := c.selectTier(estimate)
+
+	if tier == c.current {
+		c.pending = 0
+		return
+	}
+
+	if tier != c.pending {
+		c.pending = tier
+		c.since = now
+		return
+	}
+
+	delay := bitrateDowngradeDelay
+	if tier > c.current {
+		delay = bitrateUpgradeDelay
+	}
+
+	if now.Sub(c.since) < delay {
+		return
+	}
+
+	logger.Infof("changing the bitrate of stream %v from %d to %d b/s, %d viewers estimate %d b/s\n", c.name, c.current, tier, len(estimates), estimate)
+
+	c.current = tier
+	c.pending = 0
+	c.room.SetStartBitrate(tier)
+	c.source.SetBitrate(tier)
+}
+
+//selectTier returns the highest tier the estimate allows, a tier above the current one needs headroom
+func (c *bitrateController) selectTier(estimate int) int {
+	selected := c.tiers[0]
+
+	for _, tier := range c.tiers {
+		required := tier
+		if tier > c.current {
+			required += tier * bitrateHeadroom / 100
+		}
+
+		if estimate >= required {
+			selected = tier
+		}
+	}
+
+	return selected
+}
+
+//percentile returns the value that p percent of the values are below
+func percentile(values []int, p int) int {
+	sorted := append([]int(nil), values...)
+	sort.Ints(sorted)
+
+	return sorted[len(sorted)*p/100]
+}
+
+//argBitrate returns the bitrate of the -b:v argument of an ffmpeg command line
+func argBitrate(args []string) (int, error) {
+	for i, arg := range args {
+		if arg == "-b:v" && i+1 < len(args) {
+			return parseBitrate(args[i+1])
+		}
+	}
+
+	return 0, fmt.Errorf("args have no -b:v")
+}
+
+//withBitrate returns a copy of the arguments with the value of -b:v replaced
+func withBitrate(args []string, bitrate int) []string {
+	replaced := append([]string(nil), args...)
+
+	for i, arg := range replaced {
+		if arg == "-b:v" && i+1 < len(replaced) {
+			replaced[i+1] = strconv.Itoa(bitrate)
+		}
+	}
+
+	return replaced
+}
+
+//parseBitrate parses a bitrate the way ffmpeg writes it, 800000, 800k or 2.5M
+func parseBitrate(value string) (int, error) {
+	multiplier := 1.0
+
+	switch {
+	case strings.HasSuffix(value, "k"):
+		multiplier = 1000
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1000000
+	}
+
+	number, err := strconv.ParseFloat(strings.TrimRight(value, "kM"), 64)
+	if err != nil || number <= 0 {
+		return 0, fmt.Errorf("invalid bitrate %q", value)
+	}
+
+	return int(number * multiplier), nil
+}
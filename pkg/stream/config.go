@@ -0,0 +1,259 @@
+package stream
+
+import (
+	"encoding/json"
+	"ffmpeg-webrtc/pkg/audio"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+//Config holds all streams served by one server
+type Config struct {
+	Streams []StreamConfig `json:"streams"`
+}
+
+//StreamConfig describes a single named stream and its source
+type StreamConfig struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+
+	//App and Args run the app of an ffmpeg source, FromFile marks it as playing back a recording
+	App      string   `json:"app"`
+	Args     []string `json:"args"`
+	FromFile bool     `json:"from_file"`
+	//PipeName, Transport and Address select how the app hands its output over, see the Transport constants
+	//for an rtsp source Transport is tcp or udp, an mpegts source listens on Address with udp or tcp
+	PipeName  string `json:"pipe_name"`
+	Transport string `json:"transport"`
+	Address   string `json:"address"`
+	//AudioPipe is a named pipe the app writes opus in ogg into, the viewers get an audio track when it is set
+	//it is handed over with the Transport of the video, with unix, tcp or udp AudioPipe is the address the app writes to
+	//with AudioCodec pcmu or pcma the app writes raw g.711 at 8kHz instead, an rtsp source forwards the g.711 of the camera
+	AudioPipe  string `json:"audio_pipe"`
+	AudioCodec string `json:"audio_codec"`
+	//KeyframeRestart restarts the app when a viewer needs a keyframe that is not in the gop cache
+	KeyframeRestart bool `json:"keyframe_restart"`
+	//MaxRestarts limits how often a crashed app is restarted, 0 restarts it forever
+	MaxRestarts int `json:"max_restarts"`
+	//Renditions are lower qualities the app writes into pipes of their own, every viewer gets the best one its bandwidth allows
+	//Bitrate is the bitrate in bit/s a viewer needs for the video of PipeName
+	Renditions []RenditionConfig `json:"renditions"`
+	Bitrate    int               `json:"bitrate"`
+	//BitrateControl restarts the app with a lower or higher -b:v when the bandwidth estimates of the viewers change
+	BitrateControl bool `json:"bitrate_control"`
+
+	//File and Loop configure a file source, VOD gives every viewer its own playback that it can pause and seek
+	File string `json:"file"`
+	Loop bool   `json:"loop"`
+	VOD  bool   `json:"vod"`
+
+	//URL is the rtsp:// url of an rtsp source, credentials can be part of it
+	URL string `json:"url"`
+
+	//SDP is the sdp file of an rtp source, Address is the address it listens on if the sdp has no port
+	//Latency is how long a missing packet is waited for before it is skipped
+	SDP     string `json:"sdp"`
+	Latency string `json:"latency"`
+
+	//StreamKey is the bearer token a whip publisher has to send and the stream key of an rtmp publisher
+	StreamKey string `json:"stream_key"`
+
+	//Device, Width and Height configure a v4l2 source, FPS is used as its frame rate
+	Device string `json:"device"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+
+	//Timing, FPS and Pace control the timestamps of the frames, see the Timing constants
+	Timing string  `json:"timing"`
+	FPS    float64 `json:"fps"`
+	Pace   bool    `json:"pace"`
+
+	//the source runs while someone is watching, Linger is how long it keeps running after the last viewer left
+	//AlwaysOn keeps it running without viewers
+	Linger   string `json:"linger"`
+	AlwaysOn bool   `json:"always_on"`
+}
+
+//RenditionConfig is one rendition of an ffmpeg source, Bitrate is the bitrate in bit/s a viewer needs for it
+//PipeName is the address of the rendition with the unix, tcp and udp transports
+type RenditionConfig struct {
+	PipeName string `json:"pipe_name"`
+	Bitrate  int    `json:"bitrate"`
+}
+
+//DefaultStreamName is used for a config that describes a single stream without a streams list
+const DefaultStreamName = "default"
+
+var streamName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+//LoadConfig reads and validates the config file
+//a file without a streams list is read as a single stream named DefaultStreamName
+//relative file paths are relative to the directory of the config file
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("error parsing config %v: %v", path, err)
+	}
+
+	if config.Streams == nil {
+		var single StreamConfig
+		if err := json.Unmarshal(data, &single); err != nil {
+			return nil, fmt.Errorf("error parsing config %v: %v", path, err)
+		}
+
+		if single.Name == "" {
+			single.Name = DefaultStreamName
+		}
+
+		config.Streams = []StreamConfig{single}
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %v: %v", path, err)
+	}
+
+	for i := range config.Streams {
+		if file := config.Streams[i].File; file != "" && !filepath.IsAbs(file) {
+			config.Streams[i].File = filepath.Join(filepath.Dir(path), file)
+		}
+
+		if sdp := config.Streams[i].SDP; sdp != "" && !filepath.IsAbs(sdp) {
+			config.Streams[i].SDP = filepath.Join(filepath.Dir(path), sdp)
+		}
+	}
+
+	return &config, nil
+}
+
+func (c *Config) validate() error {
+	if len(c.Streams) == 0 {
+		return fmt.Errorf("streams must not be empty")
+	}
+
+	names := make(map[string]bool)
+	pipes := make(map[string]string)
+	keys := make(map[string]string)
+
+	for i, stream := range c.Streams {
+		if !streamName.MatchString(stream.Name) {
+			return fmt.Errorf("streams[%d].name %q must only contain letters, digits, - and _", i, stream.Name)
+		}
+
+		if names[stream.Name] {
+			return fmt.Errorf("streams[%d].name %s is used more than once", i, stream.Name)
+		}
+		names[stream.Name] = true
+
+		if stream.VOD && stream.Type != SourceTypeFile {
+			return fmt.Errorf("streams[%d].vod is only supported by file sources", i)
+		}
+
+		if (stream.Type == SourceTypeWHIP || stream.Type == SourceTypeRTMP) && stream.StreamKey == "" {
+			return fmt.Errorf("streams[%d].stream_key must not be empty for a %s source", i, stream.Type)
+		}
+
+		if stream.StreamKey != "" {
+			if other, exists := keys[stream.StreamKey]; exists {
+				return fmt.Errorf("streams[%d].stream_key is already used by stream %s", i, other)
+			}
+			keys[stream.StreamKey] = stream.Name
+		}
+
+		if stream.Latency != "" {
+			if latency, err := time.ParseDuration(stream.Latency); err != nil || latency < 0 {
+				return fmt.Errorf("streams[%d].latency %q must be a duration like 50ms", i, stream.Latency)
+			}
+		}
+
+		if stream.Linger != "" {
+			if linger, err := time.ParseDuration(stream.Linger); err != nil || linger < 0 {
+				return fmt.Errorf("streams[%d].linger %q must be a duration like 30s", i, stream.Linger)
+			}
+		}
+
+		if stream.AudioCodec != "" {
+			codec := audio.CodecByName(stream.AudioCodec)
+			if codec == nil {
+				return fmt.Errorf("streams[%d].audio_codec %q must be opus, pcmu or pcma", i, stream.AudioCodec)
+			}
+
+			if stream.Type == SourceTypeRTSP && codec == audio.Opus {
+				return fmt.Errorf("streams[%d].audio_codec of an rtsp source must be pcmu or pcma", i)
+			}
+		}
+
+		//the audio and the renditions use the transport of the video, only the video can be written to stdout
+		if stream.Transport == TransportStdout && (stream.AudioPipe != "" || len(stream.Renditions) > 0) {
+			return fmt.Errorf("streams[%d].audio_pipe and renditions can not be used with transport %s", i, TransportStdout)
+		}
+
+		if stream.AudioPipe != "" {
+			if stream.AudioPipe == stream.PipeName || stream.AudioPipe == stream.Address {
+				return fmt.Errorf("streams[%d].audio_pipe must not be the pipe_name or the address", i)
+			}
+
+			if other, exists := pipes[stream.AudioPipe]; exists {
+				return fmt.Errorf("streams[%d].audio_pipe %s is already used by stream %s", i, stream.AudioPipe, other)
+			}
+			pipes[stream.AudioPipe] = stream.Name
+		}
+
+		if len(stream.Renditions) > 0 {
+			if stream.Type != "" && stream.Type != SourceTypeFFmpeg {
+				return fmt.Errorf("streams[%d].renditions are only supported by ffmpeg sources", i)
+			}
+
+			if stream.Bitrate <= 0 {
+				return fmt.Errorf("streams[%d].bitrate must be set for the renditions", i)
+			}
+		}
+
+		if stream.BitrateControl {
+			if stream.Type != "" && stream.Type != SourceTypeFFmpeg {
+				return fmt.Errorf("streams[%d].bitrate_control is only supported by ffmpeg sources", i)
+			}
+
+			if len(stream.Renditions) > 0 {
+				return fmt.Errorf("streams[%d].bitrate_control can not be used with renditions", i)
+			}
+
+			if _, err := argBitrate(stream.Args); err != nil {
+				return fmt.Errorf("streams[%d].bitrate_control needs a valid -b:v in the args: %v", i, err)
+			}
+		}
+
+		for j, rendition := range stream.Renditions {
+			if rendition.Bitrate <= 0 {
+				return fmt.Errorf("streams[%d].renditions[%d].bitrate must be positive", i, j)
+			}
+
+			if rendition.PipeName == "" || rendition.PipeName == stream.PipeName || rendition.PipeName == stream.Address {
+				return fmt.Errorf("streams[%d].renditions[%d].pipe_name must be set and differ from the pipe_name and the address", i, j)
+			}
+
+			if other, exists := pipes[rendition.PipeName]; exists {
+				return fmt.Errorf("streams[%d].renditions[%d].pipe_name %s is already used by stream %s", i, j, rendition.PipeName, other)
+			}
+			pipes[rendition.PipeName] = stream.Name
+		}
+
+		if stream.PipeName == "" {
+			continue
+		}
+
+		if other, exists := pipes[stream.PipeName]; exists {
+			return fmt.Errorf("streams[%d].pipe_name %s is already used by stream %s", i, stream.PipeName, other)
+		}
+		pipes[stream.PipeName] = stream.Name
+	}
+
+	return nil
+}
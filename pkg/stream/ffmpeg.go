@@ -0,0 +1,426 @@
+package stream
+
+import (
+	"errors"
+	"ffmpeg-webrtc/pkg/audio"
+	"ffmpeg-webrtc/pkg/h264"
+	"ffmpeg-webrtc/pkg/logger"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+//ffmpegSource runs an external app, usually ffmpeg, that writes h264 into a transport, by default a named pipe
+//the app is supervised and restarted when it exits
+type ffmpegSource struct {
+	app      string
+	args     []string
+	fromFile bool
+	//keyframeRestart restarts the app when a viewer needs a keyframe, for apps that can not be asked for one otherwise
+	keyframeRestart bool
+	transport       transport
+	supervisor      *supervisor
+	progress        *progressParser
+	logFile         *os.File
+	frames          chan *h264.Frame
+	//audio is the transport of the audio, nil without audio, audioCodec is opus or g.711
+	audio       transport
+	audioCodec  *audio.Codec
+	audioFrames chan *audio.Frame
+	//renditions are the transports of the other qualities of the video, bitrates is nil without renditions
+	renditions      []transport
+	renditionFrames []chan *h264.Frame
+	bitrates        []int
+	//done is closed on stop so the readers of this start do not hand over another frame, readers waits for them
+	done    chan bool
+	readers sync.WaitGroup
+}
+
+func newFFmpegSource(c *StreamConfig) (*ffmpegSource, error) {
+	if _, err := exec.LookPath(c.App); err != nil {
+		return nil, fmt.Errorf("app %s does not exist", c.App)
+	}
+
+	if len(c.Args) == 0 {
+		return nil, fmt.Errorf("args cannot be empty")
+	}
+
+	transport, err := newTransport(c.Transport, c.PipeName, c.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	source := &ffmpegSource{
+		app:             c.App,
+		args:            c.Args,
+		fromFile:        c.FromFile,
+		keyframeRestart: c.KeyframeRestart,
+		transport:       transport,
+		frames:          make(chan *h264.Frame, 240),
+		progress:        newProgressParser(nil),
+	}
+	//the audio and the renditions are handed over like the video, pipe_name is their address with a socket transport
+	if c.AudioPipe != "" {
+		source.audio, err = newTransport(c.Transport, c.AudioPipe, c.AudioPipe)
+		if err != nil {
+			return nil, err
+		}
+		source.audioCodec = audio.Opus
+		if c.AudioCodec != "" {
+			source.audioCodec = audio.CodecByName(c.AudioCodec)
+		}
+		source.audioFrames = make(chan *audio.Frame, 50)
+	}
+
+	if len(c.Renditions) > 0 {
+		source.bitrates = []int{c.Bitrate}
+		for _, rendition := range c.Renditions {
+			renditionTransport, err := newTransport(c.Transport, rendition.PipeName, rendition.PipeName)
+			if err != nil {
+				return nil, err
+			}
+
+			source.renditions = append(source.renditions, renditionTransport)
+			source.renditionFrames = append(source.renditionFrames, make(chan *h264.Frame, 240))
+			source.bitrates = append(source.bitrates, rendition.Bitrate)
+		}
+	}
+
+	source.supervisor = newSupervisor(c.App, c.Args, c.MaxRestarts, source.setIO, transport.started)
+
+	return source, nil
+}
+
+func (f *ffmpegSource) Start() error {
+	if err := f.initIO(); err != nil {
+		return err
+	}
+
+	f.done = make(chan bool)
+
+	f.readers.Add(1)
+	go f.read(f.transport, f.frames, f.done)
+
+	if f.audio != nil {
+		if err := f.audio.open(); err != nil {
+			f.stopReaders(0)
+			return err
+		}
+
+		f.readers.Add(1)
+		go f.readAudio(f.done)
+	}
+
+	for i, rendition := range f.renditions {
+		if err := rendition.open(); err != nil {
+			f.stopReaders(i)
+			return err
+		}
+
+		f.readers.Add(1)
+		go f.read(rendition, f.renditionFrames[i], f.done)
+	}
+
+	f.supervisor.Start()
+
+	return nil
+}
+
+func (f *ffmpegSource) Stop() error {
+	//stop the ffmpeg process, it is killed if it does not exit in time
+	f.supervisor.Stop()
+
+	err := f.stopReaders(len(f.renditions))
+
+	if f.logFile != nil {
+		f.logFile.Close()
+	}
+
+	return err
+}
+
+//stopReaders stops the readers, closes the io like closeIO and waits for the readers to exit
+//the frames channels are not written to once it returns
+func (f *ffmpegSource) stopReaders(count int) error {
+	if f.done == nil {
+		return nil
+	}
+
+	close(f.done)
+	f.done = nil
+
+	err := f.closeIO(count)
+	f.readers.Wait()
+
+	return err
+}
+
+//closeIO closes the transport, the audio pipe and the first count rendition pipes
+func (f *ffmpegSource) closeIO(count int) error {
+	err := f.transport.close()
+
+	if f.audio != nil {
+		if audioErr := f.audio.close(); err == nil {
+			err = audioErr
+		}
+	}
+
+	for _, rendition := range f.renditions[:count] {
+		if renditionErr := rendition.close(); err == nil {
+			err = renditionErr
+		}
+	}
+
+	return err
+}
+
+func (f *ffmpegSource) Frames() <-chan *h264.Frame {
+	return f.frames
+}
+
+func (f *ffmpegSource) Bitrates() []int {
+	return f.bitrates
+}
+
+func (f *ffmpegSource) RenditionFrames() []<-chan *h264.Frame {
+	frames := make([]<-chan *h264.Frame, len(f.renditionFrames))
+	for i, rendition := range f.renditionFrames {
+		frames[i] = rendition
+	}
+
+	return frames
+}
+
+//AudioCodec returns the codec of the audio pipe, nil without one
+func (f *ffmpegSource) AudioCodec() *audio.Codec {
+	return f.audioCodec
+}
+
+func (f *ffmpegSource) AudioFrames() <-chan *audio.Frame {
+	return f.audioFrames
+}
+
+func (f *ffmpegSource) Info() SourceInfo {
+	return SourceInfo{
+		Kind:     SourceTypeFFmpeg,
+		Codec:    "h264",
+		Live:     !f.fromFile,
+		Realtime: true,
+		State:    f.supervisor.State(),
+	}
+}
+
+func (f *ffmpegSource) initIO() error {
+	if err := f.transport.open(); err != nil {
+		return err
+	}
+
+	//create log file for app
+	logFile, err := os.OpenFile(f.app+".log", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		logger.Errorf("error creating log file: %v\n", err)
+	}
+
+	f.logFile = logFile
+	if logFile != nil {
+		f.progress.out = logFile
+	}
+
+	return nil
+}
+
+//setIO attaches the transport and the progress parser to a new command, the parser passes stderr through to the log file
+func (f *ffmpegSource) setIO(cmd *exec.Cmd) error {
+	cmd.Stderr = f.progress
+
+	return f.transport.attach(cmd)
+}
+
+//RequestKeyframe restarts the app if keyframe_restart is set, a restarted encoder starts with a keyframe
+func (f *ffmpegSource) RequestKeyframe() {
+	if !f.keyframeRestart {
+		return
+	}
+
+	logger.Infof("restarting %v for a keyframe\n", f.app)
+	f.supervisor.Restart()
+}
+
+//Bitrate returns the bitrate of the -b:v argument of the app, 0 when it has none
+func (f *ffmpegSource) Bitrate() int {
+	bitrate, err := argBitrate(f.supervisor.Args())
+	if err != nil {
+		return 0
+	}
+
+	return bitrate
+}
+
+//SetBitrate restarts the app with a new -b:v argument, ffmpeg can not change the bitrate of a running encoder
+func (f *ffmpegSource) SetBitrate(bitrate int) {
+	f.supervisor.SetArgs(withBitrate(f.supervisor.Args(), bitrate))
+	f.supervisor.Restart()
+}
+
+//Stats returns the statistics parsed from the progress output of the app
+func (f *ffmpegSource) Stats() SourceStats {
+	stats := f.progress.Stats()
+	stats.Restarts = f.supervisor.Restarts()
+
+	return stats
+}
+
+//read assembles the data written into a transport into access units
+//every connection gets a new parser so a restarted app does not continue the access unit of the previous one
+//it returns once done is closed, frames read after that are dropped
+func (f *ffmpegSource) read(transport transport, frames chan *h264.Frame, done chan bool) {
+	defer f.readers.Done()
+
+	buf := make([]byte, 1024*1024)
+
+	emit := func(frame *h264.Frame) {
+		select {
+		case frames <- frame:
+		case <-done:
+		}
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		reader, err := transport.next()
+		if err != nil {
+			return
+		}
+
+		parser := h264.NewParser()
+
+		for {
+			n, err := reader.Read(buf)
+			if n > 0 {
+				parser.Write(buf[:n], emit)
+			}
+
+			if err != nil {
+				if err != io.EOF && !errors.Is(err, os.ErrClosed) && !errors.Is(err, net.ErrClosed) {
+					logger.Errorf("error reading from %v: %v\n", f.app, err)
+				}
+				break
+			}
+		}
+
+		parser.Flush(emit)
+		reader.Close()
+	}
+}
+
+//readAudio reads the audio until its transport is closed, a socket transport gets a new connection from a restarted app
+func (f *ffmpegSource) readAudio(done chan bool) {
+	defer f.readers.Done()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		reader, err := f.audio.next()
+		if err != nil {
+			return
+		}
+
+		if f.audioCodec == audio.Opus {
+			err = f.readOpus(reader)
+		} else {
+			err = f.readG711(reader)
+		}
+
+		if err != io.EOF && !errors.Is(err, os.ErrClosed) && !errors.Is(err, net.ErrClosed) {
+			logger.Errorf("error reading audio from %v: %v\n", f.app, err)
+		}
+
+		reader.Close()
+	}
+}
+
+//readOpus reads the opus packets of the audio pipe, they are timed by their duration from the capture of the first one
+//a restarted app begins a new ogg stream and a new timeline
+func (f *ffmpegSource) readOpus(reader io.Reader) error {
+	ogg := audio.NewOggOpusReader(reader)
+
+	var timeline rtpTimeline
+	var samples uint32
+
+	for {
+		packet, duration, start, err := ogg.ReadPacket()
+		if err != nil {
+			return err
+		}
+
+		if start {
+			//the first page arrives once it is full, ffmpeg fills a page with a second of audio without -page_duration
+			//so the first packet was captured the duration of the page before its arrival
+			timeline = rtpTimeline{
+				clockRate: audio.Opus.ClockRate,
+				started:   true,
+				base:      time.Now().Add(-duration - ogg.Buffered()),
+			}
+			samples = 0
+		}
+
+		frame := &audio.Frame{
+			Data:      packet,
+			Duration:  duration,
+			Timestamp: timeline.time(samples),
+		}
+		samples += uint32(duration * time.Duration(audio.Opus.ClockRate) / time.Second)
+
+		f.queueAudio(frame)
+	}
+}
+
+//readG711 reads raw g.711 samples from the audio pipe and cuts them into 20ms frames
+//the raw samples have no marker for a restart of the app, a timeline that fell behind the arrival of the samples is started again
+func (f *ffmpegSource) readG711(reader io.Reader) error {
+	var timeline rtpTimeline
+	var samples uint32
+
+	for {
+		data := make([]byte, audio.G711FrameSize)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return err
+		}
+
+		if !timeline.started || time.Since(timeline.time(samples)) > time.Second {
+			timeline = rtpTimeline{clockRate: f.audioCodec.ClockRate}
+			samples = 0
+		}
+
+		frame := &audio.Frame{
+			Data:      data,
+			Duration:  time.Duration(len(data)) * time.Second / time.Duration(f.audioCodec.ClockRate),
+			Timestamp: timeline.time(samples),
+		}
+		samples += uint32(len(data))
+
+		f.queueAudio(frame)
+	}
+}
+
+//queueAudio hands an audio frame to the stream, it is dropped when the stream does not keep up
+func (f *ffmpegSource) queueAudio(frame *audio.Frame) {
+	select {
+	case f.audioFrames <- frame:
+	default:
+		logger.Debugln("audio queue is full, dropping audio")
+	}
+}
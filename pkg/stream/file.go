@@ -0,0 +1,137 @@
+package stream
+
+import (
+	"ffmpeg-webrtc/pkg/h264"
+	"ffmpeg-webrtc/pkg/logger"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+//fileSource reads a raw annex b h264 file directly, no ffmpeg required
+//the file is read as fast as the frames are consumed, pacing is done by the stream clock
+type fileSource struct {
+	path   string
+	loop   bool
+	frames chan *h264.Frame
+	done   chan bool
+	state  string
+	mu     sync.Mutex
+}
+
+func newFileSource(path string, loop bool) (*fileSource, error) {
+	if path == "" {
+		return nil, fmt.Errorf("file must not be empty")
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("error opening file: %v", err)
+	}
+
+	return &fileSource{
+		path:   path,
+		loop:   loop,
+		frames: make(chan *h264.Frame, 240),
+		state:  StateStopped,
+	}, nil
+}
+
+func (f *fileSource) Start() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+
+	f.mu.Lock()
+	f.done = make(chan bool)
+	f.state = StateRunning
+	go f.read(file, f.done)
+	f.mu.Unlock()
+
+	return nil
+}
+
+func (f *fileSource) Stop() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.done != nil {
+		close(f.done)
+		f.done = nil
+	}
+
+	f.state = StateStopped
+
+	return nil
+}
+
+func (f *fileSource) Frames() <-chan *h264.Frame {
+	return f.frames
+}
+
+func (f *fileSource) Info() SourceInfo {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return SourceInfo{
+		Kind:     SourceTypeFile,
+		Codec:    "h264",
+		Live:     false,
+		Realtime: false,
+		State:    f.state,
+	}
+}
+
+//read splits the file into access units, when looping the file is read again from the start once it ends
+func (f *fileSource) read(file *os.File, done chan bool) {
+	defer file.Close()
+
+	buf := make([]byte, 64*1024)
+	parser := h264.NewParser()
+	stopped := false
+
+	emit := func(frame *h264.Frame) {
+		if stopped {
+			return
+		}
+
+		select {
+		case f.frames <- frame:
+		case <-done:
+			stopped = true
+		}
+	}
+
+	for !stopped {
+		n, err := file.Read(buf)
+		if n > 0 {
+			parser.Write(buf[:n], emit)
+		}
+
+		if err == io.EOF {
+			parser.Flush(emit)
+
+			if !f.loop {
+				logger.Infof("reached end of file %v\n", f.path)
+				f.mu.Lock()
+				if f.done == done {
+					f.state = StateStopped
+				}
+				f.mu.Unlock()
+				return
+			}
+
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				logger.Errorf("error rewinding file %v: %v\n", f.path, err)
+				return
+			}
+			continue
+		}
+
+		if err != nil {
+			logger.Errorf("error reading file %v: %v\n", f.path, err)
+			return
+		}
+	}
+}
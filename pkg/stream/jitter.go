@@ -0,0 +1,113 @@
+package stream
+
+import (
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	//defaultJitterLatency is how long a gap in the sequence numbers is waited for before it is skipped
+	defaultJitterLatency = 50 * time.Millisecond
+	//maxJitterPackets skips a gap right away once this many packets are waiting behind it
+	maxJitterPackets = 512
+	//maxSequenceJump is the distance in sequence numbers that is taken as a restarted sender instead of loss
+	maxSequenceJump = 3000
+)
+
+//jitterBuffer puts rtp packets back into sequence number order
+//a missing packet holds the packets behind it for up to latency, then it is counted as lost and skipped
+type jitterBuffer struct {
+	latency time.Duration
+	packets map[uint16]jitterPacket
+	next    uint16
+	started bool
+	//lost counts the packets that were skipped, late the packets that arrived after they were skipped
+	lost int64
+	late int64
+}
+
+type jitterPacket struct {
+	packet  *rtp.Packet
+	arrival time.Time
+}
+
+func newJitterBuffer(latency time.Duration) *jitterBuffer {
+	if latency <= 0 {
+		latency = defaultJitterLatency
+	}
+
+	return &jitterBuffer{
+		latency: latency,
+		packets: make(map[uint16]jitterPacket),
+	}
+}
+
+//push adds a packet, the packet must not share its buffer with other packets
+func (j *jitterBuffer) push(packet *rtp.Packet, now time.Time) {
+	seq := packet.SequenceNumber
+
+	//a large jump is a sender that started over, the packets of the old one are dropped
+	distance := int16(seq - j.next)
+	if j.started && (distance > maxSequenceJump || distance < -maxSequenceJump) {
+		j.reset()
+	}
+
+	if !j.started {
+		j.started = true
+		j.next = seq
+	}
+
+	if int16(seq-j.next) < 0 {
+		j.late++
+		return
+	}
+
+	if _, exists := j.packets[seq]; exists {
+		return
+	}
+
+	j.packets[seq] = jitterPacket{packet: packet, arrival: now}
+}
+
+//pop returns the packets that are ready in sequence number order
+func (j *jitterBuffer) pop(now time.Time) []*rtp.Packet {
+	var ready []*rtp.Packet
+
+	for len(j.packets) > 0 {
+		if p, exists := j.packets[j.next]; exists {
+			ready = append(ready, p.packet)
+			delete(j.packets, j.next)
+			j.next++
+			continue
+		}
+
+		//there is a gap, skip it once the packets behind it waited long enough or there are too many of them
+		first := j.next
+		var oldest time.Time
+
+		for seq, p := range j.packets {
+			if first == j.next || int16(seq-first) < 0 {
+				first = seq
+			}
+
+			if oldest.IsZero() || p.arrival.Before(oldest) {
+				oldest = p.arrival
+			}
+		}
+
+		if now.Sub(oldest) < j.latency && len(j.packets) < maxJitterPackets {
+			break
+		}
+
+		j.lost += int64(uint16(first - j.next))
+		j.next = first
+	}
+
+	return ready
+}
+
+func (j *jitterBuffer) reset() {
+	j.packets = make(map[uint16]jitterPacket)
+	j.started = false
+}
@@ -0,0 +1,120 @@
+package stream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func jitterSequences(packets []*rtp.Packet) []uint16 {
+	var sequences []uint16
+	for _, packet := range packets {
+		sequences = append(sequences, packet.SequenceNumber)
+	}
+
+	return sequences
+}
+
+func equalSequences(a []uint16, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestJitterBuffer(t *testing.T) {
+	type step struct {
+		//push are the sequence numbers that arrive at the time of the step, then the buffer is popped
+		at   time.Duration
+		push []uint16
+		want []uint16
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+		lost  int64
+		late  int64
+	}{
+		{"in order", []step{
+			{0, []uint16{10, 11, 12}, []uint16{10, 11, 12}},
+		}, 0, 0},
+		{"reordered", []step{
+			{0, []uint16{10, 12}, []uint16{10}},
+			{10 * time.Millisecond, []uint16{11}, []uint16{11, 12}},
+		}, 0, 0},
+		{"reordered across the wrap", []step{
+			{0, []uint16{65534, 0, 65535}, []uint16{65534, 65535, 0}},
+		}, 0, 0},
+		{"duplicate", []step{
+			{0, []uint16{10, 12, 12}, []uint16{10}},
+			{10 * time.Millisecond, []uint16{11, 11}, []uint16{11, 12}},
+			{20 * time.Millisecond, []uint16{12}, nil},
+		}, 0, 1},
+		{"gap skipped after the latency", []step{
+			{0, []uint16{10, 12, 13}, []uint16{10}},
+			{49 * time.Millisecond, nil, nil},
+			{50 * time.Millisecond, nil, []uint16{12, 13}},
+		}, 1, 0},
+		{"late", []step{
+			{0, []uint16{10, 13}, []uint16{10}},
+			{60 * time.Millisecond, nil, []uint16{13}},
+			{70 * time.Millisecond, []uint16{11, 12, 14}, []uint16{14}},
+		}, 2, 2},
+		{"restarted sender", []step{
+			{0, []uint16{10, 11}, []uint16{10, 11}},
+			{10 * time.Millisecond, []uint16{40000, 40001}, []uint16{40000, 40001}},
+		}, 0, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			jitter := newJitterBuffer(50 * time.Millisecond)
+			start := time.Unix(100, 0)
+
+			for i, step := range test.steps {
+				now := start.Add(step.at)
+				for _, seq := range step.push {
+					jitter.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: seq}}, now)
+				}
+
+				if got := jitterSequences(jitter.pop(now)); !equalSequences(got, step.want) {
+					t.Errorf("step %d popped %v, want %v", i, got, step.want)
+				}
+			}
+
+			if jitter.lost != test.lost || jitter.late != test.late {
+				t.Errorf("counted %d lost and %d late packets, want %d lost and %d late", jitter.lost, jitter.late, test.lost, test.late)
+			}
+		})
+	}
+}
+
+func TestJitterBufferFull(t *testing.T) {
+	jitter := newJitterBuffer(time.Second)
+	now := time.Unix(100, 0)
+
+	jitter.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: 0}}, now)
+	jitter.pop(now)
+
+	//the gap is skipped before the latency once the packets behind it fill the buffer
+	for seq := uint16(2); seq < 2+maxJitterPackets; seq++ {
+		jitter.push(&rtp.Packet{Header: rtp.Header{SequenceNumber: seq}}, now)
+	}
+
+	if got := jitter.pop(now); len(got) != maxJitterPackets || got[0].SequenceNumber != 2 {
+		t.Errorf("popped %d packets, want the %d behind the gap", len(got), maxJitterPackets)
+	}
+
+	if jitter.lost != 1 {
+		t.Errorf("counted %d lost packets, want 1", jitter.lost)
+	}
+}
@@ -0,0 +1,228 @@
+package stream
+
+import (
+	"crypto/subtle"
+	"ffmpeg-webrtc/pkg/logger"
+	"ffmpeg-webrtc/pkg/rtmp"
+	"ffmpeg-webrtc/pkg/server"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+//Manager runs all streams of a config behind a single http server
+//the rtmp server is started on rtmpAddr once the config has an rtmp stream
+type Manager struct {
+	configPath string
+	streams    []*Stream
+	server     *server.Server
+	rtmp       *rtmp.Server
+	rtmpAddr   string
+	//rtmpStarted is set once the rtmp server listens
+	rtmpStarted bool
+	done        chan bool
+	mu          sync.Mutex
+}
+
+//NewManager loads the config and creates its streams, the server listens on addr and serves the player from assetDir
+//rtmp publishers are accepted on rtmpAddr
+func NewManager(configPath string, addr string, rtmpAddr string, assetDir string) (*Manager, error) {
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	manager := &Manager{
+		configPath: configPath,
+		rtmpAddr:   rtmpAddr,
+		done:       make(chan bool, 1),
+	}
+	manager.rtmp = rtmp.NewServer(manager.rtmpHandler)
+	manager.server = server.NewServer(addr, assetDir, func() interface{} { return manager.Stats() }, manager.done)
+	manager.server.OnReload(manager.Reload)
+
+	for _, streamConfig := range config.Streams {
+		stream, err := NewStream(streamConfig)
+		if err != nil {
+			return nil, fmt.Errorf("stream %s: %v", streamConfig.Name, err)
+		}
+
+		manager.streams = append(manager.streams, stream)
+		manager.server.AddRoom(stream.Name(), stream.room)
+		manager.updateWHIPTarget(stream)
+	}
+
+	return manager, nil
+}
+
+func (m *Manager) Start() error {
+	go m.server.Start()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.startRTMP(); err != nil {
+		return err
+	}
+
+	for _, stream := range m.streams {
+		if err := stream.Start(); err != nil {
+			return fmt.Errorf("stream %s: %v", stream.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+func (m *Manager) Stop() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var firstErr error
+
+	for _, stream := range m.streams {
+		if err := stream.Stop(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("stream %s: %v", stream.Name(), err)
+		}
+	}
+
+	m.rtmp.Close()
+	close(m.done)
+
+	return firstErr
+}
+
+//Reload reads the config again and applies the differences to the running streams
+//new streams are started and removed ones stopped, a stream whose config changed gets a new source but keeps its viewers
+//streams whose config did not change are not touched, nothing is changed if the config is invalid
+func (m *Manager) Reload() error {
+	config, err := LoadConfig(m.configPath)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	running := make(map[string]*Stream)
+	for _, stream := range m.streams {
+		running[stream.Name()] = stream
+	}
+
+	var streams []*Stream
+	var firstErr error
+
+	for _, streamConfig := range config.Streams {
+		stream, exists := running[streamConfig.Name]
+		if exists {
+			delete(running, streamConfig.Name)
+			streams = append(streams, stream)
+
+			if reflect.DeepEqual(stream.Config(), streamConfig) {
+				continue
+			}
+
+			logger.Infof("reconfiguring stream %v\n", streamConfig.Name)
+
+			if err := stream.Reconfigure(streamConfig); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("stream %s: %v", streamConfig.Name, err)
+			}
+			m.updateWHIPTarget(stream)
+			continue
+		}
+
+		logger.Infof("adding stream %v\n", streamConfig.Name)
+
+		stream, err := NewStream(streamConfig)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("stream %s: %v", streamConfig.Name, err)
+			}
+			continue
+		}
+
+		if err := stream.Start(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("stream %s: %v", streamConfig.Name, err)
+		}
+
+		streams = append(streams, stream)
+		m.server.AddRoom(stream.Name(), stream.room)
+		m.updateWHIPTarget(stream)
+	}
+
+	for name, stream := range running {
+		logger.Infof("removing stream %v\n", name)
+
+		m.server.RemoveRoom(name)
+		m.server.RemoveWHIPTarget(name)
+
+		if err := stream.Stop(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("stream %s: %v", name, err)
+		}
+	}
+
+	m.streams = streams
+
+	if err := m.startRTMP(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+
+	return firstErr
+}
+
+//updateWHIPTarget accepts whip publishers for a stream with a whip source
+func (m *Manager) updateWHIPTarget(stream *Stream) {
+	if stream.Config().Type == SourceTypeWHIP {
+		m.server.AddWHIPTarget(stream.Name(), stream)
+	} else {
+		m.server.RemoveWHIPTarget(stream.Name())
+	}
+}
+
+//startRTMP starts the rtmp server for the first rtmp stream, it keeps running when the stream is removed again
+func (m *Manager) startRTMP() error {
+	if m.rtmpStarted {
+		return nil
+	}
+
+	for _, stream := range m.streams {
+		if stream.Config().Type == SourceTypeRTMP {
+			if err := m.rtmp.Listen(m.rtmpAddr); err != nil {
+				return err
+			}
+			m.rtmpStarted = true
+			return nil
+		}
+	}
+
+	return nil
+}
+
+//rtmpHandler returns the rtmp source of the stream with the stream key of a publisher
+func (m *Manager) rtmpHandler(key string) rtmp.Handler {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, stream := range m.streams {
+		source, ok := stream.rtmpSource()
+		if ok && subtle.ConstantTimeCompare([]byte(key), []byte(source.StreamKey())) == 1 {
+			return source
+		}
+	}
+
+	return nil
+}
+
+//Stats returns the statistics of all streams by name
+func (m *Manager) Stats() map[string]StreamStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := make(map[string]StreamStats)
+
+	for _, stream := range m.streams {
+		stats[stream.Name()] = stream.Stats()
+	}
+
+	return stats
+}
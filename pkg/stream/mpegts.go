@@ -0,0 +1,209 @@
+package stream
+
+import (
+	"errors"
+	"ffmpeg-webrtc/pkg/h264"
+	"ffmpeg-webrtc/pkg/logger"
+	"ffmpeg-webrtc/pkg/mpegts"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+//mpegtsMaxJump is the largest dts jump between frames that is taken as the real distance
+//a bigger jump is a restarted or switched encoder, its timeline starts over
+const mpegtsMaxJump = 10 * time.Second
+
+//mpegtsSource receives an mpeg transport stream over udp, unicast or multicast, or from a tcp connection
+//the h264 of the first program is extracted with its pts, hardware encoders often only speak mpeg-ts
+type mpegtsSource struct {
+	address   string
+	transport transport
+	frames    chan *h264.Frame
+	done      chan bool
+	exited    chan bool
+	state     string
+	stats     SourceStats
+	mu        sync.Mutex
+}
+
+func newMPEGTSSource(c *StreamConfig) (*mpegtsSource, error) {
+	kind := c.Transport
+	if kind == "" {
+		kind = TransportUDP
+	}
+
+	if kind != TransportUDP && kind != TransportTCP {
+		return nil, fmt.Errorf("transport %s is not supported by mpegts sources, use udp or tcp", kind)
+	}
+
+	transport, err := newTransport(kind, "", c.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mpegtsSource{
+		address:   c.Address,
+		transport: transport,
+		frames:    make(chan *h264.Frame, 240),
+		state:     StateStopped,
+	}, nil
+}
+
+func (m *mpegtsSource) Start() error {
+	if err := m.transport.open(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.done = make(chan bool)
+	m.exited = make(chan bool)
+	m.state = StateRunning
+	done, exited := m.done, m.exited
+	m.mu.Unlock()
+
+	go m.read(done, exited)
+
+	return nil
+}
+
+func (m *mpegtsSource) Stop() error {
+	m.mu.Lock()
+	done, exited := m.done, m.exited
+	m.done = nil
+	m.mu.Unlock()
+
+	if done == nil {
+		return nil
+	}
+
+	close(done)
+	err := m.transport.close()
+	<-exited
+
+	m.mu.Lock()
+	m.state = StateStopped
+	m.mu.Unlock()
+
+	return err
+}
+
+func (m *mpegtsSource) Frames() <-chan *h264.Frame {
+	return m.frames
+}
+
+func (m *mpegtsSource) Info() SourceInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return SourceInfo{
+		Kind:     SourceTypeMPEGTS,
+		Codec:    "h264",
+		Live:     true,
+		Realtime: true,
+		State:    m.state,
+	}
+}
+
+//Stats returns the number of frames received, ContinuityErrors counts the transport stream packets that were lost
+func (m *mpegtsSource) Stats() SourceStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.stats
+}
+
+//read demuxes every connection, or all datagrams, with a new demuxer so a new sender starts with a clean state
+func (m *mpegtsSource) read(done chan bool, exited chan bool) {
+	defer close(exited)
+
+	buf := make([]byte, 64*1024)
+
+	for {
+		reader, err := m.transport.next()
+		if err != nil {
+			return
+		}
+
+		demuxer := h264Demuxer{source: m, done: done, demuxer: mpegts.NewDemuxer(), parser: h264.NewParser()}
+
+		for {
+			n, err := reader.Read(buf)
+			if n > 0 {
+				demuxer.write(buf[:n])
+			}
+
+			if err != nil {
+				if err != io.EOF && !errors.Is(err, os.ErrClosed) && !errors.Is(err, net.ErrClosed) {
+					logger.Errorf("error reading mpegts on %v: %v\n", m.address, err)
+				}
+				break
+			}
+		}
+
+		reader.Close()
+	}
+}
+
+//h264Demuxer turns the pes of one transport stream into frames timed by their pts
+//the timeline follows the dts, which grows in the order the frames arrive in, and the pts is placed on it
+type h264Demuxer struct {
+	source   *mpegtsSource
+	done     chan bool
+	demuxer  *mpegts.Demuxer
+	parser   *h264.Parser
+	timeline rtpTimeline
+	previous uint64
+	started  bool
+	errors   int64
+}
+
+func (d *h264Demuxer) write(data []byte) {
+	d.demuxer.Write(data, d.pes)
+
+	if errors := d.demuxer.ContinuityErrors(); errors != d.errors {
+		d.source.mu.Lock()
+		d.source.stats.ContinuityErrors += errors - d.errors
+		d.source.mu.Unlock()
+
+		d.errors = errors
+	}
+}
+
+//pes parses the access units of a pes, they all get its pts
+func (d *h264Demuxer) pes(data []byte, pts uint64, dts uint64) {
+	//the dts has 33 bits, the timeline follows the lower 32 bits which wrap around at the same time
+	jump := time.Duration(int32(uint32(dts)-uint32(d.previous))) * time.Second / mpegts.ClockRate
+	if !d.started || jump > mpegtsMaxJump || jump < -mpegtsMaxJump {
+		if d.started {
+			logger.Infof("mpegts dts on %v jumped by %v, restarting timeline\n", d.source.address, jump)
+		}
+		d.started = true
+		d.timeline = rtpTimeline{clockRate: mpegts.ClockRate}
+	}
+	d.previous = dts
+
+	//with b-frames a picture is shown after frames that are decoded later, its pts is ahead of its dts
+	timestamp := d.timeline.time(uint32(dts)).Add(time.Duration(int32(uint32(pts)-uint32(dts))) * time.Second / mpegts.ClockRate)
+
+	emit := func(frame *h264.Frame) {
+		frame.Timestamp = timestamp
+
+		select {
+		case d.source.frames <- frame:
+		case <-d.done:
+			return
+		}
+
+		d.source.mu.Lock()
+		d.source.stats.Frames++
+		d.source.stats.Updated = time.Now()
+		d.source.mu.Unlock()
+	}
+
+	d.parser.Write(data, emit)
+	d.parser.Flush(emit)
+}
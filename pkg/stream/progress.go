@@ -0,0 +1,146 @@
+package stream
+
+import (
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//SourceStats are live statistics collected from a source
+//Bitrate is in kbit/s, Speed is the processing speed relative to realtime
+type SourceStats struct {
+	Frames     int64     `json:"frames"`
+	FPS        float64   `json:"fps"`
+	Bitrate    float64   `json:"bitrate"`
+	Speed      float64   `json:"speed"`
+	Dropped    int64     `json:"dropped"`
+	Duplicated int64     `json:"duplicated"`
+	Errors     int64     `json:"errors"`
+	LastError  string    `json:"last_error,omitempty"`
+	Restarts   int       `json:"restarts"`
+	Updated    time.Time `json:"updated"`
+
+	//ContinuityErrors counts the mpeg-ts packets that were lost or arrived out of order
+	ContinuityErrors int64 `json:"continuity_errors,omitempty"`
+}
+
+//statsSource is implemented by sources that collect statistics
+type statsSource interface {
+	Stats() SourceStats
+}
+
+var progressField = regexp.MustCompile(`([a-z_]+)=\s*(\S+)`)
+
+//progressParser parses the stderr of ffmpeg while passing it through to the log file
+//it understands both the status line ffmpeg prints by default and the key=value output of -progress
+type progressParser struct {
+	out     io.Writer
+	partial []byte
+	mu      sync.Mutex
+	stats   SourceStats
+}
+
+func newProgressParser(out io.Writer) *progressParser {
+	return &progressParser{out: out}
+}
+
+func (p *progressParser) Write(data []byte) (int, error) {
+	if p.out != nil {
+		p.out.Write(data)
+	}
+
+	p.partial = append(p.partial, data...)
+
+	//status lines are terminated by \r, everything else by \n
+	for {
+		i := strings.IndexAny(string(p.partial), "\r\n")
+		if i == -1 {
+			break
+		}
+
+		line := strings.TrimSpace(string(p.partial[:i]))
+		p.partial = p.partial[i+1:]
+
+		if line != "" {
+			p.parseLine(line)
+		}
+	}
+
+	//a line this long is not something ffmpeg prints, drop it
+	if len(p.partial) > 64*1024 {
+		p.partial = nil
+	}
+
+	return len(data), nil
+}
+
+//Stats returns a copy of the latest statistics
+func (p *progressParser) Stats() SourceStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.stats
+}
+
+func (p *progressParser) parseLine(line string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lower := strings.ToLower(line)
+	if strings.Contains(lower, "error") && !strings.HasPrefix(lower, "frame=") {
+		p.stats.Errors++
+		p.stats.LastError = line
+		p.stats.Updated = time.Now()
+		return
+	}
+
+	fields := progressField.FindAllStringSubmatch(line, -1)
+	if len(fields) == 0 {
+		return
+	}
+
+	for _, field := range fields {
+		key, value := field[1], field[2]
+
+		switch key {
+		case "frame":
+			p.stats.Frames = parseInt(value, p.stats.Frames)
+		case "fps":
+			p.stats.FPS = parseFloat(value, p.stats.FPS)
+		case "bitrate":
+			p.stats.Bitrate = parseFloat(strings.TrimSuffix(value, "kbits/s"), p.stats.Bitrate)
+		case "speed":
+			p.stats.Speed = parseFloat(strings.TrimSuffix(value, "x"), p.stats.Speed)
+		case "drop", "drop_frames":
+			p.stats.Dropped = parseInt(value, p.stats.Dropped)
+		case "dup", "dup_frames":
+			p.stats.Duplicated = parseInt(value, p.stats.Duplicated)
+		default:
+			continue
+		}
+
+		p.stats.Updated = time.Now()
+	}
+}
+
+//parseInt and parseFloat keep the previous value for N/A and other unparsable values
+func parseInt(value string, previous int64) int64 {
+	v, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return previous
+	}
+
+	return v
+}
+
+func parseFloat(value string, previous float64) float64 {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return previous
+	}
+
+	return v
+}
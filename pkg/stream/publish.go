@@ -0,0 +1,144 @@
+package stream
+
+import (
+	"ffmpeg-webrtc/pkg/h264"
+	"ffmpeg-webrtc/pkg/logger"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//publishedSource is the part of the sources that publishers push to, whip and rtmp
+//the source accepts a publisher at any time, a new publisher replaces the previous one
+//frames are only passed on while the source is started
+type publishedSource struct {
+	kind      string
+	streamKey string
+	frames    chan *h264.Frame
+	running   bool
+	//publisher counts the publishers, it tells a publisher whether it has been replaced
+	publisher int
+	connected bool
+	stats     SourceStats
+	mu        sync.Mutex
+}
+
+func newPublishedSource(kind string, c *StreamConfig) (*publishedSource, error) {
+	if c.StreamKey == "" {
+		return nil, fmt.Errorf("stream_key must not be empty")
+	}
+
+	return &publishedSource{
+		kind:      kind,
+		streamKey: c.StreamKey,
+		frames:    make(chan *h264.Frame, 240),
+	}, nil
+}
+
+func (p *publishedSource) Start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.running = true
+
+	return nil
+}
+
+func (p *publishedSource) Stop() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.running = false
+
+	return nil
+}
+
+func (p *publishedSource) Frames() <-chan *h264.Frame {
+	return p.frames
+}
+
+func (p *publishedSource) Info() SourceInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state := StateStopped
+	if p.running {
+		state = StateStarting
+		if p.connected {
+			state = StateRunning
+		}
+	}
+
+	return SourceInfo{
+		Kind:     p.kind,
+		Codec:    "h264",
+		Live:     true,
+		Realtime: true,
+		State:    state,
+	}
+}
+
+//Stats returns the number of frames received, Restarts counts the publishers that connected
+func (p *publishedSource) Stats() SourceStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.stats
+}
+
+func (p *publishedSource) StreamKey() string {
+	return p.streamKey
+}
+
+//connect registers a new publisher and returns its number
+func (p *publishedSource) connect() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.publisher++
+	p.connected = true
+	p.stats.Restarts = p.publisher - 1
+
+	return p.publisher
+}
+
+//disconnect unregisters a publisher unless it has been replaced
+func (p *publishedSource) disconnect(publisher int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.publisher == publisher {
+		p.connected = false
+	}
+}
+
+//replaced reports whether a newer publisher has connected
+func (p *publishedSource) replaced(publisher int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.publisher != publisher
+}
+
+//forward passes a frame of a publisher on, frames are dropped while the source is stopped or the queue is full
+func (p *publishedSource) forward(publisher int, frame *h264.Frame) {
+	p.mu.Lock()
+	forward := p.running && p.publisher == publisher
+	p.mu.Unlock()
+
+	if !forward {
+		return
+	}
+
+	select {
+	case p.frames <- frame:
+	default:
+		logger.Debugf("%v frame queue is full, dropping frame\n", p.kind)
+		return
+	}
+
+	p.mu.Lock()
+	p.stats.Frames++
+	p.stats.Updated = time.Now()
+	p.mu.Unlock()
+}
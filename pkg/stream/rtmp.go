@@ -0,0 +1,64 @@
+package stream
+
+import (
+	"errors"
+	"ffmpeg-webrtc/pkg/logger"
+	"ffmpeg-webrtc/pkg/rtmp"
+	"io"
+	"net"
+)
+
+//rtmpSource receives h264 pushed over rtmp, the rtmp server of the manager hands it the publishers of its stream key
+type rtmpSource struct {
+	*publishedSource
+	conn *rtmp.Conn
+}
+
+func newRTMPSource(c *StreamConfig) (*rtmpSource, error) {
+	source, err := newPublishedSource(SourceTypeRTMP, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rtmpSource{publishedSource: source}, nil
+}
+
+//Publish reads the frames of a publisher until it stops publishing, a previous publisher is disconnected
+func (r *rtmpSource) Publish(conn *rtmp.Conn) {
+	publisher := r.connect()
+	defer r.disconnect(publisher)
+
+	r.mu.Lock()
+	previous := r.conn
+	r.conn = conn
+	r.mu.Unlock()
+
+	if previous != nil {
+		logger.Infof("rtmp publisher %v replaces %v\n", conn.RemoteAddr(), previous.RemoteAddr())
+		previous.Close()
+	}
+
+	defer func() {
+		r.mu.Lock()
+		if r.conn == conn {
+			r.conn = nil
+		}
+		r.mu.Unlock()
+	}()
+
+	//rtmp timestamps are in milliseconds
+	timeline := rtpTimeline{clockRate: 1000}
+
+	for {
+		frame, timestamp, err := conn.ReadFrame()
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) && !r.replaced(publisher) {
+				logger.Errorf("error reading from rtmp publisher %v: %v\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		frame.Timestamp = timeline.time(timestamp)
+		r.forward(publisher, frame)
+	}
+}
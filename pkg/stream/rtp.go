@@ -0,0 +1,239 @@
+package stream
+
+import (
+	"errors"
+	"ffmpeg-webrtc/pkg/h264"
+	"ffmpeg-webrtc/pkg/logger"
+	"ffmpeg-webrtc/pkg/rtsp"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+//rtpReadInterval is how often the jitter buffer is checked for gaps to skip while no packet arrives
+const rtpReadInterval = 10 * time.Millisecond
+
+//rtpSource listens for h264 sent as rtp over udp, for example by ffmpeg -f rtp udp://host:port
+//the payload type and clock rate are taken from the sdp file written by the sender, without one every payload type is accepted
+type rtpSource struct {
+	address string
+	media   *rtsp.Media
+	latency time.Duration
+	conn    *net.UDPConn
+	frames  chan *h264.Frame
+	done    chan bool
+	exited  chan bool
+	state   string
+	stats   SourceStats
+	mu      sync.Mutex
+}
+
+func newRTPSource(c *StreamConfig) (*rtpSource, error) {
+	media := &rtsp.Media{ClockRate: h264.ClockRate}
+
+	if c.SDP != "" {
+		data, err := ioutil.ReadFile(c.SDP)
+		if err != nil {
+			return nil, fmt.Errorf("error reading sdp: %v", err)
+		}
+
+		media, err = rtsp.ParseMedia(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	//the sdp names the destination of the sender, only a multicast group is joined, otherwise all interfaces are used
+	address := c.Address
+	if address == "" && media.Port > 0 {
+		host := ""
+		if ip := net.ParseIP(media.Address); ip != nil && ip.IsMulticast() {
+			host = media.Address
+		}
+		address = net.JoinHostPort(host, strconv.Itoa(media.Port))
+	}
+
+	if address == "" {
+		return nil, fmt.Errorf("address or an sdp with a port is required")
+	}
+
+	if _, err := net.ResolveUDPAddr("udp", address); err != nil {
+		return nil, fmt.Errorf("invalid address %v: %v", address, err)
+	}
+
+	var latency time.Duration
+	if c.Latency != "" {
+		latency, _ = time.ParseDuration(c.Latency)
+	}
+
+	return &rtpSource{
+		address: address,
+		media:   media,
+		latency: latency,
+		frames:  make(chan *h264.Frame, 240),
+		state:   StateStopped,
+	}, nil
+}
+
+func (r *rtpSource) Start() error {
+	addr, err := net.ResolveUDPAddr("udp", r.address)
+	if err != nil {
+		return err
+	}
+
+	var conn *net.UDPConn
+	if addr.IP != nil && addr.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp", nil, addr)
+	} else {
+		conn, err = net.ListenUDP("udp", addr)
+	}
+
+	if err != nil {
+		return fmt.Errorf("error listening on %v: %v", r.address, err)
+	}
+
+	//a bigger socket buffer rides out bursts of large keyframes
+	conn.SetReadBuffer(4 * 1024 * 1024)
+
+	r.mu.Lock()
+	r.conn = conn
+	r.done = make(chan bool)
+	r.exited = make(chan bool)
+	r.state = StateRunning
+	done, exited := r.done, r.exited
+	r.mu.Unlock()
+
+	logger.Infof("receiving rtp on %v\n", r.address)
+
+	go r.read(conn, done, exited)
+
+	return nil
+}
+
+func (r *rtpSource) Stop() error {
+	r.mu.Lock()
+	done, exited, conn := r.done, r.exited, r.conn
+	r.done = nil
+	r.mu.Unlock()
+
+	if done == nil {
+		return nil
+	}
+
+	close(done)
+	err := conn.Close()
+	<-exited
+
+	r.mu.Lock()
+	r.state = StateStopped
+	r.mu.Unlock()
+
+	return err
+}
+
+func (r *rtpSource) Frames() <-chan *h264.Frame {
+	return r.frames
+}
+
+func (r *rtpSource) Info() SourceInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return SourceInfo{
+		Kind:     SourceTypeRTP,
+		Codec:    "h264",
+		Live:     true,
+		Realtime: true,
+		State:    r.state,
+	}
+}
+
+//Stats returns the number of frames received, Dropped counts the packets that were lost or arrived too late
+func (r *rtpSource) Stats() SourceStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.stats
+}
+
+func (r *rtpSource) read(conn *net.UDPConn, done chan bool, exited chan bool) {
+	defer close(exited)
+
+	buf := make([]byte, 64*1024)
+	jitter := newJitterBuffer(r.latency)
+	depacketizer := h264.NewDepacketizer()
+	timeline := rtpTimeline{clockRate: r.media.ClockRate}
+	var ssrc uint32
+
+	emit := func(frame *h264.Frame, timestamp uint32) {
+		frame.Timestamp = timeline.time(timestamp)
+		frame = frame.WithParameterSets(r.media.SPS, r.media.PPS)
+
+		select {
+		case r.frames <- frame:
+		case <-done:
+			return
+		}
+
+		r.mu.Lock()
+		r.stats.Frames++
+		r.stats.Dropped = jitter.lost + jitter.late
+		r.stats.Updated = time.Now()
+		r.mu.Unlock()
+	}
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(rtpReadInterval))
+
+		n, _, err := conn.ReadFromUDP(buf)
+		now := time.Now()
+
+		if err != nil {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				logger.Errorf("error reading rtp on %v: %v\n", r.address, err)
+				return
+			}
+		}
+
+		if n > 0 {
+			//the jitter buffer keeps the packet, it needs its own copy of the data
+			packet := &rtp.Packet{}
+			if err := packet.Unmarshal(append([]byte(nil), buf[:n]...)); err != nil {
+				continue
+			}
+
+			if r.media.PayloadType != 0 && packet.PayloadType != r.media.PayloadType {
+				continue
+			}
+
+			//a new ssrc is a restarted sender, its sequence numbers and timestamps start over
+			if packet.SSRC != ssrc {
+				if ssrc != 0 {
+					logger.Infof("rtp sender on %v changed\n", r.address)
+				}
+				ssrc = packet.SSRC
+				jitter.reset()
+				depacketizer = h264.NewDepacketizer()
+				timeline = rtpTimeline{clockRate: r.media.ClockRate}
+			}
+
+			jitter.push(packet, now)
+		}
+
+		for _, packet := range jitter.pop(now) {
+			depacketizer.Write(packet, emit)
+		}
+	}
+}
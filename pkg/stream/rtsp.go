@@ -0,0 +1,323 @@
+package stream
+
+import (
+	"ffmpeg-webrtc/pkg/audio"
+	"ffmpeg-webrtc/pkg/h264"
+	"ffmpeg-webrtc/pkg/logger"
+	"ffmpeg-webrtc/pkg/rtsp"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+//rtspTimeout limits every rtsp request and the time without a packet before the source reconnects
+const rtspTimeout = 10 * time.Second
+
+//rtspSource pulls h264 from an rtsp server, usually an ip camera, and reconnects when the connection fails
+type rtspSource struct {
+	url       string
+	transport string
+	frames    chan *h264.Frame
+	done      chan bool
+	exited    chan bool
+	state     string
+	stats     SourceStats
+	mu        sync.Mutex
+	//audioCodec is the g.711 codec of the camera audio that is forwarded, nil to leave the audio out
+	audioCodec  *audio.Codec
+	audioFrames chan *audio.Frame
+}
+
+func newRTSPSource(c *StreamConfig) (*rtspSource, error) {
+	if !strings.HasPrefix(c.URL, "rtsp://") {
+		return nil, fmt.Errorf("url %q must be an rtsp:// url", rtsp.Redact(c.URL))
+	}
+
+	switch c.Transport {
+	case "", rtsp.TransportTCP, rtsp.TransportUDP:
+	default:
+		return nil, fmt.Errorf("unknown rtsp transport %s", c.Transport)
+	}
+
+	source := &rtspSource{
+		url:       c.URL,
+		transport: c.Transport,
+		frames:    make(chan *h264.Frame, 240),
+		state:     StateStopped,
+	}
+	if c.AudioCodec != "" {
+		source.audioCodec = audio.CodecByName(c.AudioCodec)
+		source.audioFrames = make(chan *audio.Frame, 50)
+	}
+
+	return source, nil
+}
+
+func (r *rtspSource) Start() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.done = make(chan bool)
+	r.exited = make(chan bool)
+	r.state = StateStarting
+	r.stats.Restarts = 0
+
+	go r.run(r.done, r.exited)
+
+	return nil
+}
+
+func (r *rtspSource) Stop() error {
+	r.mu.Lock()
+	done, exited := r.done, r.exited
+	r.done = nil
+	r.mu.Unlock()
+
+	if done == nil {
+		return nil
+	}
+
+	close(done)
+	<-exited
+
+	r.setState(StateStopped)
+
+	return nil
+}
+
+func (r *rtspSource) Frames() <-chan *h264.Frame {
+	return r.frames
+}
+
+//AudioCodec returns the configured g.711 codec, the viewers get an audio track even while the camera sends none
+func (r *rtspSource) AudioCodec() *audio.Codec {
+	return r.audioCodec
+}
+
+func (r *rtspSource) AudioFrames() <-chan *audio.Frame {
+	return r.audioFrames
+}
+
+func (r *rtspSource) Info() SourceInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return SourceInfo{
+		Kind:     SourceTypeRTSP,
+		Codec:    "h264",
+		Live:     true,
+		Realtime: true,
+		State:    r.state,
+	}
+}
+
+//Stats returns the number of frames received, the connection errors and the reconnects
+func (r *rtspSource) Stats() SourceStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.stats
+}
+
+func (r *rtspSource) setState(state string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.state = state
+}
+
+//run keeps a session open, reconnecting with the same backoff the supervisor uses for crashed apps
+func (r *rtspSource) run(done chan bool, exited chan bool) {
+	defer close(exited)
+
+	backoff := minBackoff
+
+	for {
+		startedAt := time.Now()
+		err := r.session(done)
+
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		if time.Since(startedAt) >= stableRuntime {
+			backoff = minBackoff
+		}
+
+		r.mu.Lock()
+		r.stats.Errors++
+		r.stats.LastError = err.Error()
+		r.stats.Restarts++
+		r.stats.Updated = time.Now()
+		r.state = StateRestarting
+		r.mu.Unlock()
+
+		logger.Errorf("rtsp %v failed: %v, reconnecting in %v\n", rtsp.Redact(r.url), err, backoff)
+
+		select {
+		case <-done:
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+//session plays the url until the connection fails or the source is stopped
+func (r *rtspSource) session(done chan bool) error {
+	r.setState(StateStarting)
+
+	client, err := rtsp.Dial(r.url, rtspTimeout)
+	if err != nil {
+		return err
+	}
+
+	//closing the client ends a blocking read when the source is stopped
+	ended := make(chan bool)
+	defer close(ended)
+
+	go func() {
+		select {
+		case <-done:
+		case <-ended:
+		}
+		client.Close()
+	}()
+
+	media, err := client.Describe()
+	if err != nil {
+		return err
+	}
+
+	if err := client.Setup(r.transport); err != nil {
+		return err
+	}
+
+	if r.audioCodec != nil {
+		r.setupAudio(client, done)
+	}
+
+	if err := client.Play(); err != nil {
+		return err
+	}
+
+	logger.Infof("playing %v\n", rtsp.Redact(r.url))
+	r.setState(StateRunning)
+
+	go r.keepAlive(client, ended)
+
+	depacketizer := h264.NewDepacketizer()
+	timeline := rtpTimeline{clockRate: media.ClockRate}
+
+	emit := func(frame *h264.Frame, timestamp uint32) {
+		//a select picks any ready case, so a stopped source is checked first to not push a frame after Stop drained
+		if stopped(done) {
+			return
+		}
+
+		frame.Timestamp = timeline.time(timestamp)
+
+		//cameras often only send the parameter sets in the sdp
+		frame = frame.WithParameterSets(media.SPS, media.PPS)
+
+		select {
+		case r.frames <- frame:
+		case <-done:
+			return
+		}
+
+		r.mu.Lock()
+		r.stats.Frames++
+		r.stats.Updated = time.Now()
+		r.mu.Unlock()
+	}
+
+	for {
+		packet, err := client.ReadPacket()
+		if stopped(done) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if packet.PayloadType != media.PayloadType {
+			continue
+		}
+
+		depacketizer.Write(packet, emit)
+	}
+}
+
+//setupAudio forwards the audio of the camera if it is sent with the configured codec, the video plays without it otherwise
+func (r *rtspSource) setupAudio(client *rtsp.Client, done chan bool) {
+	media := client.Audio()
+	if media == nil || !strings.EqualFold(media.Encoding, r.audioCodec.Name) {
+		logger.Errorf("rtsp %v has no %v audio, playing the video only\n", rtsp.Redact(r.url), r.audioCodec.Name)
+		return
+	}
+
+	timeline := rtpTimeline{clockRate: media.ClockRate}
+
+	//udp audio is read in the background of the client, it may still arrive while the source is stopped
+	err := client.SetupAudio(func(packet *rtp.Packet) {
+		if stopped(done) || packet.PayloadType != media.PayloadType || len(packet.Payload) == 0 {
+			return
+		}
+
+		//one byte per sample
+		frame := &audio.Frame{
+			Data:      append([]byte(nil), packet.Payload...),
+			Duration:  time.Duration(len(packet.Payload)) * time.Second / time.Duration(media.ClockRate),
+			Timestamp: timeline.time(packet.Timestamp),
+		}
+
+		select {
+		case r.audioFrames <- frame:
+		default:
+			logger.Debugln("audio queue is full, dropping audio")
+		}
+	})
+	if err != nil {
+		logger.Errorf("error setting up the audio of %v: %v\n", rtsp.Redact(r.url), err)
+	}
+}
+
+func (r *rtspSource) keepAlive(client *rtsp.Client, ended chan bool) {
+	ticker := time.NewTicker(client.KeepAliveInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ended:
+			return
+		case <-ticker.C:
+			//a dead control connection ends the session, the source reconnects
+			if err := client.KeepAlive(); err != nil {
+				logger.Errorf("error keeping rtsp session alive: %v\n", err)
+				client.Close()
+				return
+			}
+		}
+	}
+}
+
+//stopped reports whether done is closed without waiting for it
+func stopped(done chan bool) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
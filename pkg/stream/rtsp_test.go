@@ -0,0 +1,115 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0x00, 0x1f, 0xe9, 0x02, 0x80}
+	testPPS = []byte{0x68, 0xce, 0x3c, 0x80}
+	testIDR = []byte{0x65, 0x88, 0x84, 0x00, 0x33}
+)
+
+//serveRTSP answers a session on conn with a single idr sent interleaved and drops the connection after it
+func serveRTSP(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+
+	reader := textproto.NewReader(bufio.NewReader(conn))
+
+	for {
+		line, err := reader.ReadLine()
+		if err != nil {
+			return
+		}
+
+		header, _ := reader.ReadMIMEHeader()
+		cseq := header.Get("Cseq")
+
+		var method string
+		fmt.Sscanf(line, "%s", &method)
+
+		switch method {
+		case "DESCRIBE":
+			sdp := "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\nm=video 0 RTP/AVP 96\r\na=rtpmap:96 H264/90000\r\n" +
+				"a=fmtp:96 packetization-mode=1;sprop-parameter-sets=" + base64.StdEncoding.EncodeToString(testSPS) + "," + base64.StdEncoding.EncodeToString(testPPS) + "\r\n"
+			fmt.Fprintf(conn, "RTSP/1.0 200 OK\r\nCSeq: %s\r\nContent-Length: %d\r\n\r\n%s", cseq, len(sdp), sdp)
+		case "SETUP":
+			fmt.Fprintf(conn, "RTSP/1.0 200 OK\r\nCSeq: %s\r\nSession: 1\r\n\r\n", cseq)
+		case "PLAY":
+			fmt.Fprintf(conn, "RTSP/1.0 200 OK\r\nCSeq: %s\r\n\r\n", cseq)
+
+			packet := &rtp.Packet{
+				Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: 1, Timestamp: 9000, Marker: true, SSRC: 1},
+				Payload: testIDR,
+			}
+			data, err := packet.Marshal()
+			if err != nil {
+				t.Errorf("error marshalling packet: %v", err)
+				return
+			}
+
+			header := []byte{'$', 0, 0, 0}
+			binary.BigEndian.PutUint16(header[2:], uint16(len(data)))
+			conn.Write(append(header, data...))
+
+			return
+		default:
+			fmt.Fprintf(conn, "RTSP/1.0 200 OK\r\nCSeq: %s\r\n\r\n", cseq)
+		}
+	}
+}
+
+func TestRTSPSourceReconnects(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveRTSP(t, conn)
+		}
+	}()
+
+	source, err := newRTSPSource(&StreamConfig{Type: SourceTypeRTSP, URL: fmt.Sprintf("rtsp://%s/cam", listener.Addr())})
+	if err != nil {
+		t.Fatalf("error creating source: %v", err)
+	}
+
+	if err := source.Start(); err != nil {
+		t.Fatalf("error starting source: %v", err)
+	}
+	defer source.Stop()
+
+	//the second keyframe only arrives once the source reconnected after the dropped session
+	for i := 0; i < 2; i++ {
+		select {
+		case frame := <-source.Frames():
+			if !frame.Keyframe || !bytes.Equal(frame.SPS(), testSPS) || !bytes.Equal(frame.PPS(), testPPS) {
+				t.Errorf("frame %d is not the idr with the parameter sets of the sdp", i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d of 2 frames", i)
+		}
+	}
+
+	stats := source.Stats()
+	if stats.Restarts < 1 || stats.Frames < 2 {
+		t.Errorf("source restarted %d times with %d frames, want a restart and 2 frames", stats.Restarts, stats.Frames)
+	}
+}
@@ -0,0 +1,94 @@
+package stream
+
+import (
+	"ffmpeg-webrtc/pkg/audio"
+	"ffmpeg-webrtc/pkg/h264"
+	"fmt"
+)
+
+//Source produces h264 access units for a stream, the ffmpeg pipe is one implementation
+//others such as raw files, network ingest or synthetic sources can be plugged in without touching the room fan-out
+type Source interface {
+	//Start starts producing frames, the frames are delivered on the channel returned by Frames
+	Start() error
+	//Stop stops the source and releases all of its resources
+	Stop() error
+	//Frames returns the channel the source delivers its frames on
+	Frames() <-chan *h264.Frame
+	//Info returns metadata describing the source
+	Info() SourceInfo
+}
+
+//keyframeSource is implemented by sources that can produce a keyframe on request
+type keyframeSource interface {
+	RequestKeyframe()
+}
+
+//audioSource is implemented by sources that can produce audio next to the video, AudioCodec is nil when they do not
+type audioSource interface {
+	AudioCodec() *audio.Codec
+	AudioFrames() <-chan *audio.Frame
+}
+
+//renditionSource is implemented by sources that also encode the video in other qualities
+//Bitrates holds the bitrate a viewer needs for the video of Frames followed by the one of every rendition
+type renditionSource interface {
+	Bitrates() []int
+	RenditionFrames() []<-chan *h264.Frame
+}
+
+//bitrateSource is implemented by sources whose encoder bitrate can be changed while they run, in bit/s
+type bitrateSource interface {
+	Bitrate() int
+	SetBitrate(bitrate int)
+}
+
+//SourceInfo describes a source
+//Live is false for sources that play back recorded data
+//Realtime is false for sources that deliver frames as fast as they are consumed, those are paced by the stream
+//State is one of the State constants
+type SourceInfo struct {
+	Kind     string `json:"kind"`
+	Codec    string `json:"codec"`
+	Live     bool   `json:"live"`
+	Realtime bool   `json:"realtime"`
+	State    string `json:"state"`
+}
+
+const (
+	SourceTypeFFmpeg = "ffmpeg"
+	SourceTypeFile   = "file"
+	SourceTypeV4L2   = "v4l2"
+	SourceTypeRTSP   = "rtsp"
+	SourceTypeRTP    = "rtp"
+	SourceTypeWHIP   = "whip"
+	SourceTypeMPEGTS = "mpegts"
+	SourceTypeRTMP   = "rtmp"
+)
+
+//newSource creates the source described by the stream configuration
+func newSource(c *StreamConfig) (Source, error) {
+	switch c.Type {
+	case "", SourceTypeFFmpeg:
+		return newFFmpegSource(c)
+	case SourceTypeFile:
+		if c.VOD {
+			return newVODSource(c)
+		}
+		return newFileSource(c.File, c.Loop)
+	case SourceTypeV4L2:
+		return newV4L2Source(c)
+	case SourceTypeRTSP:
+		return newRTSPSource(c)
+	case SourceTypeRTP:
+		return newRTPSource(c)
+	case SourceTypeWHIP:
+		return newWHIPSource(c)
+	case SourceTypeMPEGTS:
+		return newMPEGTSSource(c)
+	case SourceTypeRTMP:
+		return newRTMPSource(c)
+	default:
+		return nil, fmt.Errorf("unknown source type %s", c.Type)
+	}
+}
@@ -1,212 +1,523 @@
 package stream
 
 import (
-	"encoding/json"
-	"ffmpeg-webrtc/pkg/server"
+	"ffmpeg-webrtc/pkg/audio"
+	"ffmpeg-webrtc/pkg/h264"
+	"ffmpeg-webrtc/pkg/logger"
 	wbrtc "ffmpeg-webrtc/pkg/webrtc"
-	"fmt"
-	"io/ioutil"
-	"os"
-	"os/exec"
-	"syscall"
+	"sync"
 	"time"
 
 	"github.com/pion/webrtc/v3"
-	"golang.org/x/sys/unix"
 )
 
 const H264FRAMEDURATION = time.Millisecond * 33
 
+//DefaultLinger is how long a source keeps running after the last viewer left
+const DefaultLinger = 10 * time.Second
+
+//Stream connects a source to the room its viewers are registered in
+//the source only runs while someone is watching, unless the stream is always on
+//the source can be replaced while the stream is running, the room and the connected viewers are kept
 type Stream struct {
-	App      string   `json:"app"`
-	Args     []string `json:"args"`
-	Type     string   `json:"type"`
-	PipeName string   `json:"pipe_name"`
-	FromFile bool     `json:"from_file"`
-	room     *wbrtc.Room
-	server   *server.Server
-	cmd      *exec.Cmd
-	done     chan bool
-	pipe     *os.File
-	logger   *os.File
-}
-
-func NewStream() (*Stream, error) {
-	var stream Stream
-
-	config, err := ioutil.ReadFile("config.json")
+	config StreamConfig
+	room   *wbrtc.Room
+	source Source
+	clock  *frameClock
+	//stop ends the fan-out of the running source, exited is closed once it has ended, stop is nil while the source is stopped
+	stop   chan bool
+	exited chan bool
+	//active is set between Start and Stop, lingering is set while the source waits to be stopped
+	//lingerID tells a linger timer whether it has been cancelled
+	active    bool
+	lingering bool
+	lingerID  int
+	done      chan bool
+	mu        sync.Mutex
+
+	//bitrate adjusts the bitrate of the encoder to the viewers, nil without bitrate_control
+	bitrate *bitrateController
+}
+
+func NewStream(config StreamConfig) (*Stream, error) {
+	source, clock, err := newPipeline(config)
 	if err != nil {
 		return nil, err
 	}
 
-	if err = json.Unmarshal(config, &stream); err != nil {
-		return nil, err
+	done := make(chan bool, 1)
+	room := wbrtc.NewRoom(done)
+
+	stream := &Stream{
+		config: config,
+		room:   room,
+		source: source,
+		clock:  clock,
+		done:   done,
 	}
+	stream.setKeyframeHandler()
+	stream.setPlaybackHandler()
+	stream.setAudioCodec()
+	stream.setRenditions()
+	stream.setBitrateControl()
+	room.OnViewersChange(stream.viewersChanged)
+
+	return stream, nil
+}
 
-	if _, err := exec.LookPath(stream.App); err != nil {
-		return nil, fmt.Errorf("app %s does not exist", stream.App)
+//newPipeline creates the source of a stream and the clock that timestamps its frames
+func newPipeline(config StreamConfig) (Source, *frameClock, error) {
+	source, err := newSource(&config)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if len(stream.Args) == 0 {
-		return nil, fmt.Errorf("args cannot be empty")
+	//live sources are timed by their capture time, recorded ones by their frame rate
+	timing := config.Timing
+	if timing == "" {
+		timing = TimingVUI
+		if source.Info().Live {
+			timing = TimingWallclock
+		}
 	}
 
-	if stream.PipeName == "" {
-		return nil, fmt.Errorf("pipe_name must not be empty")
+	clock, err := newFrameClock(timing, config.FPS, config.Pace || !source.Info().Realtime)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	done := make(chan bool, 1)
-	room := wbrtc.NewRoom(done)
-	server := server.NewServer(room, done)
+	return source, clock, nil
+}
 
-	stream.server = server
-	stream.room = room
-	stream.done = done
+//Name returns the name the stream is served under
+func (s *Stream) Name() string {
+	return s.config.Name
+}
+
+//Config returns the config the stream is currently running with
+func (s *Stream) Config() StreamConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	return &stream, nil
+	return s.config
 }
 
 func (s *Stream) Start() error {
-	cmd := exec.Command(s.App, s.Args...)
-	s.cmd = cmd
+	go s.room.Start()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	fmt.Println(cmd.Args)
+	s.active = true
 
-	if err := s.initIO(cmd); err != nil {
+	if !s.demanded() {
+		return nil
+	}
+
+	return s.startSource()
+}
+
+func (s *Stream) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.active = false
+	s.cancelLinger()
+
+	err := s.stopSource()
+
+	close(s.done)
+
+	return err
+}
+
+//Reconfigure replaces the source with one created from config
+//the room is kept so connected viewers stay connected, the timestamps continue where the old source stopped
+//the old source keeps running if the new one can not be created
+func (s *Stream) Reconfigure(config StreamConfig) error {
+	source, clock, err := newPipeline(config)
+	if err != nil {
 		return err
 	}
 
-	go s.server.Start()
-	go s.room.Start()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	running := s.stop != nil
+
+	if err := s.stopSource(); err != nil {
+		logger.Errorf("error stopping stream %v: %v\n", s.Name(), err)
+	}
+
+	clock.continueFrom(s.clock)
 
-	if s.FromFile {
-		if err := s.streamFromFile(); err != nil {
-			return err
+	s.config = config
+	s.source = source
+	s.clock = clock
+	s.setKeyframeHandler()
+	s.setPlaybackHandler()
+	s.setAudioCodec()
+	s.setRenditions()
+	s.setBitrateControl()
+
+	if !s.active || (!running && !s.demanded()) {
+		return nil
+	}
+
+	return s.startSource()
+}
+
+//demanded tells whether the source should be running
+func (s *Stream) demanded() bool {
+	return s.config.AlwaysOn || s.room.Viewers() > 0
+}
+
+//viewersChanged starts the source for the first viewer and stops it once the last viewer left and the linger time passed
+func (s *Stream) viewersChanged() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.active {
+		return
+	}
+
+	if s.demanded() {
+		s.cancelLinger()
+
+		if s.stop != nil {
+			return
 		}
-	} else {
-		if err := s.streamFromDevice(); err != nil {
-			return err
+
+		logger.Infof("starting stream %v for its first viewer\n", s.Name())
+
+		if err := s.startSource(); err != nil {
+			logger.Errorf("error starting stream %v: %v\n", s.Name(), err)
 		}
+		return
 	}
 
-	return nil
+	if s.stop == nil || s.lingering {
+		return
+	}
+
+	linger := DefaultLinger
+	if s.config.Linger != "" {
+		linger, _ = time.ParseDuration(s.config.Linger)
+	}
+
+	logger.Infof("stopping stream %v in %v, nobody is watching\n", s.Name(), linger)
+
+	s.lingering = true
+	id := s.lingerID
+
+	time.AfterFunc(linger, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if id != s.lingerID || s.demanded() {
+			return
+		}
+		s.lingering = false
+
+		logger.Infof("stopping stream %v\n", s.Name())
+
+		if err := s.stopSource(); err != nil {
+			logger.Errorf("error stopping stream %v: %v\n", s.Name(), err)
+		}
+	})
 }
 
-func (s *Stream) Stop() error {
-	//stop the ffmpeg process
-	s.cmd.Process.Signal(syscall.SIGTERM)
+//cancelLinger keeps the source running when a viewer connects before the linger time passed
+func (s *Stream) cancelLinger() {
+	s.lingering = false
+	s.lingerID++
+}
 
-	//close the pipe
-	if err := s.pipe.Close(); err != nil {
-		return fmt.Errorf("error closing pipe: %v", err)
-	}
+//startSource starts the fan-out and the source
+func (s *Stream) startSource() error {
+	stop := make(chan bool)
+	exited := make(chan bool)
+	s.stop = stop
+	s.exited = exited
 
-	s.logger.Close()
+	go s.stream(s.source, s.clock, stop, exited)
 
-	close(s.done)
+	if s.bitrate != nil {
+		go s.bitrate.run(stop)
+	}
 
-	return nil
+	return s.source.Start()
 }
 
-func (s *Stream) initIO(cmd *exec.Cmd) error {
-	if _, err := os.Stat(s.PipeName); os.IsNotExist(err) {
-		if err := syscall.Mkfifo(s.PipeName, 0666); err != nil {
-			return fmt.Errorf("error creating named pipe: %v", err)
+//stopSource stops the source and its fan-out
+//frames still queued are dropped and the cached gop is cleared, the next run continues the timestamps
+func (s *Stream) stopSource() error {
+	if s.stop == nil {
+		return nil
+	}
+
+	close(s.stop)
+	<-s.exited
+	s.stop = nil
+
+	err := s.source.Stop()
+
+	audioFrames := audioFrames(s.source)
+
+	for drained := false; !drained; {
+		select {
+		case <-s.source.Frames():
+		case <-audioFrames:
+		default:
+			drained = true
 		}
 	}
 
-	//set pipe to non-blocking
-	pipe, err := os.OpenFile(s.PipeName, os.O_RDWR|syscall.O_NONBLOCK, os.ModeNamedPipe)
-	if err != nil {
-		return fmt.Errorf("error opening named pipe: %v", err)
+	for _, frames := range renditionFrames(s.source) {
+		for drained := false; !drained; {
+			select {
+			case <-frames:
+			default:
+				drained = true
+			}
+		}
 	}
 
-	//set the pipe size to 1MB
-	if _, err := unix.FcntlInt(pipe.Fd(), syscall.F_SETPIPE_SZ, 1024*1024); err != nil {
-		return fmt.Errorf("error setting pipe size: %v", err)
+	s.clock.resume()
+	s.room.ResetGOP()
+
+	return err
+}
+
+func (s *Stream) setKeyframeHandler() {
+	if keyframer, ok := s.source.(keyframeSource); ok {
+		s.room.OnKeyframeRequest(keyframer.RequestKeyframe)
+	} else {
+		s.room.OnKeyframeRequest(nil)
 	}
+}
 
-	//check size of pipe
-	pipeSize, err := unix.FcntlInt(pipe.Fd(), syscall.F_GETPIPE_SZ, 0)
-	if err != nil {
-		return fmt.Errorf("error getting pipe size: %v", err)
+//setAudioCodec tells the room whether viewers get an audio track
+func (s *Stream) setAudioCodec() {
+	if source, ok := s.source.(audioSource); ok {
+		s.room.SetAudioCodec(source.AudioCodec())
+	} else {
+		s.room.SetAudioCodec(nil)
 	}
+}
 
-	fmt.Printf("created named pipe with name %v and size %v\n", s.PipeName, pipeSize)
+//audioFrames returns the audio channel of a source, it is nil for a source without audio so reading it blocks
+func audioFrames(source Source) <-chan *audio.Frame {
+	if source, ok := source.(audioSource); ok && source.AudioCodec() != nil {
+		return source.AudioFrames()
+	}
 
-	s.pipe = pipe
+	return nil
+}
 
-	//create log file for app
-	logger, err := os.OpenFile(s.App+".log", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
-	if err != nil {
-		fmt.Printf("error creating log file: %v\n", err)
+//setRenditions tells the room which renditions the viewers can be switched between
+func (s *Stream) setRenditions() {
+	if source, ok := s.source.(renditionSource); ok {
+		s.room.SetRenditions(source.Bitrates())
+	} else {
+		s.room.SetRenditions(nil)
 	}
+}
+
+//setBitrateControl creates the controller of the encoder bitrate if bitrate_control is set
+//new viewers start estimating from the bitrate the source sends
+func (s *Stream) setBitrateControl() {
+	s.bitrate = nil
+	s.room.SetStartBitrate(wbrtc.LowBitrate)
 
-	//set io for cmd
-	s.logger = logger
-	cmd.Stderr = logger
-	cmd.Stdout = pipe
+	source, ok := s.source.(bitrateSource)
+	if !ok || !s.config.BitrateControl {
+		return
+	}
+
+	s.bitrate = newBitrateController(s.Name(), source, s.room)
+	s.room.SetStartBitrate(s.bitrate.current)
+}
+
+//renditionFrames returns the channels of the renditions of a source, nil for a source without renditions
+func renditionFrames(source Source) []<-chan *h264.Frame {
+	if source, ok := source.(renditionSource); ok {
+		return source.RenditionFrames()
+	}
 
 	return nil
 }
 
-func (s *Stream) streamFromFile() error {
-	connected := false
+//renditionFrame is a frame of the rendition with the index, the video of Frames is rendition 0
+type renditionFrame struct {
+	index int
+	frame *h264.Frame
+}
 
-	for !connected {
-		if len(s.room.Clients) < 1 {
-			continue
+//forwardRendition hands the frames of a rendition to the fan-out until it is stopped
+func forwardRendition(index int, frames <-chan *h264.Frame, out chan<- renditionFrame, stop chan bool) {
+	for {
+		select {
+		case frame := <-frames:
+			select {
+			case out <- renditionFrame{index: index, frame: frame}:
+			case <-stop:
+				return
+			}
+		case <-stop:
+			return
 		}
+	}
+}
 
-		for _, client := range s.room.Clients {
-			if client.PC == nil {
-				continue
-			}
+//setPlaybackHandler hands the viewers and their playback messages to sources that give every viewer its own playback
+func (s *Stream) setPlaybackHandler() {
+	player, ok := s.source.(playbackSource)
+	if !ok {
+		s.room.OnViewer(nil)
+		s.room.OnPlayback(nil)
+		return
+	}
 
-			if client.PC.ConnectionState() == webrtc.PeerConnectionStateConnected {
-				connected = true
-				break
-			}
+	room := s.room
+	room.OnViewer(func(clientID string, joined bool) {
+		if joined {
+			player.join(room, clientID)
+		} else {
+			player.leave(clientID)
 		}
+	})
+	room.OnPlayback(player.control)
+
+	//viewers that are already watching when the source is replaced
+	for _, clientID := range room.ViewerIDs() {
+		player.join(room, clientID)
+	}
+}
+
+//StreamKey returns the stream key of a whip source, it is empty for other sources so no publisher is accepted
+func (s *Stream) StreamKey() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if source, ok := s.source.(*whipSource); ok {
+		return source.StreamKey()
 	}
 
-	go s.stream()
+	return ""
+}
 
-	return nil
+//rtmpSource returns the source of the stream if it is an rtmp source
+func (s *Stream) rtmpSource() (*rtmpSource, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	source, ok := s.source.(*rtmpSource)
+
+	return source, ok
 }
 
-func (s *Stream) streamFromDevice() error {
-	go s.stream()
+//Publish hands the track of a whip publisher to the source, the source may be replaced while the publisher is connected
+func (s *Stream) Publish(track *webrtc.TrackRemote, requestKeyframe func()) {
+	s.mu.Lock()
+	source, ok := s.source.(*whipSource)
+	s.mu.Unlock()
 
-	return nil
+	if !ok {
+		return
+	}
+
+	source.Publish(track, requestKeyframe)
 }
 
-func (s *Stream) stream() {
-	buf := make([]byte, 1024*1024)
-	frames := make(chan []byte, 240)
+//StreamStats describes the state of a stream, Stats is nil for sources that do not collect statistics
+type StreamStats struct {
+	Source  SourceInfo   `json:"source"`
+	Stats   *SourceStats `json:"stats,omitempty"`
+	Viewers int          `json:"viewers"`
+
+	//AVOffset is how many milliseconds the audio is sent ahead of the video on average, nil while no viewer gets audio
+	AVOffset *float64 `json:"av_offset_ms,omitempty"`
+}
 
-	go func() {
-		for {
-			n, err := s.pipe.Read(buf)
-			if err != nil {
+//Stats returns the current statistics of the stream
+func (s *Stream) Stats() StreamStats {
+	s.mu.Lock()
+	source := s.source
+	s.mu.Unlock()
+
+	stats := StreamStats{
+		Source:  source.Info(),
+		Viewers: s.room.ClientCount(),
+	}
+
+	if source, ok := source.(statsSource); ok {
+		sourceStats := source.Stats()
+		stats.Stats = &sourceStats
+	}
+
+	if offset, ok := s.room.AVOffset(); ok {
+		milliseconds := float64(offset) / float64(time.Millisecond)
+		stats.AVOffset = &milliseconds
+	}
+
+	return stats
+}
+
+func (s *Stream) stream(source Source, clock *frameClock, stop chan bool, exited chan bool) {
+	defer close(exited)
+
+	audioFrames := audioFrames(source)
+
+	renditions := make(chan renditionFrame)
+	for i, frames := range renditionFrames(source) {
+		go forwardRendition(i+1, frames, renditions, stop)
+	}
+
+	//a paced frame is held until it is due, the audio and the renditions keep flowing meanwhile
+	var held *h264.Frame
+	timer := time.NewTimer(0)
+	<-timer.C
+	defer timer.Stop()
+
+	for {
+		frames := source.Frames()
+		if held != nil {
+			frames = nil
+		}
+
+		select {
+		case frame := <-frames:
+			clock.stamp(frame)
+
+			if d := clock.delay(frame); d > 0 {
+				held = frame
+				timer.Reset(d)
 				continue
 			}
 
-			frames <- buf[:n]
-		}
-	}()
-
-	go func() {
-		for frame := range frames {
-			for _, client := range s.room.Clients {
-				if client.PC != nil {
-					if client.PC.ConnectionState() == webrtc.PeerConnectionStateConnected {
-						client.Frames <- frame
-					}
-				}
+			s.room.WriteFrame(frame)
+		case <-timer.C:
+			//a stop that came in meanwhile wins, the held frame belongs to the timeline before the resume of the clock
+			select {
+			case <-stop:
+				return
+			default:
 			}
-		}
-	}()
 
-	s.cmd.Start()
+			s.room.WriteFrame(held)
+			held = nil
+		case frame := <-audioFrames:
+			if clock.stampAudio(frame) {
+				s.room.WriteAudio(frame)
+			}
+		case rendition := <-renditions:
+			if clock.stampRendition(rendition.index, rendition.frame) {
+				s.room.WriteRenditionFrame(rendition.index, rendition.frame)
+			}
+		case <-stop:
+			//a held frame is dropped like the queued ones, the deferred stop of the timer keeps it from firing
+			return
+		}
+	}
 }
@@ -0,0 +1,254 @@
+package stream
+
+import (
+	"ffmpeg-webrtc/pkg/logger"
+	"fmt"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	StateStarting   = "starting"
+	StateRunning    = "running"
+	StateRestarting = "restarting"
+	StateFailed     = "failed"
+	StateStopped    = "stopped"
+)
+
+const (
+	minBackoff  = time.Second
+	maxBackoff  = 30 * time.Second
+	stopTimeout = 5 * time.Second
+	//a process that ran at least this long is considered healthy and resets the backoff
+	stableRuntime = 10 * time.Second
+)
+
+//supervisor runs a child process and restarts it with exponential backoff when it exits
+//setup is called with every new command before it is started so its io can be attached
+//started is called after every attempt to start a command, so io that belongs to the child can be released
+type supervisor struct {
+	app         string
+	args        []string
+	maxRestarts int
+	setup       func(cmd *exec.Cmd) error
+	started     func()
+	mu          sync.Mutex
+	state       string
+	cmd         *exec.Cmd
+	restarts    int
+	restart     bool
+	stop        chan bool
+	exited      chan bool
+}
+
+func newSupervisor(app string, args []string, maxRestarts int, setup func(cmd *exec.Cmd) error, started func()) *supervisor {
+	return &supervisor{
+		app:         app,
+		args:        args,
+		maxRestarts: maxRestarts,
+		setup:       setup,
+		started:     started,
+		state:       StateStopped,
+	}
+}
+
+//Start starts the process and keeps it running until Stop is called
+func (s *supervisor) Start() {
+	s.mu.Lock()
+	s.stop = make(chan bool)
+	s.exited = make(chan bool)
+	s.restarts = 0
+	s.mu.Unlock()
+
+	go s.run(s.stop, s.exited)
+}
+
+//Stop sends SIGTERM to the process and SIGKILL if it has not exited after stopTimeout
+func (s *supervisor) Stop() {
+	s.mu.Lock()
+	stop, exited := s.stop, s.exited
+	s.stop = nil
+	s.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	s.signal(syscall.SIGTERM)
+
+	select {
+	case <-exited:
+	case <-time.After(stopTimeout):
+		logger.Errorf("%v did not exit after %v, killing it\n", s.app, stopTimeout)
+		s.signal(syscall.SIGKILL)
+		<-exited
+	}
+}
+
+//Restart stops the running process so it is started again right away, without counting it as a crash
+func (s *supervisor) Restart() {
+	s.mu.Lock()
+	if s.cmd == nil {
+		s.mu.Unlock()
+		return
+	}
+	s.restart = true
+	s.mu.Unlock()
+
+	s.signal(syscall.SIGTERM)
+}
+
+//Args returns the arguments the process is started with
+func (s *supervisor) Args() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.args
+}
+
+//SetArgs replaces the arguments, they are used from the next start of the process on
+func (s *supervisor) SetArgs(args []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.args = args
+}
+
+//State returns the current state of the process
+func (s *supervisor) State() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.state
+}
+
+//Restarts returns how many times the process has been restarted
+func (s *supervisor) Restarts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.restarts
+}
+
+func (s *supervisor) run(stop chan bool, exited chan bool) {
+	defer close(exited)
+
+	backoff := minBackoff
+
+	for {
+		s.setState(StateStarting)
+
+		startedAt := time.Now()
+		err := s.runOnce(stop)
+
+		select {
+		case <-stop:
+			s.setState(StateStopped)
+			return
+		default:
+		}
+
+		s.mu.Lock()
+		restart := s.restart
+		s.restart = false
+		s.mu.Unlock()
+
+		if restart {
+			logger.Infof("restarting %v\n", s.app)
+			continue
+		}
+
+		logger.Errorf("%v exited: %v\n", s.app, err)
+
+		if time.Since(startedAt) >= stableRuntime {
+			backoff = minBackoff
+		}
+
+		s.mu.Lock()
+		s.restarts++
+		restarts := s.restarts
+		s.mu.Unlock()
+
+		if s.maxRestarts > 0 && restarts > s.maxRestarts {
+			logger.Errorf("%v failed after %v restarts\n", s.app, s.maxRestarts)
+			s.setState(StateFailed)
+			return
+		}
+
+		s.setState(StateRestarting)
+		logger.Infof("restarting %v in %v\n", s.app, backoff)
+
+		select {
+		case <-stop:
+			s.setState(StateStopped)
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+//runOnce starts the process and waits for it to exit
+func (s *supervisor) runOnce(stop chan bool) error {
+	cmd := exec.Command(s.app, s.Args()...)
+
+	if err := s.setup(cmd); err != nil {
+		return err
+	}
+
+	logger.Infoln(cmd.Args)
+
+	s.mu.Lock()
+	select {
+	case <-stop:
+		s.mu.Unlock()
+		s.started()
+		return nil
+	default:
+	}
+
+	err := cmd.Start()
+	s.started()
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+
+	s.cmd = cmd
+	s.state = StateRunning
+	s.mu.Unlock()
+
+	err = cmd.Wait()
+
+	s.mu.Lock()
+	s.cmd = nil
+	s.mu.Unlock()
+
+	if err == nil {
+		return fmt.Errorf("exited with status 0")
+	}
+
+	return err
+}
+
+func (s *supervisor) signal(sig syscall.Signal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cmd != nil && s.cmd.Process != nil {
+		s.cmd.Process.Signal(sig)
+	}
+}
+
+func (s *supervisor) setState(state string) {
+	s.mu.Lock()
+	s.state = state
+	s.mu.Unlock()
+}
@@ -0,0 +1,212 @@
+package stream
+
+import (
+	"ffmpeg-webrtc/pkg/audio"
+	"ffmpeg-webrtc/pkg/h264"
+	"fmt"
+	"time"
+)
+
+const (
+	//TimingWallclock derives timestamps from the capture time of the frames
+	TimingWallclock = "wallclock"
+	//TimingFPS derives timestamps from the configured frame rate
+	TimingFPS = "fps"
+	//TimingVUI derives timestamps from the vui timing info of the sps, falling back to the configured frame rate
+	TimingVUI = "vui"
+)
+
+//audioResyncThreshold is how far the audio timeline may jump before the audio is anchored to the video again
+//the sources start a new audio timeline when the app restarts or the audio fell behind
+const audioResyncThreshold = time.Second
+
+//frameClock assigns presentation timestamps to frames and optionally paces them by their frame rate
+type frameClock struct {
+	mode          string
+	frameDuration time.Duration
+	pace          bool
+	started       bool
+	start         time.Time
+	epoch         time.Time
+	next          time.Duration
+	//base is added to every timestamp, it continues the timestamps of a previous clock
+	base time.Duration
+	last time.Duration
+
+	//lastCapture is the capture time of the last video frame
+	//without wallclock timing the audio follows its own timeline from audioAnchor on, which is at audioAnchorPTS on the video clock
+	lastCapture    time.Time
+	audioStarted   bool
+	audioAnchor    time.Time
+	audioAnchorPTS time.Duration
+	audioExpected  time.Time
+	//renditionNext holds the timestamp of the next frame of every rendition that started without wallclock timing
+	renditionNext map[int]time.Duration
+}
+
+func newFrameClock(mode string, fps float64, pace bool) (*frameClock, error) {
+	switch mode {
+	case TimingWallclock, TimingFPS, TimingVUI:
+	default:
+		return nil, fmt.Errorf("unknown timing %s", mode)
+	}
+
+	if fps < 0 {
+		return nil, fmt.Errorf("fps must not be negative")
+	}
+
+	frameDuration := H264FRAMEDURATION
+	if fps > 0 {
+		frameDuration = time.Duration(float64(time.Second) / fps)
+	}
+
+	return &frameClock{
+		mode:          mode,
+		frameDuration: frameDuration,
+		pace:          pace,
+	}, nil
+}
+
+//stamp sets the presentation timestamp of the frame
+func (c *frameClock) stamp(frame *h264.Frame) {
+	if !c.started {
+		c.started = true
+		c.start = frame.Timestamp
+		c.epoch = time.Now()
+	}
+
+	if c.mode == TimingVUI {
+		if nal := frame.SPS(); nal != nil {
+			if sps, err := h264.ParseSPS(nal); err == nil && sps.FrameRate > 0 {
+				c.frameDuration = time.Duration(float64(time.Second) / sps.FrameRate)
+			}
+		}
+	}
+
+	if c.mode == TimingWallclock {
+		frame.PTS = c.base + frame.Timestamp.Sub(c.start)
+	} else {
+		frame.PTS = c.base + c.next
+		c.next += c.frameDuration
+	}
+
+	c.last = frame.PTS
+	c.lastCapture = frame.Timestamp
+}
+
+//stampAudio sets the presentation timestamp of an audio frame, audio captured before the first video frame has no picture
+//to go with and is dropped
+//with wallclock timing it is the capture time relative to the first video frame like the video
+//otherwise the video is timed by counting frames, which drifts from the capture time, so the audio is timed by its own
+//timeline of samples that is anchored to the video frame captured with it, the sender reports map both to one clock
+func (c *frameClock) stampAudio(frame *audio.Frame) bool {
+	if !c.started || frame.Timestamp.Before(c.start) {
+		return false
+	}
+
+	if c.mode == TimingWallclock {
+		frame.PTS = c.base + frame.Timestamp.Sub(c.start)
+		return true
+	}
+
+	if jump := frame.Timestamp.Sub(c.audioExpected); !c.audioStarted || jump > audioResyncThreshold || jump < -audioResyncThreshold {
+		c.audioStarted = true
+		c.audioAnchor = frame.Timestamp
+		c.audioAnchorPTS = c.last + frame.Timestamp.Sub(c.lastCapture)
+	}
+
+	frame.PTS = c.audioAnchorPTS + frame.Timestamp.Sub(c.audioAnchor)
+	c.audioExpected = frame.Timestamp.Add(frame.Duration)
+
+	return true
+}
+
+//stampRendition sets the presentation timestamp of a frame of a rendition, the renditions share the timeline of the video
+//so a viewer can switch between them
+//with wallclock timing it is the capture time like the video, otherwise the frames are counted like the video from the frame
+//of the video that was captured with the first one
+func (c *frameClock) stampRendition(index int, frame *h264.Frame) bool {
+	if !c.started || frame.Timestamp.Before(c.start) {
+		return false
+	}
+
+	if c.mode == TimingWallclock {
+		frame.PTS = c.base + frame.Timestamp.Sub(c.start)
+		return true
+	}
+
+	next, ok := c.renditionNext[index]
+	if !ok {
+		if c.renditionNext == nil {
+			c.renditionNext = make(map[int]time.Duration)
+		}
+		//the capture times differ by the jitter of the pipes, the rendition starts on the frame grid of the video
+		next = c.last + frame.Timestamp.Sub(c.lastCapture).Round(c.frameDuration)
+	}
+
+	frame.PTS = next
+	c.renditionNext[index] = next + c.frameDuration
+
+	return true
+}
+
+//resume makes the timestamps of the next frame continue one frame after the last one, with a new pacing epoch
+func (c *frameClock) resume() {
+	c.continueFrom(c)
+	c.started = false
+	c.next = 0
+	c.audioStarted = false
+	c.renditionNext = nil
+}
+
+//continueFrom makes the timestamps of this clock continue one frame after the last timestamp of previous
+func (c *frameClock) continueFrom(previous *frameClock) {
+	if !previous.started {
+		c.base = previous.base
+		return
+	}
+
+	c.base = previous.last + previous.frameDuration
+}
+
+//delay returns how long the frame has to be held before it is sent when pacing is enabled, 0 when it is due
+func (c *frameClock) delay(frame *h264.Frame) time.Duration {
+	if !c.pace {
+		return 0
+	}
+
+	if d := time.Until(c.epoch.Add(frame.PTS - c.base)); d > 0 {
+		return d
+	}
+
+	return 0
+}
+
+//rtpTimeline converts rtp timestamps to capture times
+//the first timestamp is mapped to the arrival of its packet, later ones follow the rtp clock so network jitter does not reach the frames
+type rtpTimeline struct {
+	clockRate uint32
+	started   bool
+	base      time.Time
+	previous  uint32
+	//ticks counts the rtp clock since the first timestamp, it keeps counting when the timestamp wraps around
+	ticks int64
+}
+
+func (t *rtpTimeline) time(timestamp uint32) time.Time {
+	if !t.started {
+		t.started = true
+		t.base = time.Now()
+		t.previous = timestamp
+	}
+
+	t.ticks += int64(int32(timestamp - t.previous))
+	t.previous = timestamp
+
+	rate := int64(t.clockRate)
+	if rate == 0 {
+		rate = h264.ClockRate
+	}
+
+	return t.base.Add(time.Duration(t.ticks/rate)*time.Second + time.Duration(t.ticks%rate)*time.Second/time.Duration(rate))
+}
@@ -0,0 +1,47 @@
+package stream
+
+import (
+	"ffmpeg-webrtc/pkg/h264"
+	"testing"
+	"time"
+)
+
+func TestRenditionFollowsCountedTimeline(t *testing.T) {
+	clock, err := newFrameClock(TimingFPS, 25, false)
+	if err != nil {
+		t.Fatalf("error creating clock: %v", err)
+	}
+
+	start := time.Unix(100, 0)
+	//the camera delivers a little slower than the configured frame rate, the counted timeline drifts from the capture time
+	capture := func(i int) time.Time {
+		return start.Add(time.Duration(i) * 41 * time.Millisecond)
+	}
+
+	for i := 0; i < 3; i++ {
+		clock.stamp(&h264.Frame{Timestamp: capture(i)})
+	}
+
+	//the first frame of the rendition arrived a little after the video frame it was encoded from
+	for i := 2; i < 100; i++ {
+		frame := &h264.Frame{Timestamp: capture(i).Add(3 * time.Millisecond)}
+		if !clock.stampRendition(1, frame) {
+			t.Fatalf("rendition frame %d was dropped", i)
+		}
+
+		if want := time.Duration(i) * 40 * time.Millisecond; frame.PTS != want {
+			t.Fatalf("rendition frame %d is at %v, want %v like the video", i, frame.PTS, want)
+		}
+	}
+
+	clock.resume()
+
+	//after a restart the rendition starts again from the video
+	clock.stamp(&h264.Frame{Timestamp: capture(200)})
+	frame := &h264.Frame{Timestamp: capture(200)}
+	clock.stampRendition(1, frame)
+
+	if frame.PTS != clock.last {
+		t.Errorf("rendition frame is at %v after the restart, want %v", frame.PTS, clock.last)
+	}
+}
@@ -0,0 +1,402 @@
+package stream
+
+import (
+	"ffmpeg-webrtc/pkg/logger"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	//TransportFIFO reads from a named pipe that is passed to the app as stdout
+	TransportFIFO = "fifo"
+	//TransportStdout reads from an anonymous pipe connected to stdout of the app
+	TransportStdout = "stdout"
+	//TransportUnix listens on a unix domain socket the app connects to, e.g. unix:/tmp/camera.sock
+	TransportUnix = "unix"
+	//TransportTCP listens on a local tcp socket the app connects to, e.g. tcp://127.0.0.1:9000
+	TransportTCP = "tcp"
+	//TransportUDP listens on a local udp socket the app sends to, e.g. udp://127.0.0.1:9000
+	TransportUDP = "udp"
+)
+
+var errTransportClosed = fmt.Errorf("transport closed")
+
+//transport carries the h264 written by the app to the source
+//next blocks until the next stream of data is available, a new one is returned for every connection or process
+//all reads block and return io.EOF once the writer is gone, a closed transport can be opened again
+type transport interface {
+	//open prepares the transport, it is called before the app is started
+	open() error
+	//attach connects a new command to the transport before it is started
+	attach(cmd *exec.Cmd) error
+	//started is called once the command has been started or has failed to start
+	started()
+	next() (io.ReadCloser, error)
+	close() error
+}
+
+func newTransport(kind string, pipeName string, address string) (transport, error) {
+	switch kind {
+	case "", TransportFIFO:
+		if pipeName == "" {
+			return nil, fmt.Errorf("pipe_name must not be empty")
+		}
+		return &fifoTransport{name: pipeName}, nil
+	case TransportStdout:
+		return &stdoutTransport{}, nil
+	case TransportUnix, TransportTCP:
+		if address == "" {
+			return nil, fmt.Errorf("address must not be empty for transport %s", kind)
+		}
+		return &listenerTransport{network: kind, address: address}, nil
+	case TransportUDP:
+		if address == "" {
+			return nil, fmt.Errorf("address must not be empty for transport %s", kind)
+		}
+		return &udpTransport{address: address}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %s", kind)
+	}
+}
+
+//fifoTransport is a named pipe that is opened for reading and writing, so it never reports EOF across restarts of the app
+//the pipe is removed again on close if it was created by the transport
+//every process gets a write end of its own, passing the read end to a process would put it into blocking mode
+type fifoTransport struct {
+	name    string
+	pipe    *os.File
+	writer  *os.File
+	created bool
+	once    *sync.Once
+	done    chan bool
+}
+
+func (t *fifoTransport) open() error {
+	t.once = &sync.Once{}
+	t.done = make(chan bool)
+	t.created = false
+
+	if _, err := os.Stat(t.name); os.IsNotExist(err) {
+		if err := syscall.Mkfifo(t.name, 0666); err != nil {
+			return fmt.Errorf("error creating named pipe: %v", err)
+		}
+		t.created = true
+	}
+
+	pipe, err := os.OpenFile(t.name, os.O_RDWR, os.ModeNamedPipe)
+	if err != nil {
+		return fmt.Errorf("error opening named pipe: %v", err)
+	}
+
+	//the pipe is resized through its raw connection, pipe.Fd would put it into blocking mode and close could no longer
+	//interrupt a read
+	conn, err := pipe.SyscallConn()
+	if err != nil {
+		pipe.Close()
+		return fmt.Errorf("error opening named pipe: %v", err)
+	}
+
+	var setErr, getErr error
+	var pipeSize int
+	conn.Control(func(fd uintptr) {
+		//a 1MB pipe holds a keyframe, the pipe works with the default size where it can not be resized
+		_, setErr = unix.FcntlInt(fd, syscall.F_SETPIPE_SZ, 1024*1024)
+		pipeSize, getErr = unix.FcntlInt(fd, syscall.F_GETPIPE_SZ, 0)
+	})
+
+	if setErr != nil {
+		logger.Errorf("error setting the size of named pipe %v, using the default size: %v\n", t.name, setErr)
+	}
+
+	if getErr == nil {
+		logger.Infof("created named pipe with name %v and size %v\n", t.name, pipeSize)
+	} else {
+		logger.Infof("created named pipe with name %v\n", t.name)
+	}
+
+	t.pipe = pipe
+
+	return nil
+}
+
+func (t *fifoTransport) attach(cmd *exec.Cmd) error {
+	//the pipe is open for reading, so opening the write end does not block
+	writer, err := os.OpenFile(t.name, os.O_WRONLY, os.ModeNamedPipe)
+	if err != nil {
+		return fmt.Errorf("error opening named pipe for writing: %v", err)
+	}
+
+	cmd.Stdout = writer
+	t.writer = writer
+
+	return nil
+}
+
+func (t *fifoTransport) started() {
+	if t.writer != nil {
+		t.writer.Close()
+		t.writer = nil
+	}
+}
+
+func (t *fifoTransport) next() (io.ReadCloser, error) {
+	var reader io.ReadCloser
+
+	t.once.Do(func() {
+		reader = t.pipe
+	})
+
+	if reader != nil {
+		return reader, nil
+	}
+
+	<-t.done
+	return nil, errTransportClosed
+}
+
+func (t *fifoTransport) close() error {
+	if t.pipe == nil {
+		return nil
+	}
+
+	close(t.done)
+
+	err := t.pipe.Close()
+	t.pipe = nil
+	if err != nil {
+		return fmt.Errorf("error closing pipe: %v", err)
+	}
+
+	if t.created {
+		os.Remove(t.name)
+	}
+
+	return nil
+}
+
+//stdoutTransport creates a new pipe for every process, the write end is closed in the parent once the process
+//has started so the reader sees EOF when the process exits
+type stdoutTransport struct {
+	readers chan *os.File
+	writer  *os.File
+	//mu guards done and closed, the reader calls next while the transport is closed or opened again
+	mu     sync.Mutex
+	done   chan bool
+	closed bool
+}
+
+func (t *stdoutTransport) open() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.readers = make(chan *os.File, 1)
+	t.done = make(chan bool)
+	t.closed = false
+
+	return nil
+}
+
+//channels returns the channels of the current opening of the transport
+func (t *stdoutTransport) channels() (chan *os.File, chan bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.readers, t.done
+}
+
+func (t *stdoutTransport) attach(cmd *exec.Cmd) error {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("error creating stdout pipe: %v", err)
+	}
+
+	cmd.Stdout = writer
+	t.writer = writer
+
+	readers, done := t.channels()
+
+	select {
+	case readers <- reader:
+	case <-done:
+		reader.Close()
+		writer.Close()
+		t.writer = nil
+		return errTransportClosed
+	}
+
+	return nil
+}
+
+func (t *stdoutTransport) started() {
+	if t.writer != nil {
+		t.writer.Close()
+		t.writer = nil
+	}
+}
+
+func (t *stdoutTransport) next() (io.ReadCloser, error) {
+	readers, done := t.channels()
+
+	select {
+	case <-done:
+		return nil, errTransportClosed
+	default:
+	}
+
+	select {
+	case reader := <-readers:
+		return reader, nil
+	case <-done:
+		return nil, errTransportClosed
+	}
+}
+
+//close closes done once, a pipe that was never read is closed with it
+func (t *stdoutTransport) close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.done == nil || t.closed {
+		return nil
+	}
+
+	close(t.done)
+	t.closed = true
+
+	select {
+	case reader := <-t.readers:
+		reader.Close()
+	default:
+	}
+
+	return nil
+}
+
+//listenerTransport accepts a connection from the app over a unix domain or tcp socket
+type listenerTransport struct {
+	network  string
+	address  string
+	listener net.Listener
+}
+
+func (t *listenerTransport) open() error {
+	if t.network == TransportUnix {
+		//remove a socket left behind by a previous run
+		os.Remove(t.address)
+	}
+
+	listener, err := net.Listen(t.network, t.address)
+	if err != nil {
+		return fmt.Errorf("error listening on %v %v: %v", t.network, t.address, err)
+	}
+
+	logger.Infof("listening for %v connections on %v\n", t.network, listener.Addr())
+
+	t.listener = listener
+
+	return nil
+}
+
+func (t *listenerTransport) attach(cmd *exec.Cmd) error {
+	return nil
+}
+
+func (t *listenerTransport) started() {}
+
+func (t *listenerTransport) next() (io.ReadCloser, error) {
+	conn, err := t.listener.Accept()
+	if err != nil {
+		return nil, errTransportClosed
+	}
+
+	return conn, nil
+}
+
+func (t *listenerTransport) close() error {
+	if t.listener == nil {
+		return nil
+	}
+
+	err := t.listener.Close()
+	t.listener = nil
+
+	return err
+}
+
+//udpTransport receives datagrams on a local udp socket, datagrams from all processes form one continuous stream
+//a multicast address joins the group on the default interface
+type udpTransport struct {
+	address string
+	conn    *net.UDPConn
+	once    *sync.Once
+	done    chan bool
+}
+
+func (t *udpTransport) open() error {
+	addr, err := net.ResolveUDPAddr("udp", t.address)
+	if err != nil {
+		return fmt.Errorf("error resolving udp address %v: %v", t.address, err)
+	}
+
+	var conn *net.UDPConn
+	if addr.IP != nil && addr.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp", nil, addr)
+	} else {
+		conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("error listening on udp %v: %v", t.address, err)
+	}
+
+	//a large receive buffer prevents drops when a big keyframe arrives in a burst
+	conn.SetReadBuffer(4 * 1024 * 1024)
+
+	logger.Infof("listening for udp datagrams on %v\n", conn.LocalAddr())
+
+	t.conn = conn
+	t.once = &sync.Once{}
+	t.done = make(chan bool)
+
+	return nil
+}
+
+func (t *udpTransport) attach(cmd *exec.Cmd) error {
+	return nil
+}
+
+func (t *udpTransport) started() {}
+
+func (t *udpTransport) next() (io.ReadCloser, error) {
+	var reader io.ReadCloser
+
+	t.once.Do(func() {
+		reader = t.conn
+	})
+
+	if reader != nil {
+		return reader, nil
+	}
+
+	<-t.done
+	return nil, errTransportClosed
+}
+
+func (t *udpTransport) close() error {
+	if t.conn == nil {
+		return nil
+	}
+
+	close(t.done)
+
+	err := t.conn.Close()
+	t.conn = nil
+
+	return err
+}
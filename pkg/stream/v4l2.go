@@ -0,0 +1,188 @@
+package stream
+
+import (
+	"ffmpeg-webrtc/pkg/h264"
+	"ffmpeg-webrtc/pkg/logger"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	v4l2Buffers     = 4
+	v4l2PollTimeout = 500 * time.Millisecond
+)
+
+//CapturedFrame is one buffer dequeued from a capture device, Data is only valid until the next read
+type CapturedFrame struct {
+	Data      []byte
+	Keyframe  bool
+	Timestamp time.Time
+}
+
+//captureDevice is the part of a v4l2 device the source uses, it can be replaced by a fake device in tests
+//ReadFrame returns errNoFrame when no frame arrived within the timeout
+type captureDevice interface {
+	Open() error
+	SetFormat(width, height int, pixelFormat uint32) (int, int, error)
+	SetFrameRate(fps float64) (float64, error)
+	StartStreaming(buffers int) error
+	ReadFrame(timeout time.Duration) (CapturedFrame, error)
+	Close() error
+}
+
+//v4l2Source captures h264 directly from a uvc camera without ffmpeg
+//every buffer holds one access unit which is timestamped with the capture time reported by the kernel
+type v4l2Source struct {
+	width  int
+	height int
+	fps    float64
+	device captureDevice
+	frames chan *h264.Frame
+	done   chan bool
+	exited chan bool
+	state  string
+	mu     sync.Mutex
+}
+
+func newV4L2Source(c *StreamConfig) (*v4l2Source, error) {
+	if c.Device == "" {
+		return nil, fmt.Errorf("device must not be empty")
+	}
+
+	return newV4L2SourceWithDevice(newV4L2Device(c.Device), c.Width, c.Height, c.FPS), nil
+}
+
+func newV4L2SourceWithDevice(device captureDevice, width, height int, fps float64) *v4l2Source {
+	return &v4l2Source{
+		width:  width,
+		height: height,
+		fps:    fps,
+		device: device,
+		frames: make(chan *h264.Frame, 240),
+		state:  StateStopped,
+	}
+}
+
+func (v *v4l2Source) Start() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if err := v.open(); err != nil {
+		v.device.Close()
+		v.state = StateFailed
+		return err
+	}
+
+	v.done = make(chan bool)
+	v.exited = make(chan bool)
+	v.state = StateRunning
+
+	go v.capture(v.done, v.exited)
+
+	return nil
+}
+
+//open negotiates h264 at the configured resolution and frame rate and starts streaming
+func (v *v4l2Source) open() error {
+	if err := v.device.Open(); err != nil {
+		return err
+	}
+
+	width, height, err := v.device.SetFormat(v.width, v.height, V4L2PixFmtH264)
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("capturing h264 at %vx%v\n", width, height)
+
+	if v.fps > 0 {
+		fps, err := v.device.SetFrameRate(v.fps)
+		if err != nil {
+			return err
+		}
+
+		logger.Infof("capturing at %v fps\n", fps)
+	}
+
+	return v.device.StartStreaming(v4l2Buffers)
+}
+
+func (v *v4l2Source) Stop() error {
+	v.mu.Lock()
+	done, exited := v.done, v.exited
+	v.done = nil
+	v.mu.Unlock()
+
+	if done == nil {
+		return nil
+	}
+
+	close(done)
+	<-exited
+
+	v.mu.Lock()
+	v.state = StateStopped
+	v.mu.Unlock()
+
+	return v.device.Close()
+}
+
+func (v *v4l2Source) Frames() <-chan *h264.Frame {
+	return v.frames
+}
+
+func (v *v4l2Source) Info() SourceInfo {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return SourceInfo{
+		Kind:     SourceTypeV4L2,
+		Codec:    "h264",
+		Live:     true,
+		Realtime: true,
+		State:    v.state,
+	}
+}
+
+//capture reads buffers until the source is stopped, a failing device leaves the source in the failed state
+func (v *v4l2Source) capture(done chan bool, exited chan bool) {
+	defer close(exited)
+
+	parser := h264.NewParser()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		captured, err := v.device.ReadFrame(v4l2PollTimeout)
+		if err == errNoFrame {
+			continue
+		}
+
+		if err != nil {
+			logger.Errorf("error capturing frame: %v\n", err)
+			v.mu.Lock()
+			v.state = StateFailed
+			v.mu.Unlock()
+			return
+		}
+
+		emit := func(frame *h264.Frame) {
+			frame.Timestamp = captured.Timestamp
+			frame.Keyframe = frame.Keyframe || captured.Keyframe
+
+			select {
+			case v.frames <- frame:
+			case <-done:
+			}
+		}
+
+		//a buffer holds a complete access unit, flushing emits it right away
+		parser.Write(captured.Data, emit)
+		parser.Flush(emit)
+	}
+}
@@ -0,0 +1,338 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+//the v4l2 structs and ioctls used by the device, the layouts match linux/videodev2.h on 64 bit systems
+const (
+	v4l2BufTypeVideoCapture  = 1
+	v4l2MemoryMmap           = 1
+	v4l2FieldAny             = 0
+	v4l2CapVideoCapture      = 0x00000001
+	v4l2CapStreaming         = 0x04000000
+	v4l2CapTimePerFrame      = 0x1000
+	v4l2BufFlagKeyframe      = 0x00000008
+	v4l2BufFlagMonotonic     = 0x00002000
+	v4l2BufFlagTimestampMask = 0x0000e000
+
+	//V4L2PixFmtH264 is the fourcc H264
+	V4L2PixFmtH264 = 'H' | '2'<<8 | '6'<<16 | '4'<<24
+)
+
+type v4l2Capability struct {
+	Driver       [16]uint8
+	Card         [32]uint8
+	BusInfo      [32]uint8
+	Version      uint32
+	Capabilities uint32
+	DeviceCaps   uint32
+	Reserved     [3]uint32
+}
+
+type v4l2PixFormat struct {
+	Width        uint32
+	Height       uint32
+	PixelFormat  uint32
+	Field        uint32
+	BytesPerLine uint32
+	SizeImage    uint32
+	Colorspace   uint32
+	Priv         uint32
+	Flags        uint32
+	YcbcrEnc     uint32
+	Quantization uint32
+	XferFunc     uint32
+}
+
+//v4l2Format holds the pix member of the format union, the union is 8 byte aligned and 200 bytes long
+type v4l2Format struct {
+	Type uint32
+	_    uint32
+	Pix  v4l2PixFormat
+	_    [200 - unsafe.Sizeof(v4l2PixFormat{})]uint8
+}
+
+type v4l2Fract struct {
+	Numerator   uint32
+	Denominator uint32
+}
+
+type v4l2CaptureParm struct {
+	Capability   uint32
+	CaptureMode  uint32
+	TimePerFrame v4l2Fract
+	ExtendedMode uint32
+	ReadBuffers  uint32
+	Reserved     [4]uint32
+}
+
+type v4l2StreamParm struct {
+	Type    uint32
+	Capture v4l2CaptureParm
+	_       [200 - unsafe.Sizeof(v4l2CaptureParm{})]uint8
+}
+
+type v4l2RequestBuffers struct {
+	Count        uint32
+	Type         uint32
+	Memory       uint32
+	Capabilities uint32
+	Flags        uint8
+	Reserved     [3]uint8
+}
+
+type v4l2Timecode struct {
+	Type     uint32
+	Flags    uint32
+	Frames   uint8
+	Seconds  uint8
+	Minutes  uint8
+	Hours    uint8
+	Userbits [4]uint8
+}
+
+//v4l2Buffer holds the offset member of the m union
+type v4l2Buffer struct {
+	Index     uint32
+	Type      uint32
+	BytesUsed uint32
+	Flags     uint32
+	Field     uint32
+	Timestamp unix.Timeval
+	Timecode  v4l2Timecode
+	Sequence  uint32
+	Memory    uint32
+	Offset    uint64
+	Length    uint32
+	Reserved2 uint32
+	RequestFD int32
+}
+
+func ioc(dir, nr, size uintptr) uintptr {
+	return dir<<30 | size<<16 | 'V'<<8 | nr
+}
+
+var (
+	vidiocQueryCap  = ioc(2, 0, unsafe.Sizeof(v4l2Capability{}))
+	vidiocSFmt      = ioc(3, 5, unsafe.Sizeof(v4l2Format{}))
+	vidiocReqBufs   = ioc(3, 8, unsafe.Sizeof(v4l2RequestBuffers{}))
+	vidiocQueryBuf  = ioc(3, 9, unsafe.Sizeof(v4l2Buffer{}))
+	vidiocQBuf      = ioc(3, 15, unsafe.Sizeof(v4l2Buffer{}))
+	vidiocDQBuf     = ioc(3, 17, unsafe.Sizeof(v4l2Buffer{}))
+	vidiocStreamOn  = ioc(1, 18, unsafe.Sizeof(int32(0)))
+	vidiocStreamOff = ioc(1, 19, unsafe.Sizeof(int32(0)))
+	vidiocGParm     = ioc(3, 21, unsafe.Sizeof(v4l2StreamParm{}))
+	vidiocSParm     = ioc(3, 22, unsafe.Sizeof(v4l2StreamParm{}))
+)
+
+//errNoFrame is returned by ReadFrame when no frame arrived within the poll timeout
+var errNoFrame = errors.New("no frame available")
+
+//v4l2Device is a video capture device opened through the kernel v4l2 api, buffers are mmapped
+type v4l2Device struct {
+	path    string
+	fd      int
+	buffers [][]byte
+	index   int
+	queued  bool
+}
+
+func newV4L2Device(path string) *v4l2Device {
+	return &v4l2Device{path: path, fd: -1, index: -1}
+}
+
+func (d *v4l2Device) Open() error {
+	fd, err := unix.Open(d.path, unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("error opening %v: %v", d.path, err)
+	}
+	d.fd = fd
+
+	var capability v4l2Capability
+	if err := d.ioctl(vidiocQueryCap, unsafe.Pointer(&capability)); err != nil {
+		d.Close()
+		return fmt.Errorf("error querying capabilities of %v: %v", d.path, err)
+	}
+
+	caps := capability.Capabilities
+	if capability.DeviceCaps != 0 {
+		caps = capability.DeviceCaps
+	}
+
+	if caps&v4l2CapVideoCapture == 0 || caps&v4l2CapStreaming == 0 {
+		d.Close()
+		return fmt.Errorf("%v does not support video capture streaming", d.path)
+	}
+
+	return nil
+}
+
+func (d *v4l2Device) SetFormat(width, height int, pixelFormat uint32) (int, int, error) {
+	format := v4l2Format{Type: v4l2BufTypeVideoCapture}
+	format.Pix.Width = uint32(width)
+	format.Pix.Height = uint32(height)
+	format.Pix.PixelFormat = pixelFormat
+	format.Pix.Field = v4l2FieldAny
+
+	if err := d.ioctl(vidiocSFmt, unsafe.Pointer(&format)); err != nil {
+		return 0, 0, fmt.Errorf("error setting format: %v", err)
+	}
+
+	//the driver changes the format to the closest one it supports
+	if format.Pix.PixelFormat != pixelFormat {
+		return 0, 0, fmt.Errorf("%v does not support the requested pixel format", d.path)
+	}
+
+	return int(format.Pix.Width), int(format.Pix.Height), nil
+}
+
+func (d *v4l2Device) SetFrameRate(fps float64) (float64, error) {
+	parm := v4l2StreamParm{Type: v4l2BufTypeVideoCapture}
+	if err := d.ioctl(vidiocGParm, unsafe.Pointer(&parm)); err != nil {
+		return 0, fmt.Errorf("error getting stream parameters: %v", err)
+	}
+
+	if parm.Capture.Capability&v4l2CapTimePerFrame != 0 {
+		parm.Capture.TimePerFrame = v4l2Fract{Numerator: 1000, Denominator: uint32(fps * 1000)}
+		if err := d.ioctl(vidiocSParm, unsafe.Pointer(&parm)); err != nil {
+			return 0, fmt.Errorf("error setting frame rate: %v", err)
+		}
+	}
+
+	if parm.Capture.TimePerFrame.Numerator == 0 {
+		return 0, nil
+	}
+
+	return float64(parm.Capture.TimePerFrame.Denominator) / float64(parm.Capture.TimePerFrame.Numerator), nil
+}
+
+func (d *v4l2Device) StartStreaming(count int) error {
+	request := v4l2RequestBuffers{Count: uint32(count), Type: v4l2BufTypeVideoCapture, Memory: v4l2MemoryMmap}
+	if err := d.ioctl(vidiocReqBufs, unsafe.Pointer(&request)); err != nil {
+		return fmt.Errorf("error requesting buffers: %v", err)
+	}
+
+	if request.Count == 0 {
+		return fmt.Errorf("%v did not allocate any buffers", d.path)
+	}
+
+	for i := uint32(0); i < request.Count; i++ {
+		buffer := v4l2Buffer{Index: i, Type: v4l2BufTypeVideoCapture, Memory: v4l2MemoryMmap}
+		if err := d.ioctl(vidiocQueryBuf, unsafe.Pointer(&buffer)); err != nil {
+			return fmt.Errorf("error querying buffer %v: %v", i, err)
+		}
+
+		data, err := unix.Mmap(d.fd, int64(buffer.Offset), int(buffer.Length), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+		if err != nil {
+			return fmt.Errorf("error mapping buffer %v: %v", i, err)
+		}
+		d.buffers = append(d.buffers, data)
+
+		if err := d.ioctl(vidiocQBuf, unsafe.Pointer(&buffer)); err != nil {
+			return fmt.Errorf("error queueing buffer %v: %v", i, err)
+		}
+	}
+
+	bufType := int32(v4l2BufTypeVideoCapture)
+	if err := d.ioctl(vidiocStreamOn, unsafe.Pointer(&bufType)); err != nil {
+		return fmt.Errorf("error starting stream: %v", err)
+	}
+
+	return nil
+}
+
+//ReadFrame waits up to timeout for the next buffer, the returned data is only valid until the next call
+func (d *v4l2Device) ReadFrame(timeout time.Duration) (CapturedFrame, error) {
+	//hand the previous buffer back to the driver
+	if d.index >= 0 {
+		buffer := v4l2Buffer{Index: uint32(d.index), Type: v4l2BufTypeVideoCapture, Memory: v4l2MemoryMmap}
+		if err := d.ioctl(vidiocQBuf, unsafe.Pointer(&buffer)); err != nil {
+			return CapturedFrame{}, fmt.Errorf("error queueing buffer: %v", err)
+		}
+		d.index = -1
+	}
+
+	fds := []unix.PollFd{{Fd: int32(d.fd), Events: unix.POLLIN}}
+	n, err := unix.Poll(fds, int(timeout/time.Millisecond))
+	if err != nil && err != unix.EINTR {
+		return CapturedFrame{}, fmt.Errorf("error polling device: %v", err)
+	}
+
+	if n == 0 || err == unix.EINTR {
+		return CapturedFrame{}, errNoFrame
+	}
+
+	buffer := v4l2Buffer{Type: v4l2BufTypeVideoCapture, Memory: v4l2MemoryMmap}
+	if err := d.ioctl(vidiocDQBuf, unsafe.Pointer(&buffer)); err != nil {
+		if err == unix.EAGAIN {
+			return CapturedFrame{}, errNoFrame
+		}
+		return CapturedFrame{}, fmt.Errorf("error dequeueing buffer: %v", err)
+	}
+	d.index = int(buffer.Index)
+
+	return CapturedFrame{
+		Data:      d.buffers[buffer.Index][:buffer.BytesUsed],
+		Keyframe:  buffer.Flags&v4l2BufFlagKeyframe != 0,
+		Timestamp: kernelTime(buffer.Timestamp, buffer.Flags),
+	}, nil
+}
+
+func (d *v4l2Device) Close() error {
+	if d.fd < 0 {
+		return nil
+	}
+
+	bufType := int32(v4l2BufTypeVideoCapture)
+	d.ioctl(vidiocStreamOff, unsafe.Pointer(&bufType))
+
+	for _, buffer := range d.buffers {
+		unix.Munmap(buffer)
+	}
+	d.buffers = nil
+	d.index = -1
+
+	err := unix.Close(d.fd)
+	d.fd = -1
+
+	return err
+}
+
+func (d *v4l2Device) ioctl(request uintptr, arg unsafe.Pointer) error {
+	for {
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(d.fd), request, uintptr(arg))
+		if errno == unix.EINTR {
+			continue
+		}
+
+		if errno != 0 {
+			return errno
+		}
+
+		return nil
+	}
+}
+
+//kernelTime converts a buffer timestamp to wall clock time, most drivers use the monotonic clock
+func kernelTime(timestamp unix.Timeval, flags uint32) time.Time {
+	captured := time.Unix(timestamp.Unix())
+
+	if flags&v4l2BufFlagTimestampMask != v4l2BufFlagMonotonic {
+		return captured
+	}
+
+	var now unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &now); err != nil {
+		return time.Now()
+	}
+
+	age := time.Duration(now.Nano()) - time.Duration(timestamp.Nano())
+
+	return time.Now().Add(-age)
+}
@@ -0,0 +1,259 @@
+package stream
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+//fakeDevice is a capture device that supports maxWidth x maxHeight at maxFPS and returns the scripted reads in order
+//once the reads are used up it reports that no frame arrived
+type fakeDevice struct {
+	maxWidth  int
+	maxHeight int
+	maxFPS    float64
+	reads     []fakeRead
+	mu        sync.Mutex
+	//width, height, pixelFormat, fps and buffers are what the source asked for
+	width       int
+	height      int
+	pixelFormat uint32
+	fps         float64
+	buffers     int
+	noFrames    int
+	closed      bool
+}
+
+type fakeRead struct {
+	frame CapturedFrame
+	err   error
+}
+
+func (d *fakeDevice) Open() error {
+	return nil
+}
+
+func (d *fakeDevice) SetFormat(width, height int, pixelFormat uint32) (int, int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if pixelFormat != V4L2PixFmtH264 {
+		return 0, 0, errors.New("pixel format not supported")
+	}
+	d.width, d.height, d.pixelFormat = width, height, pixelFormat
+
+	if width > d.maxWidth || height > d.maxHeight {
+		width, height = d.maxWidth, d.maxHeight
+	}
+
+	return width, height, nil
+}
+
+func (d *fakeDevice) SetFrameRate(fps float64) (float64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.fps = fps
+	if fps > d.maxFPS {
+		return d.maxFPS, nil
+	}
+
+	return fps, nil
+}
+
+func (d *fakeDevice) StartStreaming(buffers int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.buffers = buffers
+
+	return nil
+}
+
+func (d *fakeDevice) ReadFrame(timeout time.Duration) (CapturedFrame, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.reads) == 0 {
+		d.noFrames++
+		time.Sleep(time.Millisecond)
+		return CapturedFrame{}, errNoFrame
+	}
+
+	read := d.reads[0]
+	d.reads = d.reads[1:]
+
+	if read.err == errNoFrame {
+		d.noFrames++
+	}
+
+	return read.frame, read.err
+}
+
+func (d *fakeDevice) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.closed = true
+
+	return nil
+}
+
+func TestV4L2Negotiation(t *testing.T) {
+	device := &fakeDevice{maxWidth: 1280, maxHeight: 720, maxFPS: 30}
+	source := newV4L2SourceWithDevice(device, 1920, 1080, 60)
+
+	if err := source.Start(); err != nil {
+		t.Fatalf("error starting source: %v", err)
+	}
+
+	if state := source.Info().State; state != StateRunning {
+		t.Errorf("state is %v, want %v", state, StateRunning)
+	}
+
+	source.Stop()
+
+	device.mu.Lock()
+	defer device.mu.Unlock()
+
+	if device.width != 1920 || device.height != 1080 || device.pixelFormat != V4L2PixFmtH264 {
+		t.Errorf("source asked for %dx%d in format %x, want 1920x1080 h264", device.width, device.height, device.pixelFormat)
+	}
+
+	if device.fps != 60 || device.buffers != v4l2Buffers {
+		t.Errorf("source asked for %v fps with %d buffers, want 60 fps with %d", device.fps, device.buffers, v4l2Buffers)
+	}
+
+	if !device.closed {
+		t.Errorf("device is still open after stop")
+	}
+}
+
+func TestV4L2NegotiationWithoutFrameRate(t *testing.T) {
+	device := &fakeDevice{maxWidth: 1280, maxHeight: 720, maxFPS: 30}
+	source := newV4L2SourceWithDevice(device, 640, 480, 0)
+
+	if err := source.Start(); err != nil {
+		t.Fatalf("error starting source: %v", err)
+	}
+	source.Stop()
+
+	//the device keeps its own frame rate
+	if device.fps != 0 {
+		t.Errorf("source asked for %v fps without a configured frame rate", device.fps)
+	}
+}
+
+func TestV4L2Frames(t *testing.T) {
+	first := time.Unix(100, 0)
+	second := first.Add(33 * time.Millisecond)
+
+	device := &fakeDevice{
+		maxWidth:  1280,
+		maxHeight: 720,
+		maxFPS:    30,
+		reads: []fakeRead{
+			{err: errNoFrame},
+			{frame: CapturedFrame{Data: []byte{0, 0, 0, 1, 0x65, 0x88, 0x80, 0x40}, Timestamp: first}},
+			{err: errNoFrame},
+			{err: errNoFrame},
+			//a device may flag a keyframe the slice types do not show, such as a recovery point
+			{frame: CapturedFrame{Data: []byte{0, 0, 0, 1, 0x41, 0x9a, 0x80, 0x40}, Keyframe: true, Timestamp: second}},
+			{frame: CapturedFrame{Data: []byte{0, 0, 1, 0x41, 0x9a, 0x80, 0x41}, Timestamp: second.Add(33 * time.Millisecond)}},
+		},
+	}
+	source := newV4L2SourceWithDevice(device, 1280, 720, 30)
+
+	if err := source.Start(); err != nil {
+		t.Fatalf("error starting source: %v", err)
+	}
+	defer source.Stop()
+
+	want := []struct {
+		keyframe  bool
+		timestamp time.Time
+	}{
+		{true, first},
+		{true, second},
+		{false, second.Add(33 * time.Millisecond)},
+	}
+
+	for i, w := range want {
+		select {
+		case frame := <-source.Frames():
+			if frame.Keyframe != w.keyframe || !frame.Timestamp.Equal(w.timestamp) {
+				t.Errorf("frame %d is keyframe %v at %v, want keyframe %v at %v", i, frame.Keyframe, frame.Timestamp, w.keyframe, w.timestamp)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("got %d of %d frames", i, len(want))
+		}
+	}
+
+	//reads without a frame keep the source running
+	if state := source.Info().State; state != StateRunning {
+		t.Errorf("state is %v, want %v", state, StateRunning)
+	}
+
+	device.mu.Lock()
+	noFrames := device.noFrames
+	device.mu.Unlock()
+
+	if noFrames < 3 {
+		t.Errorf("device reported %d reads without a frame, want at least 3", noFrames)
+	}
+}
+
+func TestV4L2DeviceFailure(t *testing.T) {
+	device := &fakeDevice{
+		maxWidth:  1280,
+		maxHeight: 720,
+		maxFPS:    30,
+		reads: []fakeRead{
+			{frame: CapturedFrame{Data: []byte{0, 0, 0, 1, 0x65, 0x88, 0x80, 0x40}, Timestamp: time.Now()}},
+			{err: errors.New("device unplugged")},
+		},
+	}
+	source := newV4L2SourceWithDevice(device, 1280, 720, 30)
+
+	if err := source.Start(); err != nil {
+		t.Fatalf("error starting source: %v", err)
+	}
+	defer source.Stop()
+
+	<-source.Frames()
+
+	deadline := time.Now().Add(time.Second)
+	for source.Info().State != StateFailed {
+		if time.Now().After(deadline) {
+			t.Fatalf("state is %v after the device failed, want %v", source.Info().State, StateFailed)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestV4L2UnsupportedFormat(t *testing.T) {
+	device := &fakeDevice{}
+	source := newV4L2SourceWithDevice(&unsupportedDevice{device}, 1280, 720, 30)
+
+	if err := source.Start(); err == nil {
+		t.Fatalf("source started on a device without h264")
+	}
+
+	if state := source.Info().State; state != StateFailed {
+		t.Errorf("state is %v, want %v", state, StateFailed)
+	}
+
+	if !device.closed {
+		t.Errorf("device is still open after the failed start")
+	}
+}
+
+//unsupportedDevice is a device that can not capture h264
+type unsupportedDevice struct {
+	*fakeDevice
+}
+
+func (d *unsupportedDevice) SetFormat(width, height int, pixelFormat uint32) (int, int, error) {
+	return 0, 0, errors.New("pixel format not supported")
+}
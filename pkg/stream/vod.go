@@ -0,0 +1,423 @@
+package stream
+
+import (
+	"ffmpeg-webrtc/pkg/h264"
+	"ffmpeg-webrtc/pkg/logger"
+	wbrtc "ffmpeg-webrtc/pkg/webrtc"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+//playbackSource is implemented by sources that give every viewer its own playback
+//join and leave are called with the room locked, they must not call back into the room
+type playbackSource interface {
+	join(room *wbrtc.Room, clientID string)
+	leave(clientID string)
+	control(clientID string, m wbrtc.Message)
+}
+
+//vodSource plays a raw annex b h264 file to every viewer separately
+//viewers can pause, resume and seek, a seek starts at the keyframe nearest to the requested position
+type vodSource struct {
+	path     string
+	loop     bool
+	index    *vodIndex
+	sessions map[string]*vodSession
+	state    string
+	mu       sync.Mutex
+}
+
+//vodIndex lists the keyframes of a file, frames is the number of frames in the file
+//sps and pps are the first parameter sets of the file, they are added to keyframes that do not carry them
+type vodIndex struct {
+	keyframes     []vodKeyframe
+	frames        int
+	frameDuration time.Duration
+	sps           []byte
+	pps           []byte
+}
+
+//vodKeyframe is the number of a keyframe in the file and the offset of its access unit
+type vodKeyframe struct {
+	frame  int
+	offset int64
+}
+
+func newVODSource(c *StreamConfig) (*vodSource, error) {
+	if c.File == "" {
+		return nil, fmt.Errorf("file must not be empty")
+	}
+
+	index, err := buildVODIndex(c.File, c.FPS)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Infof("indexed %v: %v frames, %v keyframes\n", c.File, index.frames, len(index.keyframes))
+
+	return &vodSource{
+		path:     c.File,
+		loop:     c.Loop,
+		index:    index,
+		sessions: make(map[string]*vodSession),
+		state:    StateStopped,
+	}, nil
+}
+
+//buildVODIndex reads the whole file once to find its keyframes
+//the frame duration is taken from fps if it is set, otherwise from the vui of the sps
+func buildVODIndex(path string, fps float64) (*vodIndex, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+
+	index := &vodIndex{}
+	var vuiRate float64
+
+	emit := func(frame *h264.Frame) {
+		if frame.Keyframe {
+			index.keyframes = append(index.keyframes, vodKeyframe{frame: index.frames, offset: frame.Offset})
+
+			if sps, pps := frame.SPS(), frame.PPS(); sps != nil && pps != nil && index.sps == nil {
+				index.sps = sps
+				index.pps = pps
+
+				if info, err := h264.ParseSPS(sps); err == nil {
+					vuiRate = info.FrameRate
+				}
+			}
+		}
+
+		index.frames++
+	}
+
+	parser := h264.NewParser()
+	buf := make([]byte, 64*1024)
+
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			parser.Write(buf[:n], emit)
+		}
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("error reading file %v: %v", path, err)
+		}
+	}
+	parser.Flush(emit)
+
+	if len(index.keyframes) == 0 {
+		return nil, fmt.Errorf("no keyframe found in %v", path)
+	}
+
+	switch {
+	case fps > 0:
+		index.frameDuration = time.Duration(float64(time.Second) / fps)
+	case vuiRate > 0:
+		index.frameDuration = time.Duration(float64(time.Second) / vuiRate)
+	default:
+		index.frameDuration = H264FRAMEDURATION
+	}
+
+	return index, nil
+}
+
+//nearest returns the keyframe closest to a position
+func (i *vodIndex) nearest(position time.Duration) vodKeyframe {
+	target := int(position / i.frameDuration)
+
+	distance := func(k vodKeyframe) int {
+		if k.frame > target {
+			return k.frame - target
+		}
+		return target - k.frame
+	}
+
+	best := i.keyframes[0]
+	for _, keyframe := range i.keyframes[1:] {
+		if distance(keyframe) < distance(best) {
+			best = keyframe
+		}
+	}
+
+	return best
+}
+
+func (v *vodSource) Start() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.state = StateRunning
+
+	return nil
+}
+
+//Stop ends the playback of all viewers
+func (v *vodSource) Stop() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for id, session := range v.sessions {
+		close(session.done)
+		delete(v.sessions, id)
+	}
+
+	v.state = StateStopped
+
+	return nil
+}
+
+//Frames returns nil, every viewer gets its frames from its own session
+func (v *vodSource) Frames() <-chan *h264.Frame {
+	return nil
+}
+
+func (v *vodSource) Info() SourceInfo {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return SourceInfo{
+		Kind:     SourceTypeFile,
+		Codec:    "h264",
+		Live:     false,
+		Realtime: true,
+		State:    v.state,
+	}
+}
+
+func (v *vodSource) join(room *wbrtc.Room, clientID string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if _, exists := v.sessions[clientID]; exists {
+		return
+	}
+
+	session := &vodSession{
+		clientID: clientID,
+		source:   v,
+		room:     room,
+		commands: make(chan wbrtc.Message, 4),
+		done:     make(chan bool),
+	}
+	v.sessions[clientID] = session
+
+	go session.run()
+}
+
+func (v *vodSource) leave(clientID string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if session, exists := v.sessions[clientID]; exists {
+		close(session.done)
+		delete(v.sessions, clientID)
+	}
+}
+
+func (v *vodSource) control(clientID string, m wbrtc.Message) {
+	v.mu.Lock()
+	session, exists := v.sessions[clientID]
+	v.mu.Unlock()
+
+	if !exists {
+		return
+	}
+
+	select {
+	case session.commands <- m:
+	case <-session.done:
+	}
+}
+
+//vodSession is the playback of one viewer
+//the timestamps keep counting across pauses and seeks so the viewer sees one continuous rtp stream
+type vodSession struct {
+	clientID string
+	source   *vodSource
+	room     *wbrtc.Room
+	commands chan wbrtc.Message
+	done     chan bool
+}
+
+//playbackReportInterval is how often the playback position is sent to the viewer
+const playbackReportInterval = time.Second
+
+func (s *vodSession) run() {
+	file, err := os.Open(s.source.path)
+	if err != nil {
+		logger.Errorf("error opening file: %v\n", err)
+		return
+	}
+	defer file.Close()
+
+	index := s.source.index
+	buf := make([]byte, 64*1024)
+
+	var (
+		parser  *h264.Parser
+		pending []*h264.Frame
+		//frame is the number of the next frame in the file, pts is the timestamp it is sent with
+		frame      int
+		pts        time.Duration
+		epoch      time.Time
+		paused     bool
+		ended      bool
+		lastReport time.Time
+	)
+
+	emit := func(f *h264.Frame) {
+		pending = append(pending, f)
+	}
+
+	seek := func(keyframe vodKeyframe) error {
+		if _, err := file.Seek(keyframe.offset, io.SeekStart); err != nil {
+			return fmt.Errorf("error seeking in file %v: %v", s.source.path, err)
+		}
+
+		parser = h264.NewParser()
+		pending = nil
+		frame = keyframe.frame
+		epoch = time.Now().Add(-pts)
+
+		return nil
+	}
+
+	report := func() {
+		lastReport = time.Now()
+
+		s.room.SendMessage(s.clientID, wbrtc.Message{
+			Kind:     wbrtc.PLAYBACK,
+			Position: (time.Duration(frame) * index.frameDuration).Seconds(),
+			Duration: (time.Duration(index.frames) * index.frameDuration).Seconds(),
+			Paused:   paused || ended,
+		})
+	}
+
+	handle := func(m wbrtc.Message) error {
+		switch m.Kind {
+		case wbrtc.PAUSE:
+			paused = true
+		case wbrtc.RESUME:
+			paused = false
+			epoch = time.Now().Add(-pts)
+
+			if ended {
+				ended = false
+				if err := seek(index.keyframes[0]); err != nil {
+					return err
+				}
+			}
+		case wbrtc.SEEK:
+			ended = false
+			if err := seek(index.nearest(time.Duration(m.Position * float64(time.Second)))); err != nil {
+				return err
+			}
+		}
+
+		report()
+
+		return nil
+	}
+
+	if err := seek(index.keyframes[0]); err != nil {
+		logger.Errorln(err)
+		return
+	}
+	report()
+
+	for {
+		if paused || ended {
+			select {
+			case m := <-s.commands:
+				if err := handle(m); err != nil {
+					logger.Errorln(err)
+					return
+				}
+			case <-s.done:
+				return
+			}
+			continue
+		}
+
+		if len(pending) == 0 {
+			n, err := file.Read(buf)
+			if n > 0 {
+				parser.Write(buf[:n], emit)
+			}
+
+			if err != nil && err != io.EOF {
+				logger.Errorf("error reading file %v: %v\n", s.source.path, err)
+				return
+			}
+
+			if err == io.EOF {
+				parser.Flush(emit)
+
+				if len(pending) > 0 {
+					continue
+				}
+
+				if !s.source.loop {
+					ended = true
+					report()
+					continue
+				}
+
+				if err := seek(index.keyframes[0]); err != nil {
+					logger.Errorln(err)
+					return
+				}
+			}
+			continue
+		}
+
+		next := pending[0]
+		pending = pending[1:]
+
+		timer := time.NewTimer(time.Until(epoch.Add(pts)))
+		select {
+		case <-timer.C:
+		case m := <-s.commands:
+			timer.Stop()
+
+			//the frame is sent after a pause, a seek drops it together with the other pending frames
+			pending = append([]*h264.Frame{next}, pending...)
+
+			if err := handle(m); err != nil {
+				logger.Errorln(err)
+				return
+			}
+			continue
+		case <-s.done:
+			timer.Stop()
+			return
+		}
+
+		next = next.WithParameterSets(index.sps, index.pps)
+		next.PTS = pts
+
+		//the peer is still connecting, the frame is sent again one frame later
+		if !s.room.WriteClientFrame(s.clientID, next) {
+			pending = append([]*h264.Frame{next}, pending...)
+			epoch = epoch.Add(index.frameDuration)
+			continue
+		}
+
+		pts += index.frameDuration
+		frame++
+
+		if time.Since(lastReport) >= playbackReportInterval {
+			report()
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package stream
+
+import (
+	"ffmpeg-webrtc/pkg/h264"
+	"ffmpeg-webrtc/pkg/logger"
+	"io"
+
+	"github.com/pion/webrtc/v3"
+)
+
+//whipSource receives h264 published over whip, for example by obs or a browser
+//the server accepts the publisher, the source reads its track
+type whipSource struct {
+	*publishedSource
+	requestKeyframe func()
+}
+
+func newWHIPSource(c *StreamConfig) (*whipSource, error) {
+	source, err := newPublishedSource(SourceTypeWHIP, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return &whipSource{publishedSource: source}, nil
+}
+
+//Start lets the frames of the publisher through, a publisher can connect at any time
+func (w *whipSource) Start() error {
+	w.publishedSource.Start()
+
+	//viewers should not wait for the next keyframe of the publisher
+	go w.RequestKeyframe()
+
+	return nil
+}
+
+//RequestKeyframe sends a pli to the publisher
+func (w *whipSource) RequestKeyframe() {
+	w.mu.Lock()
+	requestKeyframe := w.requestKeyframe
+	w.mu.Unlock()
+
+	if requestKeyframe != nil {
+		requestKeyframe()
+	}
+}
+
+//Publish reads the track of a publisher until it ends or another publisher replaces it
+func (w *whipSource) Publish(track *webrtc.TrackRemote, requestKeyframe func()) {
+	publisher := w.connect()
+	defer w.disconnect(publisher)
+
+	w.mu.Lock()
+	w.requestKeyframe = requestKeyframe
+	w.mu.Unlock()
+
+	defer func() {
+		w.mu.Lock()
+		if w.publisher == publisher {
+			w.requestKeyframe = nil
+		}
+		w.mu.Unlock()
+	}()
+
+	requestKeyframe()
+
+	depacketizer := h264.NewDepacketizer()
+	timeline := rtpTimeline{clockRate: track.Codec().ClockRate}
+
+	emit := func(frame *h264.Frame, timestamp uint32) {
+		frame.Timestamp = timeline.time(timestamp)
+		w.forward(publisher, frame)
+	}
+
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			if err != io.EOF {
+				logger.Errorf("error reading whip track: %v\n", err)
+			}
+			return
+		}
+
+		if w.replaced(publisher) {
+			return
+		}
+
+		depacketizer.Write(packet, emit)
+	}
+}
@@ -1,9 +1,10 @@
 package webrtc
 
 import (
+	"ffmpeg-webrtc/pkg/audio"
 	"ffmpeg-webrtc/pkg/h264"
-	"fmt"
-	"log"
+	"ffmpeg-webrtc/pkg/logger"
+	"io"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -24,8 +25,28 @@ type Client struct {
 	PC        *webrtc.PeerConnection
 	Estimator cc.BandwidthEstimator
 	Packets   chan *rtp.Packet
-	Frames    chan []byte
-	done      chan bool
+	Frames    chan *h264.Frame
+	//AudioTrack is nil when the room has no audio, AudioCodec is the codec negotiated for it
+	AudioTrack  *webrtc.TrackLocalStaticRTP
+	AudioSSRC   webrtc.SSRC
+	AudioSender *webrtc.RTPSender
+	AudioCodec  *audio.Codec
+	AudioFrames chan *audio.Frame
+	//clock keeps audio and video in sync, it is used by WriteRTP and read for the statistics
+	clock syncClock
+	done  chan bool
+	//viewing, started, waitKeyframe, resync, lastPTS and lastKeyframeRequest are guarded by the room
+	viewing             bool
+	started             bool
+	waitKeyframe        bool
+	resync              bool
+	lastPTS             time.Duration
+	lastKeyframeRequest time.Time
+	//rendition is the rendition the client gets, targetRendition the one it switches to at the next keyframe
+	//ptsShift is added to the timestamps of the rendition so they go on after the previous one, all guarded by the room
+	rendition       int
+	targetRendition int
+	ptsShift        time.Duration
 }
 
 func NewClient(conn *websocket.Conn, clientID string, room *Room) *Client {
@@ -35,8 +56,10 @@ func NewClient(conn *websocket.Conn, clientID string, room *Room) *Client {
 		send:    make(chan []byte, 1),
 		room:    room,
 		Packets: make(chan *rtp.Packet, 240),
-		Frames:  make(chan []byte, 240),
-		done:    make(chan bool, 1),
+		Frames:  make(chan *h264.Frame, 240),
+		//a second of 20ms packets
+		AudioFrames: make(chan *audio.Frame, 50),
+		done:        make(chan bool, 1),
 	}
 
 	return &client
@@ -46,42 +69,94 @@ func (c *Client) Read() {
 	for {
 		_, msg, err := c.conn.ReadMessage()
 		if err != nil {
-			log.Println(err)
+			logger.Errorln(err)
+			//a closed websocket means the viewer left, do not wait for ice to notice
+			c.room.RemoveClient(c.id)
+			return
+		}
+
+		//the room stops reading once its stream is removed or reconfigured
+		select {
+		case c.room.Broadcast <- msg:
+		case <-c.room.done:
 			return
 		}
-		c.room.Broadcast <- msg
 	}
 }
 
+//Write sends the queued messages until the client is stopped
 func (c *Client) Write() {
 	for {
-		msg := <-c.send
-		err := c.conn.WriteMessage(websocket.TextMessage, msg)
-		if err != nil {
+		select {
+		case msg := <-c.send:
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-c.done:
 			return
 		}
 	}
 }
 
 func (c *Client) WriteRTP() {
-	payloader := h264.NewPayloader()
-	packetizer := rtp.NewPacketizer(1460, 96, uint32(c.SSRC), payloader, rtp.NewRandomSequencer(), 90000)
+	packetizer := newPacketizer(uint32(c.SSRC))
+
+	var audioPacketizer *audioPacketizer
+	if c.AudioTrack != nil {
+		audioPacketizer = newAudioPacketizer(uint32(c.AudioSSRC), c.AudioCodec)
+	}
+
+	reports := time.NewTicker(senderReportInterval)
+	defer reports.Stop()
 
 	for {
 		select {
 		case packet := <-c.Packets:
 			c.Track.WriteRTP(packet)
 		case frame := <-c.Frames:
-			packets := packetizer.Packetize(frame, uint32(160))
+			c.clock.video(frame.PTS, time.Now())
+			packets := packetizer.packetize(frame)
 			for _, packet := range packets {
 				c.Track.WriteRTP(packet)
 			}
+		case frame := <-c.AudioFrames:
+			c.clock.audio(frame.PTS, time.Now())
+			c.AudioTrack.WriteRTP(audioPacketizer.packetize(frame))
+		case now := <-reports.C:
+			c.writeSenderReports(now, packetizer, audioPacketizer)
 		case <-c.done:
 			return
 		}
 	}
 }
 
+//writeSenderReports sends the sender reports of both tracks, they are taken from the same clock so the browser can sync them
+func (c *Client) writeSenderReports(now time.Time, packetizer *packetizer, audioPacketizer *audioPacketizer) {
+	elapsed, ok := c.clock.elapsed(now)
+	if !ok {
+		return
+	}
+
+	reports := []rtcp.Packet{packetizer.senderReport(now, elapsed)}
+	if audioPacketizer != nil {
+		reports = append(reports, audioPacketizer.senderReport(now, elapsed))
+	}
+
+	if err := c.PC.WriteRTCP(reports); err != nil {
+		logger.Debugf("client %v could not send sender reports: %v\n", c.id, err)
+		return
+	}
+
+	if offset, ok := c.clock.offset(); ok {
+		logger.Debugf("client %v audio is sent %v ahead of the video\n", c.id, offset)
+	}
+}
+
+//AVOffset returns how far the audio is sent ahead of the video, false when the client gets no audio
+func (c *Client) AVOffset() (time.Duration, bool) {
+	return c.clock.offset()
+}
+
 func (c *Client) ReadRTCP() {
 	for {
 		select {
@@ -89,24 +164,39 @@ func (c *Client) ReadRTCP() {
 			return
 		default:
 			rtcpPackets, _, err := c.RTPSender.ReadRTCP()
+			if err == io.EOF {
+				return
+			}
+
 			if err != nil {
-				fmt.Println("could not read rtcp:", err)
+				logger.Errorln("could not read rtcp:", err)
 				return
 			}
 
 			for _, packet := range rtcpPackets {
 				switch packet.(type) {
-				case *rtcp.PictureLossIndication:
-					fmt.Println("received pli")
+				case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+					c.room.RequestKeyframe(c)
 				case *rtcp.TransportLayerNack:
-					fmt.Println("received nack")
-					fmt.Println(packet.(*rtcp.TransportLayerNack).Nacks)
+					logger.Debugln("received nack")
+					logger.Debugln(packet.(*rtcp.TransportLayerNack).Nacks)
 				}
 			}
 		}
 	}
 }
 
+//ReadAudioRTCP reads the rtcp of the audio track so the interceptors process it, there is nothing to act on
+func (c *Client) ReadAudioRTCP() {
+	buf := make([]byte, 1500)
+
+	for {
+		if _, _, err := c.AudioSender.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
 func (c *Client) BandwidthEstimator() {
 	ticker := time.NewTicker(100 * time.Millisecond)
 
@@ -119,7 +209,10 @@ func (c *Client) BandwidthEstimator() {
 	for {
 		select {
 		case <-ticker.C:
-			bitrate := float64(c.Estimator.GetTargetBitrate())
+			estimate := c.Estimator.GetTargetBitrate()
+			c.room.updateRendition(c, estimate)
+
+			bitrate := float64(estimate)
 			// Keep dividing the bitrate until it's under 1000
 			for bitrate >= 1000.0 && powers < len(bitUnits) {
 				bitrate /= 1000.0
@@ -129,17 +222,52 @@ func (c *Client) BandwidthEstimator() {
 			unit := bitUnits[powers]
 			powers = 0
 
-			fmt.Printf("client %v estimated available bandwidth: %.2f %s/s\n", c.id, bitrate, unit)
+			logger.Debugf("client %v estimated available bandwidth: %.2f %s/s\n", c.id, bitrate, unit)
 		case <-c.done:
 			return
 		}
 	}
 }
 
+//sendFrame queues a frame without blocking the room, when the queue is full the frame is dropped
+//and the client skips frames until the next keyframe because it could not decode them anyway
+func (c *Client) sendFrame(frame *h264.Frame) {
+	if c.ptsShift != 0 {
+		shifted := *frame
+		shifted.PTS += c.ptsShift
+		frame = &shifted
+	}
+
+	select {
+	case c.Frames <- frame:
+		c.lastPTS = frame.PTS
+	default:
+		logger.Debugf("client %v is too slow, waiting for the next keyframe\n", c.id)
+		c.waitKeyframe = true
+	}
+}
+
+//sendAudio queues an audio frame without blocking the room, it is dropped when the queue is full
+func (c *Client) sendAudio(frame *audio.Frame) {
+	select {
+	case c.AudioFrames <- frame:
+	default:
+		logger.Debugf("client %v is too slow, dropping audio\n", c.id)
+	}
+}
+
 func (c *Client) Send(msg []byte) {
 	c.send <- msg
 }
 
+//trySend queues a message unless the client has been stopped
+func (c *Client) trySend(msg []byte) {
+	select {
+	case c.send <- msg:
+	case <-c.done:
+	}
+}
+
 func (c *Client) Stop() {
 	if c.conn != nil {
 		c.conn.Close()
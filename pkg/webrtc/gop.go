@@ -0,0 +1,81 @@
+package webrtc
+
+import (
+	"ffmpeg-webrtc/pkg/h264"
+	"time"
+)
+
+const (
+	//maxGOPFrames limits the size of the cache, longer gops are not cached and new viewers wait for the next keyframe
+	maxGOPFrames = 200
+	//replayFrameInterval is the spacing of the timestamps of replayed frames, the browser decodes them right away
+	//instead of playing them back at their original speed
+	replayFrameInterval = time.Millisecond
+)
+
+//gopCache keeps the frames since the most recent keyframe so new viewers can start decoding right away
+//the last seen sps and pps are kept as well for streams that only send them once
+type gopCache struct {
+	frames []*h264.Frame
+	sps    []byte
+	pps    []byte
+}
+
+func (g *gopCache) add(frame *h264.Frame) {
+	for _, nal := range frame.NALs {
+		switch h264.NalType(nal) {
+		case h264.NALU_TYPE_SPS:
+			g.sps = nal
+		case h264.NALU_TYPE_PPS:
+			g.pps = nal
+		}
+	}
+
+	if frame.Keyframe {
+		g.frames = append(g.frames[:0], frame.WithParameterSets(g.sps, g.pps))
+		return
+	}
+
+	if len(g.frames) == 0 {
+		return
+	}
+
+	if len(g.frames) >= maxGOPFrames {
+		g.frames = g.frames[:0]
+		return
+	}
+
+	g.frames = append(g.frames, frame)
+}
+
+//replay returns copies of the cached frames for a newly connected client
+//the timestamps are moved right in front of the newest frame so the browser decodes them at once
+//and continues with the live frames without stalling
+func (g *gopCache) replay() []*h264.Frame {
+	if len(g.frames) == 0 {
+		return nil
+	}
+
+	last := g.frames[len(g.frames)-1].PTS
+
+	return g.replayAfter(last - time.Duration(len(g.frames))*replayFrameInterval)
+}
+
+//replayAfter returns copies of the cached frames with their timestamps spread evenly between previous and the newest frame
+//it is used to resync a client that already received frames up to previous without sending timestamps backwards
+func (g *gopCache) replayAfter(previous time.Duration) []*h264.Frame {
+	if len(g.frames) == 0 {
+		return nil
+	}
+
+	last := g.frames[len(g.frames)-1].PTS
+	frames := make([]*h264.Frame, len(g.frames))
+
+	for i, frame := range g.frames {
+		replayed := *frame
+		replayed.PTS = previous + (last-previous)*time.Duration(i+1)/time.Duration(len(g.frames))
+		frames[i] = &replayed
+	}
+
+	return frames
+}
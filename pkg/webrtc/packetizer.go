@@ -0,0 +1,115 @@
+package webrtc
+
+import (
+	"ffmpeg-webrtc/pkg/audio"
+	"ffmpeg-webrtc/pkg/h264"
+	"math/rand"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+const (
+	MTU             = 1200
+	H264PayloadType = 96
+	rtpHeaderSize   = 12
+)
+
+//packetizer turns frames into rtp packets, the rtp timestamp is derived from the presentation time of the frame
+//every client has its own packetizer with a random sequence number and timestamp offset
+//packets and octets count what was sent for the sender reports
+type packetizer struct {
+	ssrc      uint32
+	payloader *h264.Payloader
+	sequencer rtp.Sequencer
+	offset    uint32
+	packets   uint32
+	octets    uint32
+}
+
+func newPacketizer(ssrc uint32) *packetizer {
+	return &packetizer{
+		ssrc:      ssrc,
+		payloader: h264.NewPayloader(),
+		sequencer: rtp.NewRandomSequencer(),
+		offset:    rand.Uint32(),
+	}
+}
+
+func (p *packetizer) packetize(frame *h264.Frame) []*rtp.Packet {
+	payloads := p.payloader.Payload(MTU-rtpHeaderSize, frame.Data)
+	packets := make([]*rtp.Packet, len(payloads))
+	timestamp := p.offset + frame.RTPTimestamp()
+
+	for i, payload := range payloads {
+		packets[i] = &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Padding:        false,
+				Extension:      false,
+				Marker:         i == len(payloads)-1,
+				PayloadType:    H264PayloadType,
+				SequenceNumber: p.sequencer.NextSequenceNumber(),
+				Timestamp:      timestamp,
+				SSRC:           p.ssrc,
+			},
+			Payload: payload,
+		}
+
+		p.packets++
+		p.octets += uint32(len(payload))
+	}
+
+	return packets
+}
+
+//senderReport maps the presentation time elapsed at now to the rtp clock of the video
+func (p *packetizer) senderReport(now time.Time, elapsed time.Duration) *rtcp.SenderReport {
+	return senderReport(p.ssrc, now, p.offset+rtpTime(elapsed, h264.ClockRate), p.packets, p.octets)
+}
+
+//audioPacketizer puts every audio frame into a single rtp packet, the rtp timestamp runs on the clock of the codec
+type audioPacketizer struct {
+	ssrc      uint32
+	codec     *audio.Codec
+	sequencer rtp.Sequencer
+	offset    uint32
+	packets   uint32
+	octets    uint32
+}
+
+func newAudioPacketizer(ssrc uint32, codec *audio.Codec) *audioPacketizer {
+	return &audioPacketizer{
+		ssrc:      ssrc,
+		codec:     codec,
+		sequencer: rtp.NewRandomSequencer(),
+		offset:    rand.Uint32(),
+	}
+}
+
+func (p *audioPacketizer) packetize(frame *audio.Frame) *rtp.Packet {
+	p.packets++
+	p.octets += uint32(len(frame.Data))
+
+	return &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    p.codec.PayloadType,
+			SequenceNumber: p.sequencer.NextSequenceNumber(),
+			Timestamp:      p.offset + frame.RTPTimestamp(p.codec.ClockRate),
+			SSRC:           p.ssrc,
+		},
+		Payload: frame.Data,
+	}
+}
+
+//senderReport maps the presentation time elapsed at now to the rtp clock of the audio
+func (p *audioPacketizer) senderReport(now time.Time, elapsed time.Duration) *rtcp.SenderReport {
+	return senderReport(p.ssrc, now, p.offset+rtpTime(elapsed, p.codec.ClockRate), p.packets, p.octets)
+}
+
+//rtpTime converts a presentation time to a clock rate the same way the frames do
+func rtpTime(pts time.Duration, clockRate uint32) uint32 {
+	return uint32(uint64(pts/time.Microsecond) * uint64(clockRate) / 1000000)
+}
@@ -0,0 +1,117 @@
+package webrtc
+
+import (
+	"ffmpeg-webrtc/pkg/h264"
+	"ffmpeg-webrtc/pkg/logger"
+
+	"github.com/pion/webrtc/v3"
+)
+
+//renditionHeadroom is how many percent the estimate has to exceed the bitrate of a better rendition before a viewer switches up to it
+const renditionHeadroom = 20
+
+//selectRendition returns the rendition a viewer gets for its estimated bitrate, bitrates holds what every rendition needs
+//a viewer switches down as soon as its rendition does not fit the estimate and up only with headroom, so it does not flap
+//the worst rendition is used when none fits
+func selectRendition(bitrates []int, current int, estimate int) int {
+	best := -1
+	worst := 0
+
+	for i, bitrate := range bitrates {
+		if bitrate < bitrates[worst] {
+			worst = i
+		}
+
+		required := bitrate
+		if bitrate > bitrates[current] {
+			required += bitrate * renditionHeadroom / 100
+		}
+
+		if estimate >= required && (best < 0 || bitrate > bitrates[best]) {
+			best = i
+		}
+	}
+
+	if best < 0 {
+		return worst
+	}
+
+	return best
+}
+
+//followsRendition reports whether a frame of a rendition goes to the client, it must be called with the room locked
+//a client waiting for another rendition is switched over at its next keyframe, the timestamps go on after the last frame
+//the client got so the browser keeps seeing a single stream
+func (c *Client) followsRendition(index int, frame *h264.Frame) bool {
+	if index != c.rendition && index == c.targetRendition && frame.Keyframe {
+		logger.Debugf("client %v switched from rendition %d to %d\n", c.id, c.rendition, index)
+
+		c.rendition = index
+		c.waitKeyframe = false
+		c.resync = false
+
+		c.ptsShift = 0
+		if frame.PTS <= c.lastPTS {
+			c.ptsShift = c.lastPTS + replayFrameInterval - frame.PTS
+		}
+	}
+
+	return index == c.rendition
+}
+
+//SetRenditions sets the bitrates a viewer needs for every rendition, the first one is the video of WriteFrame
+//the others are written with WriteRenditionFrame, nil turns simulcast off
+//every client goes back to the first rendition at its next keyframe
+func (r *Room) SetRenditions(bitrates []int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.renditions = bitrates
+
+	for _, client := range r.Clients {
+		if client.rendition != 0 {
+			client.waitKeyframe = true
+		}
+		client.rendition = 0
+		client.targetRendition = 0
+	}
+}
+
+//updateRendition selects the rendition of a client from its bandwidth estimate, it switches at the next keyframe of the rendition
+func (r *Room) updateRendition(client *Client, estimate int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.renditions) < 2 {
+		return
+	}
+
+	target := selectRendition(r.renditions, client.rendition, estimate)
+	if target != client.targetRendition {
+		logger.Debugf("client %v estimated %d b/s, waiting for a keyframe of rendition %d\n", client.id, estimate, target)
+		client.targetRendition = target
+	}
+}
+
+//WriteRenditionFrame fans a frame of a rendition out to the clients that get the rendition or wait to switch to it
+func (r *Room) WriteRenditionFrame(index int, frame *h264.Frame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, client := range r.Clients {
+		if !client.started || client.PC == nil || client.PC.ConnectionState() != webrtc.PeerConnectionStateConnected {
+			continue
+		}
+
+		if !client.followsRendition(index, frame) {
+			continue
+		}
+
+		if client.waitKeyframe && !frame.Keyframe {
+			continue
+		}
+		client.waitKeyframe = false
+
+		client.sendFrame(frame)
+	}
+}
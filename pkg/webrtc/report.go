@@ -0,0 +1,96 @@
+package webrtc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+const (
+	//senderReportInterval is how often the sender reports of the audio and video of a client are sent
+	senderReportInterval = time.Second
+	//ntpEpochOffset is the number of seconds between the ntp epoch in 1900 and the unix epoch
+	ntpEpochOffset = 2208988800
+)
+
+//syncClock is the clock the audio and video of a client share, presentation time 0 is at origin
+//the sender reports of both tracks map their rtp timestamps to it, so the browser plays audio and video in sync
+//the lead of a track is how much earlier than its time on the clock a frame is sent, it is smoothed like rtp jitter
+type syncClock struct {
+	started   bool
+	origin    time.Time
+	videoLead time.Duration
+	audioLead time.Duration
+	hasAudio  bool
+	mu        sync.Mutex
+}
+
+//video starts the clock with the first frame sent to the client and measures the lead of the video
+func (c *syncClock) video(pts time.Duration, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.started {
+		c.started = true
+		c.origin = now.Add(-pts)
+	}
+
+	c.videoLead += (c.origin.Add(pts).Sub(now) - c.videoLead) / 16
+}
+
+//audio measures the lead of the audio, audio sent before the first video frame has no picture to sync to
+func (c *syncClock) audio(pts time.Duration, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.started {
+		return
+	}
+
+	lead := c.origin.Add(pts).Sub(now)
+	if !c.hasAudio {
+		c.hasAudio = true
+		c.audioLead = lead
+		return
+	}
+
+	c.audioLead += (lead - c.audioLead) / 16
+}
+
+//elapsed returns the presentation time that is due at now, false before the first frame
+func (c *syncClock) elapsed(now time.Time) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return now.Sub(c.origin), c.started
+}
+
+//offset returns how far the audio is sent ahead of the video, negative when it lags behind
+//the browser evens it out with the sender reports as long as its buffers allow, false while there is no audio
+func (c *syncClock) offset() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.audioLead - c.videoLead, c.hasAudio
+}
+
+//senderReport ties an rtp timestamp to the wall clock, packets and octets count what was sent with the ssrc
+func senderReport(ssrc uint32, now time.Time, rtpTime uint32, packets uint32, octets uint32) *rtcp.SenderReport {
+	return &rtcp.SenderReport{
+		SSRC:        ssrc,
+		NTPTime:     ntpTime(now),
+		RTPTime:     rtpTime,
+		PacketCount: packets,
+		OctetCount:  octets,
+	}
+}
+
+//ntpTime converts a time to the 64 bit ntp format, seconds since 1900 and the fraction of a second
+func ntpTime(t time.Time) uint64 {
+	nanos := uint64(t.UnixNano()) + ntpEpochOffset*uint64(time.Second)
+	seconds := nanos / uint64(time.Second)
+	fraction := (nanos % uint64(time.Second)) << 32 / uint64(time.Second)
+
+	return seconds<<32 | fraction
+}
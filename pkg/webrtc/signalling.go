@@ -2,13 +2,17 @@ package webrtc
 
 import (
 	"encoding/json"
-	"fmt"
+	"ffmpeg-webrtc/pkg/audio"
+	"ffmpeg-webrtc/pkg/h264"
+	"ffmpeg-webrtc/pkg/logger"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/pion/interceptor"
 	"github.com/pion/interceptor/pkg/cc"
 	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/interceptor/pkg/report"
 	"github.com/pion/webrtc/v3"
 )
 
@@ -17,8 +21,16 @@ const (
 	ANSWER
 	ICECANDIDATE
 	STOP
+	//PAUSE, RESUME and SEEK control the playback of a recording, PLAYBACK reports its state to the client
+	PAUSE
+	RESUME
+	SEEK
+	PLAYBACK
 )
 
+//keyframeRequestInterval is the minimum time between two keyframe requests
+const keyframeRequestInterval = time.Second
+
 const (
 	LowBitrate      = 100_000
 	MidBitrate      = 300_000
@@ -27,50 +39,72 @@ const (
 )
 
 type Room struct {
-	Clients    map[string]*Client
-	Broadcast  chan []byte
-	Register   chan *Client
-	Unregister chan *Client
+	Clients   map[string]*Client
+	Broadcast chan []byte
+	Register  chan *Client
+	gop       gopCache
+	//onKeyframeRequest asks the source for a keyframe, lastKeyframeRequest rate limits it across all clients
+	onKeyframeRequest   func()
+	lastKeyframeRequest time.Time
+	//viewers counts the clients with a connected peer, onViewersChange is called when it changes from or to 0
+	viewers         int
+	onViewersChange func()
+	//onViewer is told about every viewer that connects or leaves, onPlayback receives the playback messages
+	onViewer   func(clientID string, joined bool)
+	onPlayback func(clientID string, m Message)
+	//audioCodec is the codec of the audio of the source, nil when it has none
+	audioCodec *audio.Codec
+	//renditions holds the bitrates a viewer needs for every rendition of the video, nil without simulcast
+	renditions []int
 	done       chan bool
 	mu         sync.Mutex
+
+	//startBitrate is the bitrate the bandwidth estimation of a new viewer starts from
+	startBitrate int
 }
 
 func NewRoom(done chan bool) *Room {
 	return &Room{
-		Clients:    make(map[string]*Client),
-		Broadcast:  make(chan []byte, 1),
-		Register:   make(chan *Client, 1),
-		Unregister: make(chan *Client, 1),
-		mu:         sync.Mutex{},
-		done:       done,
+		Clients:   make(map[string]*Client),
+		Broadcast: make(chan []byte, 1),
+		Register:  make(chan *Client, 1),
+		mu:        sync.Mutex{},
+		done:      done,
+
+		startBitrate: LowBitrate,
 	}
 }
 
 func (r *Room) Start() {
 	for {
 		select {
+		case <-r.done:
+			r.mu.Lock()
+			for id, client := range r.Clients {
+				if client.PC != nil {
+					client.PC.Close()
+				}
+				client.Stop()
+				delete(r.Clients, id)
+			}
+			r.viewers = 0
+			r.mu.Unlock()
+			return
 		case client := <-r.Register:
-			fmt.Println("registering client with id: ", client.id)
+			logger.Debugln("registering client with id: ", client.id)
 			r.mu.Lock()
 			r.Clients[client.id] = client
 			r.mu.Unlock()
-		case client := <-r.Unregister:
-			if _, ok := r.Clients[client.id]; ok {
-				r.mu.Lock()
-				delete(r.Clients, client.id)
-				r.mu.Unlock()
-				close(client.send)
-			}
 		case msg := <-r.Broadcast:
 			var m Message
 			if err := json.Unmarshal(msg, &m); err != nil {
-				fmt.Println(err)
+				logger.Errorln(err)
 				continue
 			}
 
 			client, exists := r.Clients[m.ClientID]
 			if !exists {
-				fmt.Println("client does not exist")
+				logger.Errorln("client does not exist")
 				continue
 			}
 
@@ -79,7 +113,7 @@ func (r *Room) Start() {
 
 				codec := webrtc.RTPCodecCapability{
 					MimeType:    webrtc.MimeTypeH264,
-					ClockRate:   90000,
+					ClockRate:   h264.ClockRate,
 					Channels:    0,
 					SDPFmtpLine: "packetization-mode=1",
 					RTCPFeedback: []webrtc.RTCPFeedback{
@@ -91,18 +125,37 @@ func (r *Room) Start() {
 					},
 				}
 
-				if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{RTPCodecCapability: codec, PayloadType: 96}, webrtc.RTPCodecTypeVideo); err != nil {
-					fmt.Println("error registering codec: ", err)
+				if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{RTPCodecCapability: codec, PayloadType: H264PayloadType}, webrtc.RTPCodecTypeVideo); err != nil {
+					logger.Errorln("error registering codec: ", err)
+				}
+
+				r.mu.Lock()
+				audioCodec := r.audioCodec
+				startBitrate := r.startBitrate
+				r.mu.Unlock()
+
+				var audioCapability webrtc.RTPCodecCapability
+				if audioCodec != nil {
+					audioCapability = webrtc.RTPCodecCapability{
+						MimeType:    audioCodec.MimeType,
+						ClockRate:   audioCodec.ClockRate,
+						Channels:    audioCodec.Channels,
+						SDPFmtpLine: audioCodec.SDPFmtpLine,
+					}
+
+					if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{RTPCodecCapability: audioCapability, PayloadType: webrtc.PayloadType(audioCodec.PayloadType)}, webrtc.RTPCodecTypeAudio); err != nil {
+						logger.Errorln("error registering audio codec: ", err)
+					}
 				}
 
 				interceptorRegistry := interceptor.Registry{}
 
 				congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
-					return gcc.NewSendSideBWE(gcc.SendSideBWEInitialBitrate(LowBitrate))
+					return gcc.NewSendSideBWE(gcc.SendSideBWEInitialBitrate(startBitrate))
 				})
 
 				if err != nil {
-					fmt.Println("error creating congestion controller: ", err)
+					logger.Errorln("error creating congestion controller: ", err)
 				}
 
 				estimatorChan := make(chan cc.BandwidthEstimator, 1)
@@ -114,18 +167,19 @@ func (r *Room) Start() {
 				interceptorRegistry.Add(congestionController)
 
 				if err = webrtc.ConfigureTWCCHeaderExtensionSender(&mediaEngine, &interceptorRegistry); err != nil {
-					fmt.Println("error registering default interceptors: ", err)
+					logger.Errorln("error registering default interceptors: ", err)
 				}
 
-				if err = webrtc.RegisterDefaultInterceptors(&mediaEngine, &interceptorRegistry); err != nil {
-					fmt.Println("error registering default interceptors: ", err)
+				//the sender reports are not left to pion, the client sends them from the clock it shares with the audio
+				if err = registerInterceptors(&mediaEngine, &interceptorRegistry); err != nil {
+					logger.Errorln("error registering interceptors: ", err)
 				}
 
 				api := webrtc.NewAPI(webrtc.WithMediaEngine(&mediaEngine), webrtc.WithInterceptorRegistry(&interceptorRegistry))
 
 				peerConnection, err := api.NewPeerConnection(webrtc.Configuration{PeerIdentity: m.ClientID, ICEServers: []webrtc.ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}}})
 				if err != nil {
-					fmt.Println("error creating peer connection: ", err)
+					logger.Errorln("error creating peer connection: ", err)
 					continue
 				}
 
@@ -135,7 +189,7 @@ func (r *Room) Start() {
 				r.HandlePeer(peerConnection, client.id)
 
 				if err := peerConnection.SetRemoteDescription(m.Offer); err != nil {
-					fmt.Println("error setting remote description: ", err)
+					logger.Errorln("error setting remote description: ", err)
 					continue
 				}
 
@@ -152,16 +206,16 @@ func (r *Room) Start() {
 
 					msgJSON, err := json.Marshal(msg)
 					if err != nil {
-						fmt.Println("error marshalling iceCandidate message: ", err)
+						logger.Errorln("error marshalling iceCandidate message: ", err)
 						return
 					}
 
-					client.Send(msgJSON)
+					client.trySend(msgJSON)
 				})
 
 				_, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RtpTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
 				if err != nil {
-					fmt.Println("error adding transceiver: ", err)
+					logger.Errorln("error adding transceiver: ", err)
 					continue
 				}
 
@@ -170,12 +224,12 @@ func (r *Room) Start() {
 
 				trackLocalStaticRTP, err := webrtc.NewTrackLocalStaticRTP(codec, streamID, trackID)
 				if err != nil {
-					fmt.Println("error creating rtp track: ", err)
+					logger.Errorln("error creating rtp track: ", err)
 				}
 
 				rtpSender, err := peerConnection.AddTrack(trackLocalStaticRTP)
 				if err != nil {
-					fmt.Println("error adding rtp video track: ", err)
+					logger.Errorln("error adding rtp video track: ", err)
 					continue
 				}
 
@@ -185,14 +239,34 @@ func (r *Room) Start() {
 				client.RTPSender = rtpSender
 				client.SSRC = encoding[0].SSRC
 
+				//the audio shares the stream id of the video so the browser plays them in sync
+				if audioCodec != nil {
+					audioTrack, err := webrtc.NewTrackLocalStaticRTP(audioCapability, streamID, uuid.New().String())
+					if err != nil {
+						logger.Errorln("error creating audio track: ", err)
+						continue
+					}
+
+					audioSender, err := peerConnection.AddTrack(audioTrack)
+					if err != nil {
+						logger.Errorln("error adding audio track: ", err)
+						continue
+					}
+
+					client.AudioTrack = audioTrack
+					client.AudioSender = audioSender
+					client.AudioSSRC = audioSender.GetParameters().Encodings[0].SSRC
+					client.AudioCodec = audioCodec
+				}
+
 				answer, err := peerConnection.CreateAnswer(nil)
 				if err != nil {
-					fmt.Println("error creating answer: ", err)
+					logger.Errorln("error creating answer: ", err)
 					continue
 				}
 
 				if err := peerConnection.SetLocalDescription(answer); err != nil {
-					fmt.Println("error setting local description: ", err)
+					logger.Errorln("error setting local description: ", err)
 					continue
 				}
 
@@ -204,65 +278,426 @@ func (r *Room) Start() {
 
 				msgJSON, err := json.Marshal(msg)
 				if err != nil {
-					fmt.Println("error marshalling answer message: ", err)
+					logger.Errorln("error marshalling answer message: ", err)
 					continue
 				}
 
-				client.Send(msgJSON)
+				client.trySend(msgJSON)
 			}
 
 			if m.Kind == ICECANDIDATE {
-				fmt.Println("iceCandidate from client received")
-				fmt.Println("iceCandidate: ", m.ClientICECandidate)
+				logger.Debugln("iceCandidate from client received")
+				logger.Debugln("iceCandidate: ", m.ClientICECandidate)
 
 				err := client.PC.AddICECandidate(m.ClientICECandidate)
 				if err != nil {
-					fmt.Println("error adding ice candidate: ", err)
+					logger.Errorln("error adding ice candidate: ", err)
+				}
+				continue
+			}
+
+			if m.Kind == PAUSE || m.Kind == RESUME || m.Kind == SEEK {
+				r.mu.Lock()
+				onPlayback := r.onPlayback
+				r.mu.Unlock()
+
+				if onPlayback != nil {
+					onPlayback(client.id, m)
 				}
 				continue
 			}
 
 			//TODO: handle stop
 			if m.Kind == STOP {
-				fmt.Println("stop from client received")
+				logger.Infoln("stop from client received")
 				client.Stop()
 			}
 		}
 	}
 }
 
+//registerInterceptors registers the default interceptors of pion without its sender reports
+func registerInterceptors(mediaEngine *webrtc.MediaEngine, interceptorRegistry *interceptor.Registry) error {
+	if err := webrtc.ConfigureNack(mediaEngine, interceptorRegistry); err != nil {
+		return err
+	}
+
+	receiver, err := report.NewReceiverInterceptor()
+	if err != nil {
+		return err
+	}
+	interceptorRegistry.Add(receiver)
+
+	return webrtc.ConfigureTWCCSender(mediaEngine, interceptorRegistry)
+}
+
 func (r *Room) HandlePeer(pc *webrtc.PeerConnection, clientID string) {
 	pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		fmt.Printf("ICE connection state for peer:%v has changed:%v\n", clientID, connectionState.String())
+		logger.Debugf("ICE connection state for peer:%v has changed:%v\n", clientID, connectionState.String())
 
 		if connectionState == webrtc.ICEConnectionStateConnected {
-			fmt.Println("peer connected")
+			logger.Infoln("peer connected")
+
+			r.mu.Lock()
+			client, exists := r.Clients[clientID]
+			if exists {
+				r.addViewer(client)
+			}
+			r.mu.Unlock()
+
+			if !exists {
+				return
+			}
 
-			go r.Clients[clientID].WriteRTP()
-			go r.Clients[clientID].ReadRTCP()
-			go r.Clients[clientID].BandwidthEstimator()
+			go client.WriteRTP()
+			go client.ReadRTCP()
+			if client.AudioSender != nil {
+				go client.ReadAudioRTCP()
+			}
+			go client.BandwidthEstimator()
 
 			return
 		}
 
 		if connectionState == webrtc.ICEConnectionStateDisconnected {
-			fmt.Printf("peer %v disconnected\n", clientID)
+			logger.Infof("peer %v disconnected\n", clientID)
 			r.RemoveClient(clientID)
 			return
 		}
 
 		if connectionState == webrtc.ICEConnectionStateFailed {
-			fmt.Printf("peer %v failed\n", clientID)
+			logger.Errorf("peer %v failed\n", clientID)
+			r.RemoveClient(clientID)
 			return
 		}
 	})
 }
 
+//addViewer and removeViewer track the clients with a connected peer, they must be called with the room locked
+func (r *Room) addViewer(client *Client) {
+	if client.viewing {
+		return
+	}
+
+	client.viewing = true
+	r.viewers++
+
+	if r.onViewer != nil {
+		r.onViewer(client.id, true)
+	}
+
+	if r.viewers == 1 && r.onViewersChange != nil {
+		go r.onViewersChange()
+	}
+}
+
+func (r *Room) removeViewer(client *Client) {
+	if !client.viewing {
+		return
+	}
+
+	client.viewing = false
+	r.viewers--
+
+	if r.onViewer != nil {
+		r.onViewer(client.id, false)
+	}
+
+	if r.viewers == 0 && r.onViewersChange != nil {
+		go r.onViewersChange()
+	}
+}
+
+//Viewers returns the number of clients with a connected peer
+func (r *Room) Viewers() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.viewers
+}
+
+//OnViewersChange sets the function called when the first viewer connects and when the last one leaves
+//it is called in its own goroutine, Viewers tells which of the two happened
+func (r *Room) OnViewersChange(f func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.onViewersChange = f
+}
+
+//OnViewer sets the function told about every viewer that connects or leaves
+//it is called with the room locked and must not call back into the room
+func (r *Room) OnViewer(f func(clientID string, joined bool)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.onViewer = f
+}
+
+//ViewerIDs returns the ids of the clients with a connected peer
+func (r *Room) ViewerIDs() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ids []string
+	for id, client := range r.Clients {
+		if client.viewing {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+//OnPlayback sets the function that handles the pause, resume and seek messages of the clients
+func (r *Room) OnPlayback(f func(clientID string, m Message)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.onPlayback = f
+}
+
+//WriteClientFrame sends a frame to a single client, it is used when every client has its own playback
+//it returns false without sending the frame while the peer of the client is not connected yet
+func (r *Room) WriteClientFrame(clientID string, frame *h264.Frame) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	client, exists := r.Clients[clientID]
+	if !exists || client.PC == nil || client.PC.ConnectionState() != webrtc.PeerConnectionStateConnected {
+		return false
+	}
+
+	if client.waitKeyframe && !frame.Keyframe {
+		return true
+	}
+	client.waitKeyframe = false
+
+	client.sendFrame(frame)
+
+	return true
+}
+
+//SendMessage sends a signalling message to a single client, it is dropped if the client has gone
+func (r *Room) SendMessage(clientID string, m Message) {
+	r.mu.Lock()
+	client, exists := r.Clients[clientID]
+	r.mu.Unlock()
+
+	if !exists {
+		return
+	}
+
+	m.ClientID = clientID
+
+	msgJSON, err := json.Marshal(m)
+	if err != nil {
+		logger.Errorln("error marshalling message: ", err)
+		return
+	}
+
+	client.trySend(msgJSON)
+}
+
+//AVOffset returns how far the audio is sent ahead of the video, averaged over the viewers that get audio
+//false when no viewer gets audio
+func (r *Room) AVOffset() (time.Duration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var total time.Duration
+	count := 0
+
+	for _, client := range r.Clients {
+		if offset, ok := client.AVOffset(); ok {
+			total += offset
+			count++
+		}
+	}
+
+	if count == 0 {
+		return 0, false
+	}
+
+	return total / time.Duration(count), true
+}
+
+//BandwidthEstimates returns the bitrates in bit/s the bandwidth estimation of every viewer currently allows
+func (r *Room) BandwidthEstimates() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var estimates []int
+	for _, client := range r.Clients {
+		if client.viewing && client.Estimator != nil {
+			estimates = append(estimates, client.Estimator.GetTargetBitrate())
+		}
+	}
+
+	return estimates
+}
+
+//SetStartBitrate sets the bitrate the bandwidth estimation of new viewers starts from, LowBitrate by default
+//starting from the bitrate the source sends lets a new viewer get it without waiting for the estimate to ramp up
+func (r *Room) SetStartBitrate(bitrate int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.startBitrate = bitrate
+}
+
+//ClientCount returns the number of registered clients
+func (r *Room) ClientCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.Clients)
+}
+
+//WriteFrame fans a frame out to every connected client
+//a newly connected client first gets the cached gop, a client that fell behind waits for the next keyframe
+func (r *Room) WriteFrame(frame *h264.Frame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.gop.add(frame)
+
+	for _, client := range r.Clients {
+		if client.PC == nil || client.PC.ConnectionState() != webrtc.PeerConnectionStateConnected {
+			continue
+		}
+
+		if !client.started {
+			frames := r.gop.replay()
+			if len(frames) == 0 {
+				continue
+			}
+
+			client.started = true
+			client.waitKeyframe = false
+
+			for _, replayed := range frames {
+				client.sendFrame(replayed)
+			}
+			continue
+		}
+
+		if !client.followsRendition(0, frame) {
+			continue
+		}
+
+		//a client that lost a keyframe gets the cached gop again, squeezed in before the current frame
+		if client.resync && !frame.Keyframe {
+			client.resync = false
+
+			if frames := r.gop.replayAfter(client.lastPTS - client.ptsShift); len(frames) > 0 {
+				for _, replayed := range frames {
+					client.sendFrame(replayed)
+				}
+				continue
+			}
+		}
+		client.resync = false
+
+		if client.waitKeyframe && !frame.Keyframe {
+			continue
+		}
+		client.waitKeyframe = false
+
+		client.sendFrame(frame)
+	}
+}
+
+//SetAudioCodec sets the codec of the audio of the source, nil removes the audio
+//it applies to viewers that connect afterwards, connected viewers keep the tracks they negotiated
+func (r *Room) SetAudioCodec(codec *audio.Codec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.audioCodec = codec
+}
+
+//WriteAudio fans an audio frame out to every client that plays the video and negotiated the same codec
+func (r *Room) WriteAudio(frame *audio.Frame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, client := range r.Clients {
+		if client.AudioTrack == nil || client.AudioCodec != r.audioCodec || !client.started {
+			continue
+		}
+
+		if client.PC == nil || client.PC.ConnectionState() != webrtc.PeerConnectionStateConnected {
+			continue
+		}
+
+		client.sendAudio(frame)
+	}
+}
+
+//ResetGOP drops the cached gop, it is used when the source is replaced
+func (r *Room) ResetGOP() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.gop = gopCache{}
+}
+
+//OnKeyframeRequest sets the function that asks the source for a keyframe
+func (r *Room) OnKeyframeRequest(f func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.onKeyframeRequest = f
+}
+
+//RequestKeyframe handles a pli or fir from a client
+//the cached gop is replayed to a client of the first rendition when there is one, otherwise the source is asked for a keyframe
+//requests are limited to one per keyframeRequestInterval per client and across all clients for the source
+func (r *Room) RequestKeyframe(client *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(client.lastKeyframeRequest) < keyframeRequestInterval {
+		return
+	}
+	client.lastKeyframeRequest = now
+
+	//only the first rendition is cached, a client of another one waits for the keyframe the source is asked for
+	if client.rendition != 0 {
+		client.waitKeyframe = true
+	} else if len(r.gop.frames) > 0 {
+		client.resync = true
+		return
+	}
+
+	if r.onKeyframeRequest == nil || now.Sub(r.lastKeyframeRequest) < keyframeRequestInterval {
+		return
+	}
+	r.lastKeyframeRequest = now
+
+	go r.onKeyframeRequest()
+}
+
 func (r *Room) RemoveClient(clientID string) {
-	r.Clients[clientID].Stop()
 	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	client, exists := r.Clients[clientID]
+	if !exists {
+		return
+	}
+
+	client.Stop()
+	r.removeViewer(client)
 	delete(r.Clients, clientID)
-	r.mu.Unlock()
+
+	//closing the peer changes its ice state, which calls RemoveClient again
+	if client.PC != nil {
+		go client.PC.Close()
+	}
 }
 
 type Message struct {
@@ -272,4 +707,8 @@ type Message struct {
 	Answer             webrtc.SessionDescription `json:"answer"`
 	ICECandidate       *webrtc.ICECandidate      `json:"ice_candidate"`
 	ClientICECandidate webrtc.ICECandidateInit   `json:"client_ice_candidate"`
+	//Position and Duration are in seconds, Position is the seek target of SEEK and the playback position of PLAYBACK
+	Position float64 `json:"position,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+	Paused   bool    `json:"paused,omitempty"`
 }